@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/sillamilla/user_microservice/internal/users/service/helper"
+	"log"
+	"os"
+)
+
+// runBuildBreachFilter implements the build-breach-filter subcommand. It
+// turns a raw HIBP file of HASH:COUNT lines into the Bloom filter read with
+// BREACH_SOURCE=bloom:
+//
+//	build-breach-filter -in pwned-passwords-sha1.txt -out breach.bloom [-fp 0.001] [-min-count 1]
+//
+// Set -min-count to the BREACH_THRESHOLD the filter is used with.
+func runBuildBreachFilter(args []string) {
+	flags := flag.NewFlagSet("build-breach-filter", flag.ExitOnError)
+	in := flags.String("in", "", "raw HIBP file with SHA-1 HASH:COUNT lines")
+	out := flags.String("out", "breach.bloom", "file to write the filter to")
+	fp := flags.Float64("fp", 0.001, "false positive rate")
+	minCount := flags.Int64("min-count", 1, "leave out hashes seen fewer times")
+	err := flags.Parse(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *in == "" {
+		log.Fatal("build-breach-filter: -in is required")
+	}
+	if *fp <= 0 || *fp >= 1 {
+		log.Fatal("build-breach-filter: -fp must be between 0 and 1")
+	}
+
+	filter, err := helper.BuildBloomFilter(*in, *fp, *minCount)
+	if err != nil {
+		log.Fatal("build-breach-filter: ", err)
+	}
+
+	file, err := os.Create(*out)
+	if err != nil {
+		log.Fatal("build-breach-filter: ", err)
+	}
+
+	size, err := filter.WriteTo(file)
+	if err != nil {
+		file.Close()
+		log.Fatal("build-breach-filter: ", err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		log.Fatal("build-breach-filter: ", err)
+	}
+
+	fmt.Printf("wrote %s, %d bytes\n", *out, size)
+}
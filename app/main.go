@@ -2,78 +2,322 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"expvar"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/redis/go-redis/v9"
 	"github.com/sillamilla/user_microservice/handler"
 	"github.com/sillamilla/user_microservice/internal/config"
+	"github.com/sillamilla/user_microservice/internal/mailer"
+	"github.com/sillamilla/user_microservice/internal/ratelimit"
 	"github.com/sillamilla/user_microservice/internal/users/Mongo_storage"
+	"github.com/sillamilla/user_microservice/internal/users/Postgres_storage"
 	"github.com/sillamilla/user_microservice/internal/users/Redis_storage"
+	"github.com/sillamilla/user_microservice/internal/users/Sqlite_storage"
 	"github.com/sillamilla/user_microservice/internal/users/service"
+	"github.com/sillamilla/user_microservice/internal/users/service/helper"
+	"github.com/sillamilla/user_microservice/internal/users/token"
+	"github.com/sillamilla/user_microservice/internal/users/validation"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"log"
 	"net/http"
+	"os"
 )
 
 func main() {
 	cfg := config.GetConfig()
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(cfg, os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "build-breach-filter" {
+		runBuildBreachFilter(os.Args[2:])
+		return
+	}
+
 	//REDIS
-	dbRedis := redis.NewClient(&redis.Options{
-		Network:  cfg.Redis.Network,
-		Addr:     cfg.Redis.Address,
-		Password: cfg.Redis.Password,
-	})
+	var dbRedis *redis.Client
+	if cfg.Storage.Sessions == "redis" || cfg.RateLimit.Backend == "redis" {
+		dbRedis = redis.NewClient(&redis.Options{
+			Network:  cfg.Redis.Network,
+			Addr:     cfg.Redis.Address,
+			Password: cfg.Redis.Password,
+		})
 
-	defer func(dbRedis *redis.Client) {
-		err := dbRedis.Close()
+		defer func(dbRedis *redis.Client) {
+			err := dbRedis.Close()
+			if err != nil {
+				log.Fatal(err)
+			}
+		}(dbRedis)
+
+		err := dbRedis.Ping(context.Background()).Err()
+		if err != nil {
+			log.Fatal("Connect error Redis:", err)
+		}
+	}
+
+	//SQLITE
+	var dbSqlite *sql.DB
+	if cfg.Storage.Users == "sqlite" || cfg.Storage.Sessions == "sqlite" {
+		var err error
+		dbSqlite, err = Sqlite_storage.Open(cfg.Sqlite.Path)
 		if err != nil {
 			log.Fatal(err)
 		}
-	}(dbRedis)
+		defer func(dbSqlite *sql.DB) {
+			err = dbSqlite.Close()
+			if err != nil {
+				log.Fatal(err)
+			}
+		}(dbSqlite)
 
-	err := dbRedis.Ping(context.Background()).Err()
-	if err != nil {
-		log.Fatal("Connect error Redis:", err)
+		err = Sqlite_storage.Migrate(context.Background(), dbSqlite)
+		if err != nil {
+			log.Fatal("Migrate SQLite:", err)
+		}
+	}
+
+	var re Redis_storage.Storage
+	switch cfg.Storage.Sessions {
+	case "redis":
+		re = Redis_storage.New(dbRedis)
+	case "sqlite":
+		re = Sqlite_storage.NewSessions(dbSqlite)
+		go Sqlite_storage.Sweep(context.Background(), dbSqlite, cfg.Sqlite.SweepInterval)
+	case "memory":
+		re = Redis_storage.NewMemory()
+	default:
+		log.Fatal("Unknown SESSION_STORAGE:", cfg.Storage.Sessions)
 	}
 
 	//MONGO
-	dbMongo, err := mongo.Connect(context.Background(), options.Client().ApplyURI(cfg.Mongo.Address))
+	var mo Mongo_storage.Storage
+	switch cfg.Storage.Users {
+	case "mongo":
+		dbMongo, err := mongo.Connect(context.Background(), options.Client().ApplyURI(cfg.Mongo.Address))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer func(dbMongo *mongo.Client, ctx context.Context) {
+			err = dbMongo.Disconnect(ctx)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}(dbMongo, context.Background())
+
+		err = dbMongo.Ping(context.Background(), nil)
+		if err != nil {
+			log.Fatal("Connect error Mongo:", err)
+		}
+
+		err = Mongo_storage.CheckMigrations(context.Background(), dbMongo)
+		if err != nil {
+			log.Fatal("Mongo: ", err, ", run the migrate up subcommand first")
+		}
+
+		mo = Mongo_storage.New(dbMongo)
+	case "postgres":
+		dbPostgres, err := sql.Open("postgres", cfg.Postgres.DSN)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer func(dbPostgres *sql.DB) {
+			err = dbPostgres.Close()
+			if err != nil {
+				log.Fatal(err)
+			}
+		}(dbPostgres)
+
+		err = dbPostgres.PingContext(context.Background())
+		if err != nil {
+			log.Fatal("Connect error Postgres:", err)
+		}
+
+		err = Postgres_storage.Migrate(context.Background(), dbPostgres)
+		if err != nil {
+			log.Fatal("Migrate Postgres:", err)
+		}
+
+		mo = Postgres_storage.New(dbPostgres)
+	case "sqlite":
+		mo = Sqlite_storage.NewUsers(dbSqlite)
+	case "memory":
+		mo = Mongo_storage.NewMemory()
+	default:
+		log.Fatal("Unknown USER_STORAGE:", cfg.Storage.Users)
+	}
+
+	//USER CACHE
+	if cfg.UserCache.TTL > 0 {
+		cached := Mongo_storage.NewCached(mo, re, Mongo_storage.CacheConfig{TTL: cfg.UserCache.TTL})
+		expvar.Publish("user_cache", expvar.Func(func() interface{} {
+			return cached.Stats()
+		}))
+		mo = cached
+	}
+	if cfg.UserCache.MetricsAddr != "" {
+		go func() {
+			err := http.ListenAndServe(cfg.UserCache.MetricsAddr, expvar.Handler())
+			if err != nil {
+				log.Println("Error starting metrics server:", err)
+			}
+		}()
+	}
+
+	tm, err := token.New(token.Config{
+		Algorithm:  cfg.Token.Algorithm,
+		Secret:     cfg.Token.Secret,
+		PrivateKey: cfg.Token.PrivateKey,
+		Issuer:     cfg.Token.Issuer,
+		AccessTTL:  cfg.Token.AccessTTL,
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer func(dbMongo *mongo.Client, ctx context.Context) {
-		err = dbMongo.Disconnect(ctx)
+
+	var ml mailer.Mailer
+	switch cfg.Mail.Driver {
+	case "smtp":
+		ml = mailer.NewSMTP(cfg.Mail.Host, cfg.Mail.Port, cfg.Mail.Username, cfg.Mail.Password, cfg.Mail.From)
+	case "file":
+		ml = mailer.NewFile(cfg.Mail.Dir)
+	case "memory":
+		ml = mailer.NewMemory()
+	default:
+		log.Fatal("Unknown MAIL_DRIVER:", cfg.Mail.Driver)
+	}
+
+	var breaches helper.BreachChecker
+	switch cfg.Breach.Source {
+	case "off":
+	case "shards":
+		breaches = helper.NewShardChecker(cfg.Breach.Path, cfg.Breach.Threshold)
+	case "bloom":
+		filter, err := helper.LoadBloomFilter(cfg.Breach.Path)
 		if err != nil {
-			log.Fatal(err)
+			log.Fatal("Load breach filter:", err)
 		}
-	}(dbMongo, context.Background())
+		if filter.MinCount != cfg.Breach.Threshold {
+			log.Printf("Breach filter was built with -min-count %d, BREACH_THRESHOLD %d is not applied", filter.MinCount, cfg.Breach.Threshold)
+		}
+		breaches = filter
+	default:
+		log.Fatal("Unknown BREACH_SOURCE:", cfg.Breach.Source)
+	}
 
-	err = dbMongo.Ping(context.Background(), nil)
+	hasher, err := helper.NewHasher(helper.HasherConfig{
+		Algorithm: cfg.Hash.Algorithm,
+		Argon2: helper.Argon2Params{
+			Memory:      uint32(cfg.Hash.ArgonMemory),
+			Iterations:  uint32(cfg.Hash.ArgonIterations),
+			Parallelism: uint8(cfg.Hash.ArgonThreads),
+			SaltLength:  helper.DefaultArgon2Params.SaltLength,
+			KeyLength:   helper.DefaultArgon2Params.KeyLength,
+		},
+		BcryptCost: int(cfg.Hash.BcryptCost),
+	})
 	if err != nil {
-		log.Fatal("Connect error Mongo:", err)
+		log.Fatal(err)
 	}
 
-	re := Redis_storage.New(dbRedis)
-	mo := Mongo_storage.New(dbMongo)
-	s := service.New(re, mo)
+	s := service.New(re, mo, tm, ml, service.Config{
+		RefreshTTL: cfg.Token.RefreshTTL,
+		ResetTTL:   cfg.Mail.ResetTTL,
+		ResetURL:   cfg.Mail.ResetURL,
+		VerifyTTL:  cfg.Mail.VerifyTTL,
+		VerifyURL:  cfg.Mail.VerifyURL,
+		Lockout: service.LockoutConfig{
+			UserThreshold:   cfg.Lockout.UserThreshold,
+			IPThreshold:     cfg.Lockout.IPThreshold,
+			BaseDelay:       cfg.Lockout.BaseDelay,
+			MaxDelay:        cfg.Lockout.MaxDelay,
+			LockoutDuration: cfg.Lockout.Duration,
+			Window:          cfg.Lockout.Window,
+			UnlockURL:       cfg.Lockout.UnlockURL,
+		},
+		Validation: validation.Config{
+			UsernameMinLength: cfg.Validation.UsernameMinLength,
+			UsernameMaxLength: cfg.Validation.UsernameMaxLength,
+			UsernameSymbols:   cfg.Validation.UsernameSymbols,
+			UsernameASCIIOnly: cfg.Validation.UsernameASCIIOnly,
+			Reserved:          cfg.Validation.Reserved,
+			Blocklist:         cfg.Validation.Blocklist,
+			PasswordMinLength: cfg.Validation.PasswordMinLength,
+			PasswordMinScore:  cfg.Validation.PasswordMinScore,
+		},
+		Breaches: breaches,
+		Hasher:   hasher,
+		Sessions: service.SessionConfig{
+			Lifetime:      cfg.Session.Lifetime,
+			IdleTimeout:   cfg.Session.IdleTimeout,
+			TouchInterval: cfg.Session.TouchInterval,
+		},
+	})
 	h := handler.NewHandler(s)
 
+	//RATE LIMIT
+	var limiter ratelimit.Limiter
+	switch cfg.RateLimit.Backend {
+	case "redis":
+		limiter = ratelimit.NewRedis(dbRedis)
+	case "memory":
+		limiter = ratelimit.NewMemory()
+	default:
+		log.Fatal("Unknown RATE_LIMIT_BACKEND:", cfg.RateLimit.Backend)
+	}
+
+	limit := func(name string, key handler.KeyFunc) mux.MiddlewareFunc {
+		rule := cfg.RateLimit.Rules[name]
+		return handler.RateLimit(limiter, name, ratelimit.Rule{Limit: rule.Limit, Window: rule.Window}, key)
+	}
+
 	router := mux.NewRouter()
-	router.HandleFunc("/signup", h.SignUp).Methods(http.MethodPost)
-	router.HandleFunc("/signin", h.SignIn).Methods(http.MethodPost)
-	router.HandleFunc("/logout", h.Logout).Methods(http.MethodPost)
-	router.HandleFunc("/editprofile", h.EditProfile).Methods(http.MethodPut)
-	router.HandleFunc("/editpassword", h.ChangePassword).Methods(http.MethodPut)
-	router.HandleFunc("/searchbyusername", h.SearchByUsername).Methods(http.MethodGet)
-
-	router.HandleFunc("/setsession", h.UpsertSessions).Methods(http.MethodPost)
+	router.Use(handler.RequestID)
+	router.Use(handler.ClientIP(cfg.HTTP.TrustedProxies))
+
+	router.Handle("/signup", limit("signup", handler.ByIP)(http.HandlerFunc(h.SignUp))).Methods(http.MethodPost)
+	router.Handle("/signin", limit("signin", handler.ByIP)(http.HandlerFunc(h.SignIn))).Methods(http.MethodPost)
+	router.Handle("/signin/2fa", limit("signin", handler.ByIP)(http.HandlerFunc(h.SignInSecondFactor))).Methods(http.MethodPost)
+	router.Handle("/signin/unlock", limit("password", handler.ByIP)(http.HandlerFunc(h.UnlockByToken))).Methods(http.MethodPost)
+	router.Handle("/token/refresh", limit("token", handler.ByIP)(http.HandlerFunc(h.RefreshToken))).Methods(http.MethodPost)
+	router.Handle("/password/forgot", limit("password", handler.ByIP)(http.HandlerFunc(h.ForgotPassword))).Methods(http.MethodPost)
+	router.Handle("/password/reset", limit("password", handler.ByIP)(http.HandlerFunc(h.ResetPassword))).Methods(http.MethodPost)
+	router.Handle("/email/verify", limit("password", handler.ByIP)(http.HandlerFunc(h.VerifyEmail))).Methods(http.MethodPost)
+	router.Handle("/searchbyusername", limit("search", handler.ByAPIKey(cfg.RateLimit.APIKeys))(http.HandlerFunc(h.SearchByUsername))).Methods(http.MethodGet)
+
 	router.HandleFunc("/getbyusername", h.GetByUsername).Methods(http.MethodGet)
 	router.HandleFunc("/getbyid", h.GetById).Methods(http.MethodGet)
-	router.HandleFunc("/getsession", h.GetSession).Methods(http.MethodGet)
 	router.HandleFunc("/getbysession", h.GetBySession).Methods(http.MethodGet)
 
+	//AUTHENTICATED
+	authRouter := router.NewRoute().Subrouter()
+	authRouter.Use(h.Authenticate)
+	authRouter.Use(limit("authenticated", handler.ByUser))
+	authRouter.HandleFunc("/logout", h.Logout).Methods(http.MethodPost)
+	authRouter.HandleFunc("/editprofile", h.EditProfile).Methods(http.MethodPut)
+	authRouter.HandleFunc("/users/me", h.GetMe).Methods(http.MethodGet)
+	authRouter.HandleFunc("/users/me", h.PatchProfile).Methods(http.MethodPatch)
+	authRouter.HandleFunc("/editpassword", h.ChangePassword).Methods(http.MethodPut)
+	authRouter.HandleFunc("/email/verify/resend", h.ResendVerification).Methods(http.MethodPost)
+	authRouter.HandleFunc("/2fa/enroll", h.EnrollTOTP).Methods(http.MethodPost)
+	authRouter.HandleFunc("/2fa/confirm", h.ConfirmTOTP).Methods(http.MethodPost)
+	authRouter.HandleFunc("/2fa/disable", h.DisableTOTP).Methods(http.MethodPost)
+	authRouter.HandleFunc("/admin/users/{username}", h.GetUserAsAdmin).Methods(http.MethodGet)
+	authRouter.HandleFunc("/admin/users/{username}/unlock", h.UnlockUser).Methods(http.MethodPost)
+	authRouter.HandleFunc("/setsession", h.UpsertSessions).Methods(http.MethodPost)
+	authRouter.HandleFunc("/getsession", h.GetSession).Methods(http.MethodGet)
+	authRouter.HandleFunc("/sessions", h.ListSessions).Methods(http.MethodGet)
+	authRouter.HandleFunc("/sessions", h.RevokeOtherSessions).Methods(http.MethodDelete)
+	authRouter.HandleFunc("/sessions/{id}", h.RevokeSession).Methods(http.MethodDelete)
+
+	if cfg.Session.ReconcileInterval > 0 {
+		go service.RunReconciler(context.Background(), s, cfg.Session.ReconcileInterval)
+	}
+
 	err = http.ListenAndServe(":8080", router)
 	if err != nil {
 		fmt.Println("Error starting server:", err)
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/sillamilla/user_microservice/internal/config"
+	"github.com/sillamilla/user_microservice/internal/users/Mongo_storage"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+)
+
+// runMigrate implements the migrate subcommand:
+//
+//	migrate up            apply all pending migrations
+//	migrate down -steps N revert the latest N migrations (default 1)
+//	migrate status        print the applied and the latest version
+//
+// Postgres and SQLite are migrated on startup, the subcommand only handles
+// Mongo.
+func runMigrate(cfg *config.Config, args []string) {
+	if cfg.Storage.Users != "mongo" {
+		log.Fatalf("migrate: USER_STORAGE=%s is migrated on startup", cfg.Storage.Users)
+	}
+	if len(args) == 0 {
+		log.Fatal("migrate: expected up, down or status")
+	}
+
+	flags := flag.NewFlagSet("migrate "+args[0], flag.ExitOnError)
+	steps := flags.Int("steps", 1, "number of migrations to revert")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := context.Background()
+	dbMongo, err := mongo.Connect(ctx, options.Client().ApplyURI(cfg.Mongo.Address))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func(dbMongo *mongo.Client, ctx context.Context) {
+		err = dbMongo.Disconnect(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}(dbMongo, ctx)
+
+	switch args[0] {
+	case "up":
+		applied, err := Mongo_storage.MigrateUp(ctx, dbMongo)
+		for _, migration := range applied {
+			fmt.Printf("applied %d %s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			log.Fatal("migrate up: ", err)
+		}
+	case "down":
+		reverted, err := Mongo_storage.MigrateDown(ctx, dbMongo, *steps)
+		for _, migration := range reverted {
+			fmt.Printf("reverted %d %s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			log.Fatal("migrate down: ", err)
+		}
+	case "status":
+		current, err := Mongo_storage.MigrationVersion(ctx, dbMongo)
+		if err != nil {
+			log.Fatal("migrate status: ", err)
+		}
+		fmt.Printf("version %d, latest %d\n", current, Mongo_storage.LatestMigration())
+	default:
+		log.Fatalf("migrate: unknown command %q, expected up, down or status", args[0])
+	}
+}
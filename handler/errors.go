@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/sillamilla/user_microservice/internal/users/service"
+	"github.com/sillamilla/user_microservice/internal/users/validation"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+type errorBody struct {
+	Code      string                  `json:"code"`
+	Message   string                  `json:"message"`
+	Fields    []validation.FieldError `json:"fields,omitempty"`
+	RequestID string                  `json:"request_id"`
+}
+
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+// handleError translates a service error into an HTTP status and a stable
+// JSON error envelope. Errors that are not domain errors are logged and
+// reported as a generic internal error so storage details never reach clients.
+func handleError(w http.ResponseWriter, r *http.Request, err error) {
+	var domainErr *service.Error
+	if !errors.As(err, &domainErr) {
+		log.Printf("request %s: %v", RequestIDFromContext(r.Context()), err)
+		writeError(w, r, http.StatusInternalServerError, "internal", "Internal server error")
+		return
+	}
+
+	switch {
+	case errors.Is(err, service.ErrNotFound):
+		writeError(w, r, http.StatusNotFound, "not_found", domainErr.Message)
+	case errors.Is(err, service.ErrConflict):
+		writeError(w, r, http.StatusConflict, "conflict", domainErr.Message)
+	case errors.Is(err, service.ErrUnauthorized):
+		writeError(w, r, http.StatusUnauthorized, "unauthorized", domainErr.Message)
+	case errors.Is(err, service.ErrForbidden):
+		writeError(w, r, http.StatusForbidden, "forbidden", domainErr.Message)
+	case errors.Is(err, service.ErrPreconditionFailed):
+		writeError(w, r, http.StatusPreconditionFailed, "precondition_failed", domainErr.Message)
+	case errors.Is(err, service.ErrValidation):
+		writeFieldErrors(w, r, domainErr.Message, domainErr.Fields)
+	case errors.Is(err, service.ErrTooManyRequests):
+		if domainErr.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(domainErr.RetryAfter.Seconds()))))
+		}
+		writeError(w, r, http.StatusTooManyRequests, "too_many_requests", domainErr.Message)
+	default:
+		log.Printf("request %s: %v", RequestIDFromContext(r.Context()), err)
+		writeError(w, r, http.StatusInternalServerError, "internal", "Internal server error")
+	}
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, code string, message string) {
+	writeErrorBody(w, r, status, errorBody{
+		Code:    code,
+		Message: message,
+	})
+}
+
+// writeFieldErrors reports a validation failure together with every invalid
+// field, so a form can show all problems at once.
+func writeFieldErrors(w http.ResponseWriter, r *http.Request, message string, fields []validation.FieldError) {
+	writeErrorBody(w, r, http.StatusUnprocessableEntity, errorBody{
+		Code:    "validation",
+		Message: message,
+		Fields:  fields,
+	})
+}
+
+func writeErrorBody(w http.ResponseWriter, r *http.Request, status int, body errorBody) {
+	body.RequestID = RequestIDFromContext(r.Context())
+	response := errorResponse{
+		Error: body,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		log.Printf("request %s: encode error response: %v", response.Error.RequestID, err)
+	}
+}
@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/sillamilla/user_microservice/internal/users/service"
+	"github.com/sillamilla/user_microservice/internal/users/validation"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandleError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		status     int
+		code       string
+		message    string
+		retryAfter string
+	}{
+		{"not found", &service.Error{Kind: service.ErrNotFound, Message: "User not found"}, http.StatusNotFound, "not_found", "User not found", ""},
+		{"conflict", &service.Error{Kind: service.ErrConflict, Message: "Username taken"}, http.StatusConflict, "conflict", "Username taken", ""},
+		{"unauthorized", &service.Error{Kind: service.ErrUnauthorized, Message: "Invalid username or password"}, http.StatusUnauthorized, "unauthorized", "Invalid username or password", ""},
+		{"forbidden", &service.Error{Kind: service.ErrForbidden, Message: "Admins only"}, http.StatusForbidden, "forbidden", "Admins only", ""},
+		{"precondition failed", &service.Error{Kind: service.ErrPreconditionFailed, Message: "Outdated version"}, http.StatusPreconditionFailed, "precondition_failed", "Outdated version", ""},
+		{"validation", &service.Error{Kind: service.ErrValidation, Message: "Too short",
+			Fields: []validation.FieldError{{Field: "password", Message: "Too short"}}}, http.StatusUnprocessableEntity, "validation", "Too short", ""},
+		{"too many requests", &service.Error{Kind: service.ErrTooManyRequests, Message: "Locked", RetryAfter: 1500 * time.Millisecond},
+			http.StatusTooManyRequests, "too_many_requests", "Locked", "2"},
+		{"too many requests without retry", &service.Error{Kind: service.ErrTooManyRequests, Message: "Locked"},
+			http.StatusTooManyRequests, "too_many_requests", "Locked", ""},
+		{"wrapped", errors.Wrap(&service.Error{Kind: service.ErrNotFound, Message: "User not found"}, "service.GetByID"),
+			http.StatusNotFound, "not_found", "User not found", ""},
+		{"storage", errors.New("connection refused"), http.StatusInternalServerError, "internal", "Internal server error", ""},
+		{"unknown kind", &service.Error{Kind: errors.New("other"), Message: "secret detail"}, http.StatusInternalServerError, "internal", "Internal server error", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handleError(w, httptest.NewRequest(http.MethodGet, "/", nil), tt.err)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.retryAfter {
+				t.Fatalf("Retry-After = %q, want %q", got, tt.retryAfter)
+			}
+
+			var response errorResponse
+			err := json.NewDecoder(w.Body).Decode(&response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.Error.Code != tt.code || response.Error.Message != tt.message {
+				t.Fatalf("error = %+v, want code %q and message %q", response.Error, tt.code, tt.message)
+			}
+		})
+	}
+}
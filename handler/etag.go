@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/sillamilla/user_microservice/internal/users/model"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func setETag(w http.ResponseWriter, user model.SelfUser) {
+	w.Header().Set("ETag", strconv.Quote(strconv.FormatInt(user.Version, 10)))
+}
+
+// setPublicETag tags a public view by its content, it carries no version. The
+// tag is weak and never names a version, so If-Match with it fails.
+func setPublicETag(w http.ResponseWriter, user model.UserInfo) {
+	body, err := json.Marshal(user)
+	if err != nil {
+		return
+	}
+
+	sum := sha256.Sum256(body)
+	w.Header().Set("ETag", "W/"+strconv.Quote(hex.EncodeToString(sum[:16])))
+}
+
+// versionFromRequest reads the user version a client expects from If-Match.
+// A missing header or "*" means any version.
+func versionFromRequest(r *http.Request) (int64, error) {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	if ifMatch == "" || ifMatch == "*" {
+		return model.AnyVersion, nil
+	}
+
+	tag, err := strconv.Unquote(strings.TrimPrefix(ifMatch, "W/"))
+	if err != nil {
+		return 0, errors.New("If-Match must be a quoted entity tag")
+	}
+
+	version, err := strconv.ParseInt(tag, 10, 64)
+	if err != nil || version < 0 {
+		return 0, errors.New("If-Match does not name a user version")
+	}
+
+	return version, nil
+}
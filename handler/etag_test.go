@@ -0,0 +1,172 @@
+package handler
+
+import (
+	"context"
+	"github.com/sillamilla/user_microservice/internal/users/Mongo_storage"
+	"github.com/sillamilla/user_microservice/internal/users/model"
+	"github.com/sillamilla/user_microservice/internal/users/service/helper"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadEndpointsSendETag(t *testing.T) {
+	mo := Mongo_storage.NewMemory()
+	hasher := testHasher(t)
+	router := newTestRouter(t, mo, hasher)
+	ctx := context.Background()
+
+	adminHash, err := hasher.Hash(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := model.UserFromInput("admin-id", model.Input{Username: "boss", Password: adminHash}, time.Now())
+	admin.Roles = []string{model.RoleUser, model.RoleAdmin}
+	err = mo.SignUp(ctx, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session := signUpAndIn(t, router, "alice")
+	adminSession := signIn(t, router, "boss")
+	alice, err := mo.GetByUsername(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := strconv.Quote(strconv.FormatInt(alice.Version, 10))
+
+	asAlice := map[string]string{"Authorization": "Bearer " + session}
+	requests := map[string]struct {
+		req testRequest
+		// etag is the expected tag, empty means any.
+		etag string
+	}{
+		"GET /users/me":          {testRequest{method: http.MethodGet, path: "/users/me", headers: asAlice}, version},
+		"GET /getbysession":      {testRequest{method: http.MethodGet, path: "/getbysession", headers: map[string]string{"Session": session}}, version},
+		"GET /admin/users/alice": {testRequest{method: http.MethodGet, path: "/admin/users/alice", headers: map[string]string{"Authorization": "Bearer " + adminSession}}, version},
+		"GET /getbyid":           {testRequest{method: http.MethodGet, path: "/getbyid", headers: map[string]string{"ID": alice.ID}}, ""},
+		"GET /getbyusername":     {testRequest{method: http.MethodGet, path: "/getbyusername", headers: map[string]string{"Username": "alice"}}, ""},
+	}
+	for name, test := range requests {
+		w := record(router, test.req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", name, w.Code, w.Body)
+		}
+		etag := w.Header().Get("ETag")
+		if etag == "" {
+			t.Errorf("%s sent no ETag", name)
+		} else if test.etag != "" && etag != test.etag {
+			t.Errorf("%s ETag = %s, want %s", name, etag, test.etag)
+		}
+	}
+}
+
+func TestStaleIfMatchFails(t *testing.T) {
+	mo := Mongo_storage.NewMemory()
+	router := newTestRouter(t, mo, testHasher(t))
+	ctx := context.Background()
+
+	session := signUpAndIn(t, router, "alice")
+	asAlice := map[string]string{"Authorization": "Bearer " + session}
+
+	w := record(router, testRequest{method: http.MethodGet, path: "/users/me", headers: asAlice})
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /users/me: %d %s", w.Code, w.Body)
+	}
+	stale := w.Header().Get("ETag")
+
+	alice, err := mo.GetByUsername(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Changes outside PATCH /users/me, like enrolling a second factor, make
+	// the tag stale too.
+	err = mo.EnableTOTP(ctx, alice.ID, "secret", []string{"code"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patch := testRequest{method: http.MethodPatch, path: "/users/me", body: `{"bio":"hi"}`,
+		headers: map[string]string{"Authorization": "Bearer " + session, "If-Match": stale}}
+	w = record(router, patch)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("PATCH with a stale If-Match: %d %s", w.Code, w.Body)
+	}
+
+	w = record(router, testRequest{method: http.MethodGet, path: "/users/me", headers: asAlice})
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /users/me: %d %s", w.Code, w.Body)
+	}
+	fresh := w.Header().Get("ETag")
+	if fresh == stale {
+		t.Fatalf("ETag %s did not change after EnableTOTP", fresh)
+	}
+
+	patch.headers["If-Match"] = fresh
+	w = record(router, patch)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PATCH with a fresh If-Match: %d %s", w.Code, w.Body)
+	}
+	if w.Header().Get("ETag") == fresh {
+		t.Fatal("PATCH did not send a new ETag")
+	}
+
+	// The tag the PATCH replaced is stale now.
+	w = record(router, patch)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("PATCH repeated with the same If-Match: %d %s", w.Code, w.Body)
+	}
+}
+
+func signUpAndIn(t *testing.T, router http.Handler, username string) string {
+	t.Helper()
+
+	status, body := do(t, router, testRequest{method: http.MethodPost, path: "/signup",
+		body: `{"username":"` + username + `","email":"` + username + `@example.com","password":"` + testPassword + `"}`})
+	if status != http.StatusOK {
+		t.Fatalf("signup: %d %s", status, body)
+	}
+
+	return signIn(t, router, username)
+}
+
+func signIn(t *testing.T, router http.Handler, username string) string {
+	t.Helper()
+
+	status, body := do(t, router, testRequest{method: http.MethodPost, path: "/signin",
+		body: `{"username":"` + username + `","password":"` + testPassword + `"}`})
+	if status != http.StatusOK {
+		t.Fatalf("signin: %d %s", status, body)
+	}
+
+	return between(body, `"session":"`, `"`)
+}
+
+// record is do for tests that need the response headers.
+func record(router http.Handler, req testRequest) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(req.method, req.path, strings.NewReader(req.body))
+	for key, value := range req.headers {
+		r.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	return w
+}
+
+func testHasher(t *testing.T) helper.Hasher {
+	t.Helper()
+
+	hasher, err := helper.NewHasher(helper.HasherConfig{
+		Algorithm: helper.Argon2id,
+		Argon2:    helper.Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hasher
+}
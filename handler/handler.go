@@ -2,6 +2,7 @@ package handler
 
 import (
 	"encoding/json"
+	"github.com/gorilla/mux"
 	"github.com/sillamilla/user_microservice/internal/users/model"
 	"github.com/sillamilla/user_microservice/internal/users/service"
 	"io/ioutil"
@@ -21,31 +22,33 @@ func NewHandler(service service.Service) Handler {
 func (h *Handler) SignUp(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, "bad_request", "Unable to read request body")
 		return
 	}
 
 	var inputUser model.Input
 	err = json.Unmarshal(body, &inputUser)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, "bad_request", "Invalid JSON body")
 		return
 	}
 
-	user, err := h.srv.SignUp(r.Context(), inputUser)
+	auth, err := h.srv.SignUp(r.Context(), inputUser, clientFromRequest(r))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		handleError(w, r, err)
 		return
 	}
 
 	response := make(map[string]interface{})
 	response["message"] = "Sign up successful"
-	response["user"] = user
+	response["user"] = auth.User
+	response["session"] = auth.Session
+	response["tokens"] = auth.Tokens
 
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(response)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		handleError(w, r, err)
 		return
 	}
 }
@@ -53,31 +56,237 @@ func (h *Handler) SignUp(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) SignIn(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, "bad_request", "Unable to read request body")
 		return
 	}
 
 	var inputUser model.Input
 	err = json.Unmarshal(body, &inputUser)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, "bad_request", "Invalid JSON body")
+		return
+	}
+
+	auth, err := h.srv.SignIn(r.Context(), inputUser, clientFromRequest(r))
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	response := make(map[string]interface{})
+	if auth.Challenge != "" {
+		response["message"] = "Second factor required"
+		response["challenge"] = auth.Challenge
+	} else {
+		response["message"] = "Sign in successful"
+		response["user"] = auth.User
+		response["session"] = auth.Session
+		response["tokens"] = auth.Tokens
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+}
+
+func (h *Handler) SignInSecondFactor(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "bad_request", "Unable to read request body")
 		return
 	}
 
-	user, err := h.srv.SignIn(r.Context(), inputUser)
+	var secondFactor model.SecondFactor
+	err = json.Unmarshal(body, &secondFactor)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, http.StatusBadRequest, "bad_request", "Invalid JSON body")
+		return
+	}
+
+	auth, err := h.srv.SignInSecondFactor(r.Context(), secondFactor, clientFromRequest(r))
+	if err != nil {
+		handleError(w, r, err)
 		return
 	}
 
 	response := make(map[string]interface{})
 	response["message"] = "Sign in successful"
-	response["user"] = user
+	response["user"] = auth.User
+	response["session"] = auth.Session
+	response["tokens"] = auth.Tokens
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+}
+
+func (h *Handler) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	identity, _ := IdentityFromContext(r.Context())
+	enrollment, err := h.srv.EnrollTOTP(r.Context(), identity)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	response := make(map[string]interface{})
+	response["message"] = "Two-factor enrolment started"
+	response["secret"] = enrollment.Secret
+	response["uri"] = enrollment.URI
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+}
+
+func (h *Handler) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "bad_request", "Unable to read request body")
+		return
+	}
+
+	var code model.TOTPCode
+	err = json.Unmarshal(body, &code)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "bad_request", "Invalid JSON body")
+		return
+	}
+
+	identity, _ := IdentityFromContext(r.Context())
+	recoveryCodes, err := h.srv.ConfirmTOTP(r.Context(), identity, code)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	response := make(map[string]interface{})
+	response["message"] = "Two-factor authentication enabled"
+	response["recovery_codes"] = recoveryCodes
 
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(response)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		handleError(w, r, err)
+		return
+	}
+}
+
+func (h *Handler) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "bad_request", "Unable to read request body")
+		return
+	}
+
+	var disableTOTP model.DisableTOTP
+	err = json.Unmarshal(body, &disableTOTP)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "bad_request", "Invalid JSON body")
+		return
+	}
+
+	identity, _ := IdentityFromContext(r.Context())
+	err = h.srv.DisableTOTP(r.Context(), identity, disableTOTP)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	response := map[string]string{"message": "Two-factor authentication disabled"}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+}
+
+func (h *Handler) UnlockByToken(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "bad_request", "Unable to read request body")
+		return
+	}
+
+	var unlock model.Unlock
+	err = json.Unmarshal(body, &unlock)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "bad_request", "Invalid JSON body")
+		return
+	}
+
+	err = h.srv.UnlockByToken(r.Context(), unlock.Token)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	response := map[string]string{"message": "Unlock account successful"}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+}
+
+func (h *Handler) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	identity, _ := IdentityFromContext(r.Context())
+	err := h.srv.UnlockUser(r.Context(), identity, mux.Vars(r)["username"])
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	response := map[string]string{"message": "Unlock account successful"}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+}
+
+func (h *Handler) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "bad_request", "Unable to read request body")
+		return
+	}
+
+	var input model.RefreshInput
+	err = json.Unmarshal(body, &input)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "bad_request", "Invalid JSON body")
+		return
+	}
+
+	tokens, err := h.srv.Refresh(r.Context(), input.RefreshToken)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	response := make(map[string]interface{})
+	response["message"] = "Refresh token successful"
+	response["tokens"] = tokens
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		handleError(w, r, err)
 		return
 	}
 }
@@ -85,20 +294,27 @@ func (h *Handler) SignIn(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) EditProfile(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, "bad_request", "Unable to read request body")
 		return
 	}
 
 	var updateUser model.UpdateUser
 	err = json.Unmarshal(body, &updateUser)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, "bad_request", "Invalid JSON body")
+		return
+	}
+
+	version, err := versionFromRequest(r)
+	if err != nil {
+		writeError(w, r, http.StatusPreconditionFailed, "precondition_failed", err.Error())
 		return
 	}
 
-	err = h.srv.EditProfile(r.Context(), r.Header.Get("ID"), updateUser)
+	identity, _ := IdentityFromContext(r.Context())
+	err = h.srv.EditProfile(r.Context(), identity.User.ID, updateUser, version)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		handleError(w, r, err)
 		return
 	}
 
@@ -108,7 +324,64 @@ func (h *Handler) EditProfile(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(response)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		handleError(w, r, err)
+		return
+	}
+}
+
+func (h *Handler) GetMe(w http.ResponseWriter, r *http.Request) {
+	identity, _ := IdentityFromContext(r.Context())
+	user := model.SelfFromUser(identity.User)
+	setETag(w, user)
+
+	response := make(map[string]interface{})
+	response["message"] = "Get user successful"
+	response["user"] = user
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+}
+
+func (h *Handler) PatchProfile(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "bad_request", "Unable to read request body")
+		return
+	}
+
+	var patchUser model.PatchUser
+	err = json.Unmarshal(body, &patchUser)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "bad_request", "Invalid JSON body")
+		return
+	}
+
+	version, err := versionFromRequest(r)
+	if err != nil {
+		writeError(w, r, http.StatusPreconditionFailed, "precondition_failed", err.Error())
+		return
+	}
+
+	identity, _ := IdentityFromContext(r.Context())
+	user, err := h.srv.PatchProfile(r.Context(), identity.User.ID, patchUser, version)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	setETag(w, user)
+
+	response := make(map[string]interface{})
+	response["message"] = "Edit profile successful"
+	response["user"] = user
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		handleError(w, r, err)
 		return
 	}
 }
@@ -116,20 +389,27 @@ func (h *Handler) EditProfile(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) ChangePassword(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, "bad_request", "Unable to read request body")
 		return
 	}
 
 	var changePassword model.ChangePassword
 	err = json.Unmarshal(body, &changePassword)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, "bad_request", "Invalid JSON body")
+		return
+	}
+
+	version, err := versionFromRequest(r)
+	if err != nil {
+		writeError(w, r, http.StatusPreconditionFailed, "precondition_failed", err.Error())
 		return
 	}
 
-	err = h.srv.EditPassword(r.Context(), r.Header.Get("ID"), changePassword)
+	identity, _ := IdentityFromContext(r.Context())
+	err = h.srv.EditPassword(r.Context(), identity.User.ID, changePassword, version)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		handleError(w, r, err)
 		return
 	}
 
@@ -139,35 +419,152 @@ func (h *Handler) ChangePassword(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(response)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		handleError(w, r, err)
 		return
 	}
 }
 
-func (h *Handler) UpsertSessions(w http.ResponseWriter, r *http.Request) {
-	session := r.Header.Get("ID")
+func (h *Handler) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "bad_request", "Unable to read request body")
+		return
+	}
+
+	var forgotPassword model.ForgotPassword
+	err = json.Unmarshal(body, &forgotPassword)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "bad_request", "Invalid JSON body")
+		return
+	}
+
+	err = h.srv.ForgotPassword(r.Context(), forgotPassword)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	response := map[string]string{"message": "If the email is registered a reset link has been sent"}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+}
+
+func (h *Handler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "bad_request", "Unable to read request body")
+		return
+	}
+
+	var resetPassword model.ResetPassword
+	err = json.Unmarshal(body, &resetPassword)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "bad_request", "Invalid JSON body")
+		return
+	}
+
+	err = h.srv.ResetPassword(r.Context(), resetPassword)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	response := map[string]string{"message": "Reset password successful"}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+}
+
+func (h *Handler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "bad_request", "Unable to read request body")
+		return
+	}
+
+	var verifyEmail model.VerifyEmail
+	err = json.Unmarshal(body, &verifyEmail)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "bad_request", "Invalid JSON body")
+		return
+	}
+
+	err = h.srv.VerifyEmail(r.Context(), verifyEmail.Token)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	response := map[string]string{"message": "Verify email successful"}
 
-	session, err := h.srv.UpsertSessions(r.Context(), session)
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+}
+
+func (h *Handler) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	identity, _ := IdentityFromContext(r.Context())
+	err := h.srv.ResendVerification(r.Context(), identity)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	response := map[string]string{"message": "Verification email sent"}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+}
+
+// UpsertSessions opens another session for a caller that already has one. An
+// access token is not enough, it would turn a short lived token into a long
+// lived session.
+func (h *Handler) UpsertSessions(w http.ResponseWriter, r *http.Request) {
+	identity, _ := IdentityFromContext(r.Context())
+	if identity.Session.Token == "" {
+		writeError(w, r, http.StatusUnauthorized, "unauthorized", "Session required")
+		return
+	}
+	session, plain, err := h.srv.UpsertSessions(r.Context(), identity.User.ID, clientFromRequest(r))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		handleError(w, r, err)
 		return
 	}
+	session.Token = plain
 
-	response := map[string]string{"message": "Set session successful"}
-	response["sessions"] = session
+	response := make(map[string]interface{})
+	response["message"] = "Set session successful"
+	response["session"] = session
 
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(response)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		handleError(w, r, err)
 		return
 	}
 }
 
 func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
-	err := h.srv.Logout(r.Context(), r.Header.Get("ID"))
+	identity, _ := IdentityFromContext(r.Context())
+	err := h.srv.Logout(r.Context(), identity)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		handleError(w, r, err)
 		return
 	}
 
@@ -176,7 +573,7 @@ func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(response)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		handleError(w, r, err)
 		return
 	}
 }
@@ -184,9 +581,10 @@ func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) GetBySession(w http.ResponseWriter, r *http.Request) {
 	user, err := h.srv.GetBySession(r.Context(), r.Header.Get("Session"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		handleError(w, r, err)
 		return
 	}
+	setETag(w, user)
 
 	response := make(map[string]interface{})
 	response["message"] = "Get user by session successful"
@@ -195,25 +593,84 @@ func (h *Handler) GetBySession(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(response)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		handleError(w, r, err)
 		return
 	}
 }
 
 func (h *Handler) GetSession(w http.ResponseWriter, r *http.Request) {
-	session, err := h.srv.GetSession(r.Context(), r.Header.Get("ID"))
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	identity, _ := IdentityFromContext(r.Context())
+	if identity.Session.Token == "" {
+		writeError(w, r, http.StatusUnauthorized, "unauthorized", "Session required")
 		return
 	}
+	session := identity.Session
+	session.Token = ""
 
-	response := map[string]string{"message": "Get session successful"}
+	response := make(map[string]interface{})
+	response["message"] = "Get session successful"
 	response["session"] = session
 
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+}
+
+func (h *Handler) ListSessions(w http.ResponseWriter, r *http.Request) {
+	identity, _ := IdentityFromContext(r.Context())
+	sessions, err := h.srv.ListSessions(r.Context(), identity)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	response := make(map[string]interface{})
+	response["message"] = "List sessions successful"
+	response["sessions"] = sessions
+
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(response)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		handleError(w, r, err)
+		return
+	}
+}
+
+func (h *Handler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	identity, _ := IdentityFromContext(r.Context())
+	err := h.srv.RevokeSession(r.Context(), identity, mux.Vars(r)["id"])
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	response := map[string]string{"message": "Revoke session successful"}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+}
+
+func (h *Handler) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	identity, _ := IdentityFromContext(r.Context())
+	err := h.srv.RevokeOtherSessions(r.Context(), identity)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	response := map[string]string{"message": "Revoke other sessions successful"}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		handleError(w, r, err)
 		return
 	}
 }
@@ -221,7 +678,7 @@ func (h *Handler) GetSession(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) SearchByUsername(w http.ResponseWriter, r *http.Request) {
 	user, err := h.srv.SearchByUsername(r.Context(), r.Header.Get("Username"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		handleError(w, r, err)
 		return
 	}
 
@@ -232,7 +689,7 @@ func (h *Handler) SearchByUsername(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(response)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		handleError(w, r, err)
 		return
 	}
 }
@@ -240,9 +697,10 @@ func (h *Handler) SearchByUsername(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) GetByUsername(w http.ResponseWriter, r *http.Request) {
 	user, err := h.srv.GetByUsername(r.Context(), r.Header.Get("Username"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		handleError(w, r, err)
 		return
 	}
+	setPublicETag(w, user)
 
 	response := make(map[string]interface{})
 	response["message"] = "Get username successful"
@@ -251,7 +709,7 @@ func (h *Handler) GetByUsername(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(response)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		handleError(w, r, err)
 		return
 	}
 }
@@ -259,9 +717,10 @@ func (h *Handler) GetByUsername(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) GetById(w http.ResponseWriter, r *http.Request) {
 	user, err := h.srv.GetByID(r.Context(), r.Header.Get("ID"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		handleError(w, r, err)
 		return
 	}
+	setPublicETag(w, user)
 
 	response := make(map[string]interface{})
 	response["message"] = "Get user by id successful"
@@ -270,7 +729,36 @@ func (h *Handler) GetById(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(response)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		handleError(w, r, err)
+		return
+	}
+}
+
+func (h *Handler) GetUserAsAdmin(w http.ResponseWriter, r *http.Request) {
+	identity, _ := IdentityFromContext(r.Context())
+	user, err := h.srv.GetUserAsAdmin(r.Context(), identity, mux.Vars(r)["username"])
+	if err != nil {
+		handleError(w, r, err)
 		return
 	}
+	setETag(w, user.SelfUser)
+
+	response := make(map[string]interface{})
+	response["message"] = "Get user successful"
+	response["user"] = user
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+}
+
+func clientFromRequest(r *http.Request) model.Client {
+	return model.Client{
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+		Session:   credentialFromRequest(r),
+	}
 }
@@ -0,0 +1,264 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/sillamilla/user_microservice/internal/mailer"
+	"github.com/sillamilla/user_microservice/internal/users/Mongo_storage"
+	"github.com/sillamilla/user_microservice/internal/users/Redis_storage"
+	"github.com/sillamilla/user_microservice/internal/users/model"
+	"github.com/sillamilla/user_microservice/internal/users/service"
+	"github.com/sillamilla/user_microservice/internal/users/service/helper"
+	"github.com/sillamilla/user_microservice/internal/users/token"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPassword = "correct horse battery staple"
+
+func newTestRouter(t *testing.T, mo Mongo_storage.Storage, hasher helper.Hasher) http.Handler {
+	t.Helper()
+
+	tokens, err := token.New(token.Config{
+		Algorithm: token.HS256,
+		Secret:    "test-secret",
+		Issuer:    "test",
+		AccessTTL: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := service.New(Redis_storage.NewMemory(), mo, tokens, mailer.NewMemory(), service.Config{
+		RefreshTTL: time.Hour,
+		ResetTTL:   time.Hour,
+		VerifyTTL:  time.Hour,
+		Lockout: service.LockoutConfig{
+			UserThreshold:   5,
+			IPThreshold:     20,
+			BaseDelay:       time.Millisecond,
+			MaxDelay:        time.Millisecond,
+			LockoutDuration: time.Minute,
+			Window:          time.Hour,
+		},
+		Hasher: hasher,
+	})
+	h := NewHandler(srv)
+
+	router := mux.NewRouter()
+	router.Use(ClientIP(nil))
+	router.HandleFunc("/signup", h.SignUp).Methods(http.MethodPost)
+	router.HandleFunc("/signin", h.SignIn).Methods(http.MethodPost)
+	router.HandleFunc("/searchbyusername", h.SearchByUsername).Methods(http.MethodGet)
+	router.HandleFunc("/getbyusername", h.GetByUsername).Methods(http.MethodGet)
+	router.HandleFunc("/getbyid", h.GetById).Methods(http.MethodGet)
+	router.HandleFunc("/getbysession", h.GetBySession).Methods(http.MethodGet)
+
+	authRouter := router.NewRoute().Subrouter()
+	authRouter.Use(h.Authenticate)
+	authRouter.HandleFunc("/users/me", h.GetMe).Methods(http.MethodGet)
+	authRouter.HandleFunc("/users/me", h.PatchProfile).Methods(http.MethodPatch)
+	authRouter.HandleFunc("/admin/users/{username}", h.GetUserAsAdmin).Methods(http.MethodGet)
+	authRouter.HandleFunc("/setsession", h.UpsertSessions).Methods(http.MethodPost)
+	authRouter.HandleFunc("/getsession", h.GetSession).Methods(http.MethodGet)
+	authRouter.HandleFunc("/sessions", h.ListSessions).Methods(http.MethodGet)
+
+	return router
+}
+
+type testRequest struct {
+	method  string
+	path    string
+	body    string
+	headers map[string]string
+	// want is the expected status, zero means 200.
+	want int
+}
+
+func do(t *testing.T, router http.Handler, req testRequest) (int, string) {
+	t.Helper()
+
+	r := httptest.NewRequest(req.method, req.path, strings.NewReader(req.body))
+	for key, value := range req.headers {
+		r.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	body, err := ioutil.ReadAll(w.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return w.Code, string(body)
+}
+
+func TestResponsesNeverContainHashes(t *testing.T) {
+	mo := Mongo_storage.NewMemory()
+	hasher, err := helper.NewHasher(helper.HasherConfig{
+		Algorithm: helper.Argon2id,
+		Argon2:    helper.Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := newTestRouter(t, mo, hasher)
+	ctx := context.Background()
+
+	adminHash, err := hasher.Hash(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := model.UserFromInput("admin-id", model.Input{Username: "boss", Password: adminHash}, time.Now())
+	admin.Roles = []string{model.RoleUser, model.RoleAdmin}
+	err = mo.SignUp(ctx, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, body := do(t, router, testRequest{method: http.MethodPost, path: "/signup",
+		body: `{"username":"alice","email":"alice@example.com","password":"` + testPassword + `"}`})
+	if status != http.StatusOK {
+		t.Fatalf("signup: %d %s", status, body)
+	}
+	bodies := map[string]string{"POST /signup": body}
+
+	status, body = do(t, router, testRequest{method: http.MethodPost, path: "/signin",
+		body: `{"username":"alice","password":"` + testPassword + `"}`})
+	if status != http.StatusOK {
+		t.Fatalf("signin: %d %s", status, body)
+	}
+	bodies["POST /signin"] = body
+	session := between(body, `"session":"`, `"`)
+
+	status, body = do(t, router, testRequest{method: http.MethodPost, path: "/signin",
+		body: `{"username":"boss","password":"` + testPassword + `"}`})
+	if status != http.StatusOK {
+		t.Fatalf("admin signin: %d %s", status, body)
+	}
+	adminSession := between(body, `"session":"`, `"`)
+
+	alice, err := mo.GetByUsername(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	asAlice := map[string]string{"Authorization": "Bearer " + session}
+	requests := map[string]testRequest{
+		"GET /users/me":             {method: http.MethodGet, path: "/users/me", headers: asAlice},
+		"PATCH /users/me":           {method: http.MethodPatch, path: "/users/me", body: `{"bio":"hi"}`, headers: asAlice},
+		"POST /setsession":          {method: http.MethodPost, path: "/setsession", headers: asAlice},
+		"GET /getsession":           {method: http.MethodGet, path: "/getsession", headers: asAlice},
+		"GET /sessions":             {method: http.MethodGet, path: "/sessions", headers: asAlice},
+		"GET /getbysession":         {method: http.MethodGet, path: "/getbysession", headers: map[string]string{"Session": session}},
+		"GET /getbyid":              {method: http.MethodGet, path: "/getbyid", headers: map[string]string{"ID": alice.ID}},
+		"GET /getbyusername":        {method: http.MethodGet, path: "/getbyusername", headers: map[string]string{"Username": "alice"}},
+		"GET /searchbyusername":     {method: http.MethodGet, path: "/searchbyusername", headers: map[string]string{"Username": "alice"}},
+		"GET /admin/users/alice":    {method: http.MethodGet, path: "/admin/users/alice", headers: map[string]string{"Authorization": "Bearer " + adminSession}},
+		"GET /admin/users/ as user": {method: http.MethodGet, path: "/admin/users/boss", headers: asAlice, want: http.StatusForbidden},
+	}
+	for name, req := range requests {
+		if req.want == 0 {
+			req.want = http.StatusOK
+		}
+		status, bodies[name] = do(t, router, req)
+		if status != req.want {
+			t.Fatalf("%s: %d %s", name, status, bodies[name])
+		}
+	}
+
+	// Read back after every request so sessions opened along the way count.
+	var secrets []string
+	for _, username := range []string{"alice", "boss"} {
+		user, err := mo.GetByUsername(ctx, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		secrets = append(secrets, user.Password)
+		for _, stored := range user.Sessions {
+			secrets = append(secrets, stored.Token)
+		}
+	}
+
+	for name, body := range bodies {
+		if strings.Contains(body, "$argon2id$") || strings.Contains(body, `"password"`) {
+			t.Errorf("%s response contains a password hash: %s", name, body)
+		}
+		for _, secret := range secrets {
+			if strings.Contains(body, secret) {
+				t.Errorf("%s response contains stored secret %q: %s", name, secret, body)
+			}
+		}
+	}
+
+	if !strings.Contains(bodies["GET /admin/users/alice"], `"recovery_codes_left"`) {
+		t.Errorf("admin view missing admin fields: %s", bodies["GET /admin/users/alice"])
+	}
+	if strings.Contains(bodies["GET /getbyid"], "alice@example.com") {
+		t.Errorf("public view contains the email: %s", bodies["GET /getbyid"])
+	}
+	if !strings.Contains(bodies["GET /users/me"], "alice@example.com") {
+		t.Errorf("own view is missing the email: %s", bodies["GET /users/me"])
+	}
+}
+
+// TestForgedForwardedForKeepsIPLockout guesses with a new X-Forwarded-For on
+// every request, which must not start a new IP counter each time.
+func TestForgedForwardedForKeepsIPLockout(t *testing.T) {
+	router := newTestRouter(t, Mongo_storage.NewMemory(), nil)
+
+	// The test config locks an IP after 20 failures.
+	for i := 0; i < 20; i++ {
+		status, body := do(t, router, testRequest{method: http.MethodPost, path: "/signin",
+			body:    fmt.Sprintf(`{"username":"user%d","password":"guess"}`, i),
+			headers: map[string]string{"X-Forwarded-For": fmt.Sprintf("198.51.100.%d", i)}})
+		if status != http.StatusUnauthorized {
+			t.Fatalf("guess %d: %d %s", i+1, status, body)
+		}
+		// Outlast the delay every failure adds.
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	status, body := do(t, router, testRequest{method: http.MethodPost, path: "/signin",
+		body:    `{"username":"user20","password":"guess"}`,
+		headers: map[string]string{"X-Forwarded-For": "198.51.100.200"}})
+	if status != http.StatusTooManyRequests {
+		t.Fatalf("guess after the IP threshold: %d %s", status, body)
+	}
+}
+
+// TestSetSessionNeedsSession checks an access token, which expires in
+// minutes, cannot be traded for a session that lasts for days.
+func TestSetSessionNeedsSession(t *testing.T) {
+	router := newTestRouter(t, Mongo_storage.NewMemory(), testHasher(t))
+
+	status, body := do(t, router, testRequest{method: http.MethodPost, path: "/signup",
+		body: `{"username":"alice","email":"alice@example.com","password":"` + testPassword + `"}`})
+	if status != http.StatusOK {
+		t.Fatalf("signup: %d %s", status, body)
+	}
+	session := between(body, `"session":"`, `"`)
+	access := between(body, `"access_token":"`, `"`)
+
+	status, body = do(t, router, testRequest{method: http.MethodPost, path: "/setsession",
+		headers: map[string]string{"Authorization": "Bearer " + access}})
+	if status != http.StatusUnauthorized {
+		t.Fatalf("POST /setsession with an access token: %d %s", status, body)
+	}
+
+	status, body = do(t, router, testRequest{method: http.MethodPost, path: "/setsession",
+		headers: map[string]string{"Authorization": "Bearer " + session}})
+	if status != http.StatusOK {
+		t.Fatalf("POST /setsession with a session: %d %s", status, body)
+	}
+}
+
+func between(s string, start string, end string) string {
+	_, after, _ := strings.Cut(s, start)
+	value, _, _ := strings.Cut(after, end)
+	return value
+}
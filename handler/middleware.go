@@ -0,0 +1,136 @@
+package handler
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/sillamilla/user_microservice/internal/users/model"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	identityKey
+	clientIPKey
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// RequestID makes sure every request carries an id. A client supplied
+// X-Request-ID is kept, otherwise a new one is generated. The id is echoed in
+// the response header and reported in error envelopes.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" {
+			id = uuid.NewString()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// ClientIP resolves the address of the client. It is the peer address unless
+// the peer is one of the trusted proxies, then X-Forwarded-For is read from
+// the right and the first hop that is not a trusted proxy is the client.
+// Hops further left were written by the client and are ignored.
+func ClientIP(trusted []*net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), clientIPKey, resolveClientIP(r, trusted))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// clientIP returns the address ClientIP resolved, or the peer address when
+// the middleware is not installed.
+func clientIP(r *http.Request) string {
+	ip, ok := r.Context().Value(clientIPKey).(string)
+	if ok {
+		return ip
+	}
+
+	return resolveClientIP(r, nil)
+}
+
+func resolveClientIP(r *http.Request, trusted []*net.IPNet) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+	if !isTrusted(net.ParseIP(ip), trusted) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// Only the client writes garbage, the trusted hop after it is
+			// the best address there is.
+			break
+		}
+
+		ip = hop.String()
+		if !isTrusted(hop, trusted) {
+			break
+		}
+	}
+
+	return ip
+}
+
+func isTrusted(ip net.IP, trusted []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Authenticate resolves the caller from an "Authorization: Bearer" header,
+// which may carry an access token or a session token. The legacy Session
+// header is still accepted. Requests without valid credentials are rejected.
+func (h *Handler) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, err := h.srv.Authenticate(r.Context(), credentialFromRequest(r))
+		if err != nil {
+			handleError(w, r, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), identityKey, identity)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func IdentityFromContext(ctx context.Context) (model.Identity, bool) {
+	identity, ok := ctx.Value(identityKey).(model.Identity)
+	return identity, ok
+}
+
+func credentialFromRequest(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > len("Bearer ") && strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(header[len("Bearer "):])
+	}
+
+	return r.Header.Get("Session")
+}
@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	_, proxies, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted := []*net.IPNet{proxies}
+
+	tests := []struct {
+		name      string
+		trusted   []*net.IPNet
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{"peer", trusted, "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"forged header from an untrusted peer", trusted, "203.0.113.7:5000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"no trusted proxies", nil, "10.0.0.1:5000", []string{"198.51.100.1"}, "10.0.0.1"},
+		{"one proxy", trusted, "10.0.0.1:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"client prepended a hop", trusted, "10.0.0.1:5000", []string{"1.1.1.1, 203.0.113.7"}, "203.0.113.7"},
+		{"proxy chain", trusted, "10.0.0.1:5000", []string{"1.1.1.1, 203.0.113.7, 10.0.0.2"}, "203.0.113.7"},
+		{"repeated headers", trusted, "10.0.0.1:5000", []string{"1.1.1.1", "203.0.113.7"}, "203.0.113.7"},
+		{"garbage", trusted, "10.0.0.1:5000", []string{"not-an-ip"}, "10.0.0.1"},
+		{"only proxies", trusted, "10.0.0.1:5000", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"no header", trusted, "10.0.0.1:5000", nil, "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+
+			var got string
+			ClientIP(tt.trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = clientFromRequest(r).IP
+			})).ServeHTTP(httptest.NewRecorder(), r)
+
+			if got != tt.want {
+				t.Fatalf("client IP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"github.com/sillamilla/user_microservice/internal/ratelimit"
+	"github.com/sillamilla/user_microservice/internal/users/token"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// KeyFunc picks the bucket a request is counted in.
+type KeyFunc func(r *http.Request) string
+
+// ByIP counts requests per client IP as resolved by ClientIP, so a client
+// cannot move to a new bucket by sending another X-Forwarded-For.
+func ByIP(r *http.Request) string {
+	return "ip:" + clientIP(r)
+}
+
+// ByUser counts authenticated requests per user and falls back to the IP. It
+// has to run after Authenticate.
+func ByUser(r *http.Request) string {
+	identity, ok := IdentityFromContext(r.Context())
+	if !ok {
+		return ByIP(r)
+	}
+
+	return "user:" + identity.User.ID
+}
+
+// ByAPIKey counts requests per X-API-Key header when it is one of keys and
+// falls back to the IP otherwise, so made up keys do not get fresh buckets.
+func ByAPIKey(keys []string) KeyFunc {
+	known := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if key != "" {
+			known[token.Hash(key)] = true
+		}
+	}
+
+	return func(r *http.Request) string {
+		apiKey := token.Hash(r.Header.Get("X-API-Key"))
+		if !known[apiKey] {
+			return ByIP(r)
+		}
+
+		return "apikey:" + apiKey
+	}
+}
+
+// RateLimit rejects requests over rule with 429 and reports the state of the
+// bucket in X-RateLimit-* headers. name separates the buckets of different
+// routes. When the limiter fails the request is let through.
+func RateLimit(limiter ratelimit.Limiter, name string, rule ratelimit.Rule, key KeyFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			result, err := limiter.Allow(r.Context(), name+":"+key(r), rule)
+			if err != nil {
+				log.Printf("request %s: rate limit %s: %v", RequestIDFromContext(r.Context()), name, err)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			reset := strconv.Itoa(int(math.Ceil(result.Reset.Seconds())))
+			w.Header().Set("X-RateLimit-Limit", strconv.FormatInt(result.Limit, 10))
+			w.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(result.Remaining, 10))
+			w.Header().Set("X-RateLimit-Reset", reset)
+
+			if !result.Allowed {
+				w.Header().Set("Retry-After", reset)
+				writeError(w, r, http.StatusTooManyRequests, "too_many_requests", "Rate limit exceeded")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
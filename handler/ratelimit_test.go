@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/sillamilla/user_microservice/internal/ratelimit"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func rateLimited(limiter ratelimit.Limiter, rule ratelimit.Rule, key KeyFunc, trusted []*net.IPNet) http.Handler {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	return ClientIP(trusted)(RateLimit(limiter, "test", rule, key)(ok))
+}
+
+func serve(h http.Handler, remote string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/signin", nil)
+	r.RemoteAddr = remote
+	for key, value := range headers {
+		r.Header.Set(key, value)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestRateLimit(t *testing.T) {
+	h := rateLimited(ratelimit.NewMemory(), ratelimit.Rule{Limit: 2, Window: time.Minute}, ByIP, nil)
+
+	for i, remaining := range []string{"1", "0"} {
+		w := serve(h, "203.0.113.7:5000", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d", i+1, w.Code)
+		}
+		if w.Header().Get("X-RateLimit-Limit") != "2" || w.Header().Get("X-RateLimit-Remaining") != remaining ||
+			w.Header().Get("X-RateLimit-Reset") != "60" {
+			t.Fatalf("request %d headers = %v", i+1, w.Header())
+		}
+	}
+
+	w := serve(h, "203.0.113.7:5000", nil)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("request over the limit: status %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "60" || w.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Fatalf("headers over the limit = %v", w.Header())
+	}
+	var response errorResponse
+	err := json.NewDecoder(w.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Error.Code != "too_many_requests" {
+		t.Fatalf("error = %+v", response.Error)
+	}
+
+	// Another client has its own bucket.
+	w = serve(h, "203.0.113.8:5000", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("request from another IP: status %d", w.Code)
+	}
+}
+
+func TestRateLimitIgnoresForgedForwardedFor(t *testing.T) {
+	_, proxies, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := rateLimited(ratelimit.NewMemory(), ratelimit.Rule{Limit: 1, Window: time.Minute}, ByIP, []*net.IPNet{proxies})
+
+	w := serve(h, "203.0.113.7:5000", map[string]string{"X-Forwarded-For": "198.51.100.1"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("first request: status %d", w.Code)
+	}
+	w = serve(h, "203.0.113.7:5000", map[string]string{"X-Forwarded-For": "198.51.100.2"})
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("request with a forged X-Forwarded-For: status %d, want 429", w.Code)
+	}
+
+	// Behind a trusted proxy the forwarded client is counted.
+	w = serve(h, "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "198.51.100.3"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("forwarded request: status %d", w.Code)
+	}
+	w = serve(h, "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "198.51.100.3"})
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second forwarded request: status %d, want 429", w.Code)
+	}
+}
+
+type failingLimiter struct{}
+
+func (failingLimiter) Allow(ctx context.Context, key string, rule ratelimit.Rule) (ratelimit.Result, error) {
+	return ratelimit.Result{}, errors.New("connection refused")
+}
+
+func TestRateLimitFailsOpen(t *testing.T) {
+	h := rateLimited(failingLimiter{}, ratelimit.Rule{Limit: 1, Window: time.Minute}, ByIP, nil)
+
+	for i := 0; i < 3; i++ {
+		w := serve(h, "203.0.113.7:5000", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d with a failing limiter: status %d", i+1, w.Code)
+		}
+	}
+}
+
+func TestByAPIKey(t *testing.T) {
+	h := rateLimited(ratelimit.NewMemory(), ratelimit.Rule{Limit: 1, Window: time.Minute}, ByAPIKey([]string{"feed"}), nil)
+
+	w := serve(h, "203.0.113.7:5000", map[string]string{"X-API-Key": "feed"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("first request: status %d", w.Code)
+	}
+	// The key follows the client across addresses, requests without one fall
+	// back to the IP.
+	w = serve(h, "203.0.113.8:5000", map[string]string{"X-API-Key": "feed"})
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("same key from another IP: status %d, want 429", w.Code)
+	}
+	w = serve(h, "203.0.113.7:5000", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("request without a key: status %d", w.Code)
+	}
+
+	// Unknown keys are counted per IP, a new key per request does not get
+	// around the limit.
+	w = serve(h, "203.0.113.9:5000", map[string]string{"X-API-Key": "random-1"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("request with an unknown key: status %d", w.Code)
+	}
+	w = serve(h, "203.0.113.9:5000", map[string]string{"X-API-Key": "random-2"})
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("another unknown key from the same IP: status %d, want 429", w.Code)
+	}
+}
@@ -0,0 +1,122 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTP sends mail through an SMTP relay. Authentication is skipped when
+// username is empty.
+func NewSMTP(host string, port string, username string, password string, from string) Mailer {
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return &smtpMailer{
+		addr: host + ":" + port,
+		from: from,
+		auth: auth,
+	}
+}
+
+func (m *smtpMailer) Send(ctx context.Context, msg Message) error {
+	if strings.ContainsAny(msg.To+msg.Subject, "\r\n") {
+		return errors.New("mailer.smtp.Send: header contains a line break")
+	}
+
+	data := "From: " + m.from + "\r\n" +
+		"To: " + msg.To + "\r\n" +
+		"Subject: " + msg.Subject + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + msg.Body
+
+	err := smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, []byte(data))
+	if err != nil {
+		return errors.Wrap(err, "mailer.smtp.Send")
+	}
+
+	return nil
+}
+
+// Memory keeps sent messages in memory. It is meant for tests.
+type Memory struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+func (m *Memory) Send(ctx context.Context, msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.messages = append(m.messages, msg)
+
+	return nil
+}
+
+func (m *Memory) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	messages := make([]Message, len(m.messages))
+	copy(messages, m.messages)
+
+	return messages
+}
+
+type fileMailer struct {
+	dir string
+}
+
+// NewFile writes every message to its own file in dir, which is handy for
+// local development.
+func NewFile(dir string) Mailer {
+	return &fileMailer{
+		dir: dir,
+	}
+}
+
+func (m *fileMailer) Send(ctx context.Context, msg Message) error {
+	err := os.MkdirAll(m.dir, 0o755)
+	if err != nil {
+		return errors.Wrap(err, "mailer.file.Send")
+	}
+
+	name := fmt.Sprintf("%d-%s.txt", time.Now().UnixNano(), strings.NewReplacer("@", "_at_", "/", "_").Replace(msg.To))
+	data := "To: " + msg.To + "\nSubject: " + msg.Subject + "\n\n" + msg.Body + "\n"
+
+	err = os.WriteFile(filepath.Join(m.dir, name), []byte(data), 0o600)
+	if err != nil {
+		return errors.Wrap(err, "mailer.file.Send")
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type memoryLimiter struct {
+	mu        sync.Mutex
+	hits      map[string][]time.Time
+	now       func() time.Time
+	maxWindow time.Duration
+	lastSweep time.Time
+}
+
+// NewMemory returns a limiter that keeps its counters in process. It is meant
+// for tests and single node deployments.
+func NewMemory() Limiter {
+	return &memoryLimiter{
+		hits: make(map[string][]time.Time),
+		now:  time.Now,
+	}
+}
+
+func (l *memoryLimiter) Allow(ctx context.Context, key string, rule Rule) (Result, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	cutoff := now.Add(-rule.Window)
+
+	if rule.Window > l.maxWindow {
+		l.maxWindow = rule.Window
+	}
+	if now.Sub(l.lastSweep) > l.maxWindow {
+		l.sweep(now)
+	}
+
+	hits := l.hits[key]
+	kept := hits[:0]
+	for _, hit := range hits {
+		if hit.After(cutoff) {
+			kept = append(kept, hit)
+		}
+	}
+
+	allowed := int64(len(kept)) < rule.Limit
+	if allowed {
+		kept = append(kept, now)
+	}
+
+	if len(kept) == 0 {
+		delete(l.hits, key)
+	} else {
+		l.hits[key] = kept
+	}
+
+	var reset time.Duration
+	if len(kept) > 0 {
+		reset = kept[0].Add(rule.Window).Sub(now)
+	}
+
+	return Result{
+		Allowed:   allowed,
+		Limit:     rule.Limit,
+		Remaining: rule.Limit - int64(len(kept)),
+		Reset:     reset,
+	}, nil
+}
+
+// sweep drops keys that have not been hit within the longest window in use,
+// so idle clients do not keep memory forever.
+func (l *memoryLimiter) sweep(now time.Time) {
+	cutoff := now.Add(-l.maxWindow)
+	for key, hits := range l.hits {
+		if !hits[len(hits)-1].After(cutoff) {
+			delete(l.hits, key)
+		}
+	}
+
+	l.lastSweep = now
+}
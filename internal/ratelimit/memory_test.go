@@ -0,0 +1,174 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestMemory(now *time.Time) *memoryLimiter {
+	return &memoryLimiter{
+		hits: make(map[string][]time.Time),
+		now:  func() time.Time { return *now },
+	}
+}
+
+func allow(t *testing.T, l Limiter, key string, rule Rule) Result {
+	t.Helper()
+
+	result, err := l.Allow(context.Background(), key, rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return result
+}
+
+func TestMemoryLimit(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newTestMemory(&now)
+	rule := Rule{Limit: 3, Window: time.Minute}
+
+	for i := int64(1); i <= 3; i++ {
+		result := allow(t, l, "ip:1", rule)
+		// Reset counts from the oldest request in the window.
+		reset := time.Minute - time.Duration(i-1)*10*time.Second
+		if !result.Allowed || result.Limit != 3 || result.Remaining != 3-i || result.Reset != reset {
+			t.Fatalf("request %d = %+v", i, result)
+		}
+		now = now.Add(10 * time.Second)
+	}
+
+	result := allow(t, l, "ip:1", rule)
+	if result.Allowed || result.Remaining != 0 {
+		t.Fatalf("request over the limit = %+v", result)
+	}
+	// The first request was 30s ago, its slot frees up in another 30s.
+	if result.Reset != 30*time.Second {
+		t.Fatalf("Reset = %v, want 30s", result.Reset)
+	}
+
+	// Other keys have their own budget.
+	result = allow(t, l, "ip:2", rule)
+	if !result.Allowed || result.Remaining != 2 {
+		t.Fatalf("request for another key = %+v", result)
+	}
+}
+
+// TestMemorySlidingWindow checks slots free up one by one as requests leave
+// the window, rather than all at once like a fixed window.
+func TestMemorySlidingWindow(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newTestMemory(&now)
+	rule := Rule{Limit: 2, Window: time.Minute}
+
+	allow(t, l, "k", rule)
+	now = now.Add(40 * time.Second)
+	allow(t, l, "k", rule)
+	now = now.Add(10 * time.Second)
+	if allow(t, l, "k", rule).Allowed {
+		t.Fatal("third request within the window was allowed")
+	}
+
+	// Rejected requests do not count, the first one leaves the window at 60s.
+	now = now.Add(10 * time.Second)
+	result := allow(t, l, "k", rule)
+	if !result.Allowed || result.Remaining != 0 {
+		t.Fatalf("request after the first left the window = %+v", result)
+	}
+	if allow(t, l, "k", rule).Allowed {
+		t.Fatal("request allowed while the second is still in the window")
+	}
+
+	now = now.Add(time.Minute)
+	result = allow(t, l, "k", rule)
+	if !result.Allowed || result.Remaining != 1 {
+		t.Fatalf("request after the window = %+v", result)
+	}
+}
+
+func TestMemorySweepsIdleKeys(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newTestMemory(&now)
+	rule := Rule{Limit: 5, Window: time.Minute}
+
+	allow(t, l, "idle", rule)
+	now = now.Add(2 * time.Minute)
+	allow(t, l, "active", rule)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.hits["idle"]; ok {
+		t.Fatal("idle key was not swept")
+	}
+	if _, ok := l.hits["active"]; !ok {
+		t.Fatal("active key was swept")
+	}
+}
+
+func TestMemoryConcurrent(t *testing.T) {
+	l := NewMemory()
+	rule := Rule{Limit: 10, Window: time.Minute}
+
+	var mu sync.Mutex
+	allowed := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := l.Allow(context.Background(), "k", rule)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if result.Allowed {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 10 {
+		t.Fatalf("%d concurrent requests allowed, want 10", allowed)
+	}
+}
+
+func TestMemoryConformance(t *testing.T) {
+	testLimiter(t, NewMemory())
+}
+
+// testLimiter checks a limiter on the real clock, so it works for limiters
+// whose clock cannot be stubbed. Keys are unique per run.
+func testLimiter(t *testing.T, l Limiter) {
+	key := "test:" + time.Now().Format(time.RFC3339Nano)
+	rule := Rule{Limit: 2, Window: 200 * time.Millisecond}
+
+	for i := int64(1); i <= 2; i++ {
+		result := allow(t, l, key, rule)
+		if !result.Allowed || result.Remaining != 2-i {
+			t.Fatalf("request %d = %+v", i, result)
+		}
+	}
+
+	result := allow(t, l, key, rule)
+	if result.Allowed || result.Remaining != 0 {
+		t.Fatalf("request over the limit = %+v", result)
+	}
+	if result.Reset <= 0 || result.Reset > rule.Window {
+		t.Fatalf("Reset = %v, want within the window", result.Reset)
+	}
+
+	if !allow(t, l, key+":other", rule).Allowed {
+		t.Fatal("another key was limited")
+	}
+
+	time.Sleep(rule.Window + 50*time.Millisecond)
+	result = allow(t, l, key, rule)
+	if !result.Allowed || result.Remaining != 1 {
+		t.Fatalf("request after the window = %+v", result)
+	}
+}
@@ -0,0 +1,26 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Rule allows Limit requests per key within any Window long period.
+type Rule struct {
+	Limit  int64
+	Window time.Duration
+}
+
+type Result struct {
+	Allowed   bool
+	Limit     int64
+	Remaining int64
+	// Reset is how long until a slot frees up again.
+	Reset time.Duration
+}
+
+// Limiter implements a sliding window log. Implementations must be safe for
+// concurrent use.
+type Limiter interface {
+	Allow(ctx context.Context, key string, rule Rule) (Result, error)
+}
@@ -0,0 +1,65 @@
+package ratelimit
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// slidingWindow keeps one sorted set entry per accepted request, scored by its
+// time in milliseconds. Redis time is used so all replicas share one clock.
+var slidingWindow = redis.NewScript(`
+local key = KEYS[1]
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local member = ARGV[3]
+
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+redis.call('ZREMRANGEBYSCORE', key, 0, now - window)
+local count = redis.call('ZCARD', key)
+
+local allowed = 0
+if count < limit then
+	redis.call('ZADD', key, now, member)
+	redis.call('PEXPIRE', key, window)
+	count = count + 1
+	allowed = 1
+end
+
+local reset = 0
+local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+if oldest[2] then
+	reset = tonumber(oldest[2]) + window - now
+end
+
+return {allowed, limit - count, reset}
+`)
+
+type redisLimiter struct {
+	re *redis.Client
+}
+
+// NewRedis returns a limiter whose counters are shared by every replica
+// connected to the same Redis.
+func NewRedis(re *redis.Client) Limiter {
+	return &redisLimiter{
+		re: re,
+	}
+}
+
+func (l *redisLimiter) Allow(ctx context.Context, key string, rule Rule) (Result, error) {
+	values, err := slidingWindow.Run(ctx, l.re, []string{"ratelimit:" + key}, rule.Window.Milliseconds(), rule.Limit, uuid.NewString()).Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+
+	return Result{
+		Allowed:   values[0] == 1,
+		Limit:     rule.Limit,
+		Remaining: values[1],
+		Reset:     time.Duration(values[2]) * time.Millisecond,
+	}, nil
+}
@@ -0,0 +1,26 @@
+package ratelimit
+
+import (
+	"github.com/redis/go-redis/v9"
+	"os"
+	"testing"
+)
+
+// TestRedisConformance runs against the server in REDIS_TEST_ADDRESS. Its
+// keys expire on their own, it does not flush the database.
+func TestRedisConformance(t *testing.T) {
+	address := os.Getenv("REDIS_TEST_ADDRESS")
+	if address == "" {
+		t.Skip("REDIS_TEST_ADDRESS is not set")
+	}
+
+	re := redis.NewClient(&redis.Options{
+		Addr:     address,
+		Password: os.Getenv("REDIS_TEST_PASSWORD"),
+	})
+	t.Cleanup(func() {
+		_ = re.Close()
+	})
+
+	testLimiter(t, NewRedis(re))
+}
@@ -0,0 +1,267 @@
+package Mongo_storage
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/sillamilla/user_microservice/internal/users/Redis_storage"
+	"github.com/sillamilla/user_microservice/internal/users/model"
+	"golang.org/x/sync/singleflight"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// CacheConfig configures NewCached. Users are cached for TTL. After an update
+// a user is not cached again for Hold, which must be longer than a read of the
+// user storage takes, so a read that started before the update cannot cache
+// what it replaced. A zero Hold means five seconds.
+type CacheConfig struct {
+	TTL  time.Duration
+	Hold time.Duration
+}
+
+// CacheStats counts the lookups served from the cache and those that went to
+// the user storage.
+type CacheStats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+// CachedStorage is a Storage that reads public views of users through a cache
+// kept in the session storage. GetPublicByID and SearchByUsername are cached,
+// concurrent misses for the same user share one read, and EditProfile, the
+// only method that changes the public view, invalidates it. Every other method
+// goes straight to the user storage, so password hashes, second factor
+// secrets and sessions never reach the cache. Cache errors are logged and
+// never fail a call.
+type CachedStorage struct {
+	// hits, misses and generation are first so they are 64-bit aligned for
+	// atomic.
+	hits   int64
+	misses int64
+	// generation is part of every shared read's key and changes with every
+	// invalidation, so no call that starts after an update joins a read that
+	// started before it.
+	generation int64
+
+	next  Storage
+	cache Redis_storage.Storage
+	cfg   CacheConfig
+	group singleflight.Group
+}
+
+func NewCached(next Storage, cache Redis_storage.Storage, cfg CacheConfig) *CachedStorage {
+	if cfg.Hold <= 0 {
+		cfg.Hold = 5 * time.Second
+	}
+
+	return &CachedStorage{
+		next:  next,
+		cache: cache,
+		cfg:   cfg,
+	}
+}
+
+func (db *CachedStorage) Stats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadInt64(&db.hits),
+		Misses: atomic.LoadInt64(&db.misses),
+	}
+}
+
+func (db *CachedStorage) SignUp(ctx context.Context, user model.User) error {
+	return db.next.SignUp(ctx, user)
+}
+
+func (db *CachedStorage) SignIn(ctx context.Context, input model.Input) (model.User, error) {
+	return db.next.SignIn(ctx, input)
+}
+
+func (db *CachedStorage) EditProfile(ctx context.Context, id string, input model.PatchUser, version int64) error {
+	defer db.invalidate(ctx, id)
+	return db.next.EditProfile(ctx, id, input, version)
+}
+
+func (db *CachedStorage) EditPassword(ctx context.Context, id string, password string, version int64) error {
+	return db.next.EditPassword(ctx, id, password, version)
+}
+
+func (db *CachedStorage) SetEmailVerified(ctx context.Context, id string, email string, verifiedAt *time.Time) error {
+	return db.next.SetEmailVerified(ctx, id, email, verifiedAt)
+}
+
+func (db *CachedStorage) EnableTOTP(ctx context.Context, id string, secret string, recoveryCodes []string) error {
+	return db.next.EnableTOTP(ctx, id, secret, recoveryCodes)
+}
+
+func (db *CachedStorage) DisableTOTP(ctx context.Context, id string) error {
+	return db.next.DisableTOTP(ctx, id)
+}
+
+func (db *CachedStorage) UseRecoveryCode(ctx context.Context, id string, code string) (bool, error) {
+	return db.next.UseRecoveryCode(ctx, id, code)
+}
+
+func (db *CachedStorage) GetByID(ctx context.Context, id string) (model.User, error) {
+	return db.next.GetByID(ctx, id)
+}
+
+func (db *CachedStorage) GetByUsername(ctx context.Context, username string) (model.User, error) {
+	return db.next.GetByUsername(ctx, username)
+}
+
+func (db *CachedStorage) GetByEmail(ctx context.Context, email string) (model.User, error) {
+	return db.next.GetByEmail(ctx, email)
+}
+
+func (db *CachedStorage) UpsertSession(ctx context.Context, id string, session model.Session) error {
+	return db.next.UpsertSession(ctx, id, session)
+}
+
+func (db *CachedStorage) DeleteSession(ctx context.Context, id string, token string) error {
+	return db.next.DeleteSession(ctx, id, token)
+}
+
+func (db *CachedStorage) DeleteOtherSessions(ctx context.Context, id string, keepToken string) error {
+	return db.next.DeleteOtherSessions(ctx, id, keepToken)
+}
+
+func (db *CachedStorage) GetBySession(ctx context.Context, session string) (model.User, error) {
+	return db.next.GetBySession(ctx, session)
+}
+
+func (db *CachedStorage) SessionUserIDs(ctx context.Context) ([]string, error) {
+	return db.next.SessionUserIDs(ctx)
+}
+
+func (db *CachedStorage) GetPublicByID(ctx context.Context, id string) (model.UserInfo, error) {
+	user, ok := db.cached(ctx, id)
+	if ok {
+		atomic.AddInt64(&db.hits, 1)
+		return user, nil
+	}
+
+	atomic.AddInt64(&db.misses, 1)
+	return db.load(ctx, "id:"+id, "", func(ctx context.Context) (model.UserInfo, error) {
+		return db.next.GetPublicByID(ctx, id)
+	})
+}
+
+func (db *CachedStorage) SearchByUsername(ctx context.Context, username string) (model.UserInfo, error) {
+	key := model.NormalizeUsername(username)
+	lookup := "username:" + key
+
+	user, ok := db.cachedLookup(ctx, lookup)
+	if ok && model.NormalizeUsername(user.Username) == key {
+		atomic.AddInt64(&db.hits, 1)
+		return user, nil
+	}
+
+	atomic.AddInt64(&db.misses, 1)
+	return db.load(ctx, lookup, lookup, func(ctx context.Context) (model.UserInfo, error) {
+		return db.next.SearchByUsername(ctx, username)
+	})
+}
+
+func (db *CachedStorage) cached(ctx context.Context, id string) (model.UserInfo, bool) {
+	user, err := db.cache.GetCachedUser(ctx, id)
+	if errors.Is(err, redis.Nil) {
+		return model.UserInfo{}, false
+	} else if err != nil {
+		log.Printf("Mongo_storage.CachedStorage: get user %s: %v", id, err)
+		return model.UserInfo{}, false
+	}
+
+	return user.Info(), true
+}
+
+// cachedLookup returns the cached user lookup points to. Lookups are never
+// invalidated, so callers check the user still matches.
+func (db *CachedStorage) cachedLookup(ctx context.Context, lookup string) (model.UserInfo, bool) {
+	id, err := db.cache.GetCachedUserID(ctx, lookup)
+	if errors.Is(err, redis.Nil) {
+		return model.UserInfo{}, false
+	} else if err != nil {
+		log.Printf("Mongo_storage.CachedStorage: get %s: %v", lookup, err)
+		return model.UserInfo{}, false
+	}
+
+	return db.cached(ctx, id)
+}
+
+// load reads a user with read, sharing the read with concurrent loads of the
+// same key since the last invalidation, and caches it along with lookup
+// unless lookup is empty. The shared read does not end with the context of
+// the call that started it, the others would fail with it, and each call
+// stops waiting when its own context is done.
+func (db *CachedStorage) load(ctx context.Context, key string, lookup string, read func(ctx context.Context) (model.UserInfo, error)) (model.UserInfo, error) {
+	key = strconv.FormatInt(atomic.LoadInt64(&db.generation), 10) + ":" + key
+
+	shared := db.group.DoChan(key, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(detachedContext{ctx}, sharedReadTimeout)
+		defer cancel()
+
+		user, err := read(ctx)
+		if err != nil {
+			return model.UserInfo{}, err
+		}
+
+		err = db.cache.CacheUser(ctx, Redis_storage.UserFromInfo(user), db.cfg.TTL)
+		if err != nil {
+			log.Printf("Mongo_storage.CachedStorage: cache user %s: %v", user.ID, err)
+		}
+		if lookup != "" {
+			err = db.cache.CacheUserID(ctx, lookup, user.ID, db.cfg.TTL)
+			if err != nil {
+				log.Printf("Mongo_storage.CachedStorage: cache %s: %v", lookup, err)
+			}
+		}
+
+		return user, nil
+	})
+
+	select {
+	case <-ctx.Done():
+		return model.UserInfo{}, ctx.Err()
+	case result := <-shared:
+		if result.Err != nil {
+			return model.UserInfo{}, result.Err
+		}
+
+		return result.Val.(model.UserInfo), nil
+	}
+}
+
+// sharedReadTimeout bounds a shared read, no call's context does.
+const sharedReadTimeout = 5 * time.Second
+
+// detachedContext keeps the values of a context but neither its deadline nor
+// its cancellation.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+// invalidate drops the cached user with id and starts a new generation, so
+// loads in flight, by id or by any username, are not shared with later calls.
+func (db *CachedStorage) invalidate(ctx context.Context, id string) {
+	err := db.cache.InvalidateCachedUser(ctx, id, db.cfg.Hold)
+	if err != nil {
+		log.Printf("Mongo_storage.CachedStorage: invalidate user %s: %v", id, err)
+	}
+
+	atomic.AddInt64(&db.generation, 1)
+}
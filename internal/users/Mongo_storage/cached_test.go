@@ -0,0 +1,328 @@
+package Mongo_storage_test
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/sillamilla/user_microservice/internal/users/Mongo_storage"
+	"github.com/sillamilla/user_microservice/internal/users/Redis_storage"
+	"github.com/sillamilla/user_microservice/internal/users/model"
+	"go.mongodb.org/mongo-driver/mongo"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingStorage counts reads of public views and, while gate is set, blocks
+// the first of them until it is closed.
+type countingStorage struct {
+	Mongo_storage.Storage
+	reads int64
+	gate  chan struct{}
+}
+
+func (db *countingStorage) GetPublicByID(ctx context.Context, id string) (model.UserInfo, error) {
+	err := db.read(ctx)
+	if err != nil {
+		return model.UserInfo{}, err
+	}
+	return db.Storage.GetPublicByID(ctx, id)
+}
+
+func (db *countingStorage) SearchByUsername(ctx context.Context, username string) (model.UserInfo, error) {
+	err := db.read(ctx)
+	if err != nil {
+		return model.UserInfo{}, err
+	}
+	return db.Storage.SearchByUsername(ctx, username)
+}
+
+// read fails once ctx is done, as a read of a real database would.
+func (db *countingStorage) read(ctx context.Context) error {
+	if atomic.AddInt64(&db.reads, 1) == 1 && db.gate != nil {
+		<-db.gate
+	}
+
+	return ctx.Err()
+}
+
+func newCachedTest(t *testing.T, hold time.Duration) (*Mongo_storage.CachedStorage, *countingStorage, Redis_storage.Storage, model.User) {
+	t.Helper()
+
+	next := &countingStorage{Storage: Mongo_storage.NewMemory()}
+	user := model.UserFromInput("1", model.Input{Username: "Alice", Email: "alice@example.com", Password: "hash"}, time.Now())
+	err := next.SignUp(context.Background(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := Redis_storage.NewMemory()
+	db := Mongo_storage.NewCached(next, cache, Mongo_storage.CacheConfig{TTL: time.Minute, Hold: hold})
+	return db, next, cache, user
+}
+
+func TestCachedReadsThrough(t *testing.T) {
+	db, next, _, user := newCachedTest(t, time.Millisecond)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		got, err := db.GetPublicByID(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != user.ID || got.Username != "Alice" {
+			t.Fatalf("GetPublicByID = %+v", got)
+		}
+	}
+	if next.reads != 1 {
+		t.Fatalf("user storage read %d times, want 1", next.reads)
+	}
+
+	_, err := db.SearchByUsername(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.SearchByUsername(ctx, "ALICE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := db.Stats()
+	if stats.Hits != 3 || stats.Misses != 2 {
+		t.Fatalf("Stats = %+v, want 3 hits and 2 misses", stats)
+	}
+}
+
+// TestCachedKeepsCredentialsOut reads whole users, which must never be cached,
+// they carry the password hash, second factor secrets and sessions.
+func TestCachedKeepsCredentialsOut(t *testing.T) {
+	db, _, cache, user := newCachedTest(t, time.Millisecond)
+	ctx := context.Background()
+
+	err := db.UpsertSession(ctx, user.ID, model.Session{ID: "s1", Token: "digest", UserID: user.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.GetByID(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.GetByUsername(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.GetBySession(ctx, "digest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cache.GetCachedUser(ctx, user.ID)
+	if !errors.Is(err, redis.Nil) {
+		t.Fatalf("GetCachedUser after reading whole users = %v, want redis.Nil", err)
+	}
+	if stats := db.Stats(); stats.Hits != 0 || stats.Misses != 0 {
+		t.Fatalf("Stats = %+v, whole users must not go through the cache", stats)
+	}
+
+	// A deleted session is gone at once, nothing cached outlives it.
+	err = db.DeleteSession(ctx, user.ID, "digest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.GetBySession(ctx, "digest")
+	if err != mongo.ErrNoDocuments {
+		t.Fatalf("GetBySession of a deleted session = %v, want mongo.ErrNoDocuments", err)
+	}
+}
+
+func TestCachedInvalidates(t *testing.T) {
+	db, _, _, user := newCachedTest(t, time.Millisecond)
+	ctx := context.Background()
+
+	_, err := db.SearchByUsername(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bio := "updated"
+	err = db.EditProfile(ctx, user.ID, model.PatchUser{Bio: &bio}, model.AnyVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	got, err := db.GetPublicByID(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Bio != "updated" {
+		t.Fatalf("Bio after EditProfile = %q", got.Bio)
+	}
+
+	// The lookup of the old username is still cached but must not find the
+	// renamed user.
+	username := "bob"
+	err = db.EditProfile(ctx, user.ID, model.PatchUser{Username: &username}, model.AnyVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	_, err = db.SearchByUsername(ctx, "alice")
+	if err != mongo.ErrNoDocuments {
+		t.Fatalf("SearchByUsername of the old username = %v, want mongo.ErrNoDocuments", err)
+	}
+	got, err = db.SearchByUsername(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != user.ID {
+		t.Fatalf("SearchByUsername of the new username = %+v", got)
+	}
+}
+
+func TestCachedHoldsAfterInvalidation(t *testing.T) {
+	db, next, _, user := newCachedTest(t, time.Minute)
+	ctx := context.Background()
+
+	bio := "updated"
+	err := db.EditProfile(ctx, user.ID, model.PatchUser{Bio: &bio}, model.AnyVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		_, err = db.GetPublicByID(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if next.reads != 2 {
+		t.Fatalf("user storage read %d times during the hold, want 2", next.reads)
+	}
+}
+
+func TestCachedSharesConcurrentMisses(t *testing.T) {
+	db, next, _, user := newCachedTest(t, time.Millisecond)
+	next.gate = make(chan struct{})
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := db.GetPublicByID(ctx, user.ID)
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	// Wait for every caller to miss before letting the read finish.
+	for db.Stats().Misses < 10 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(5 * time.Millisecond)
+	close(next.gate)
+	wg.Wait()
+
+	if reads := atomic.LoadInt64(&next.reads); reads != 1 {
+		t.Fatalf("user storage read %d times, want 1", reads)
+	}
+}
+
+// TestCachedUpdateSplitsInFlightMisses updates a user while a read of it by
+// username is in flight. Calls after the update must not get what that read
+// returns.
+func TestCachedUpdateSplitsInFlightMisses(t *testing.T) {
+	db, next, _, user := newCachedTest(t, time.Minute)
+	next.gate = make(chan struct{})
+	ctx := context.Background()
+
+	before := make(chan model.UserInfo, 1)
+	go func() {
+		got, err := db.SearchByUsername(ctx, "alice")
+		if err != nil {
+			t.Error(err)
+		}
+		before <- got
+	}()
+	for atomic.LoadInt64(&next.reads) < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	bio := "updated"
+	err := db.EditProfile(ctx, user.ID, model.PatchUser{Bio: &bio}, model.AnyVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after := make(chan model.UserInfo, 1)
+	go func() {
+		got, err := db.SearchByUsername(ctx, "alice")
+		if err != nil {
+			t.Error(err)
+		}
+		after <- got
+	}()
+
+	// Joining the earlier read would block until the gate is closed.
+	var got model.UserInfo
+	select {
+	case got = <-after:
+	case <-time.After(time.Second):
+		close(next.gate)
+		t.Fatal("SearchByUsername after EditProfile joined a read from before it")
+	}
+	if got.Bio != "updated" {
+		t.Fatalf("Bio read after EditProfile = %q", got.Bio)
+	}
+
+	close(next.gate)
+	<-before
+	got, err = db.GetPublicByID(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Bio != "updated" {
+		t.Fatalf("Bio after the earlier read finished = %q, it cached what the update replaced", got.Bio)
+	}
+}
+
+// TestCachedSharedReadOutlivesCaller cancels the call that started a shared
+// read. The calls that joined it must still get the user.
+func TestCachedSharedReadOutlivesCaller(t *testing.T) {
+	db, next, _, user := newCachedTest(t, time.Minute)
+	next.gate = make(chan struct{})
+
+	first, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := db.GetPublicByID(first, user.ID)
+		firstErr <- err
+	}()
+	for atomic.LoadInt64(&next.reads) < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	joined := make(chan error, 1)
+	go func() {
+		_, err := db.GetPublicByID(context.Background(), user.ID)
+		joined <- err
+	}()
+	for db.Stats().Misses < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	err := <-firstErr
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("GetPublicByID of the canceled call = %v, want context.Canceled", err)
+	}
+	close(next.gate)
+	err = <-joined
+	if err != nil {
+		t.Fatalf("GetPublicByID that joined the read of a canceled call: %v", err)
+	}
+	if reads := atomic.LoadInt64(&next.reads); reads != 1 {
+		t.Fatalf("user storage read %d times, want 1", reads)
+	}
+}
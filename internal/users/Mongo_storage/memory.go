@@ -0,0 +1,374 @@
+package Mongo_storage
+
+import (
+	"context"
+	"github.com/sillamilla/user_microservice/internal/users/model"
+	"go.mongodb.org/mongo-driver/mongo"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryDB struct {
+	mu    sync.RWMutex
+	users map[string]model.User
+}
+
+// NewMemory returns a Storage that keeps users in process memory. It enforces
+// the same unique usernames and case-insensitive unique emails as the Mongo
+// indexes and returns the same errors, so it can stand in for Mongo in local
+// runs and tests.
+func NewMemory() Storage {
+	return &memoryDB{
+		users: make(map[string]model.User),
+	}
+}
+
+func (db *memoryDB) SignUp(ctx context.Context, user model.User) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	err := db.checkUnique(user.ID, user.Username, user.Email)
+	if err != nil {
+		return err
+	}
+
+	db.users[user.ID] = model.User{
+		ID:          user.ID,
+		Username:    user.Username,
+		UsernameKey: model.NormalizeUsername(user.Username),
+		Email:       user.Email,
+		Password:    user.Password,
+		Sessions:    copySessions(user.Sessions),
+		Roles:       append([]string(nil), user.Roles...),
+		Version:     user.Version,
+		CreatedAt:   user.CreatedAt,
+	}
+
+	return nil
+}
+
+func (db *memoryDB) SignIn(ctx context.Context, input model.Input) (model.User, error) {
+	return db.find(func(user model.User) bool {
+		return user.UsernameKey == model.NormalizeUsername(input.Username) && user.Password == input.Password
+	})
+}
+
+func (db *memoryDB) EditProfile(ctx context.Context, id string, input model.PatchUser, version int64) error {
+	if input.Username == nil && input.Email == nil && input.Bio == nil && input.Icon == nil {
+		return nil
+	}
+
+	return db.updateVersioned(id, version, func(user *model.User) error {
+		username, email := user.Username, user.Email
+		if input.Username != nil {
+			username = *input.Username
+		}
+		if input.Email != nil {
+			email = *input.Email
+		}
+		err := db.checkUnique(id, username, email)
+		if err != nil {
+			return err
+		}
+
+		user.Username, user.Email = username, email
+		user.UsernameKey = model.NormalizeUsername(username)
+		if input.Bio != nil {
+			user.Bio = *input.Bio
+		}
+		if input.Icon != nil {
+			user.Icon = *input.Icon
+		}
+
+		return nil
+	})
+}
+
+func (db *memoryDB) EditPassword(ctx context.Context, id string, password string, version int64) error {
+	return db.updateVersioned(id, version, func(user *model.User) error {
+		user.Password = password
+		return nil
+	})
+}
+
+// updateVersioned mirrors mongoDB.updateVersioned: update runs only while the
+// stored version equals version, and the version is bumped afterwards.
+func (db *memoryDB) updateVersioned(id string, version int64, update func(user *model.User) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	stored, ok := db.users[id]
+	if !ok {
+		return mongo.ErrNoDocuments
+	}
+	if version != model.AnyVersion && stored.Version != version {
+		return ErrVersionConflict
+	}
+
+	user := copyUser(stored)
+	err := update(&user)
+	if err != nil {
+		return err
+	}
+	user.Version++
+	db.users[id] = user
+
+	return nil
+}
+
+func (db *memoryDB) SetEmailVerified(ctx context.Context, id string, email string, verifiedAt *time.Time) error {
+	return db.updateVersioned(id, model.AnyVersion, func(user *model.User) error {
+		if user.Email != email {
+			return mongo.ErrNoDocuments
+		}
+
+		user.EmailVerifiedAt = copyTime(verifiedAt)
+		return nil
+	})
+}
+
+func (db *memoryDB) EnableTOTP(ctx context.Context, id string, secret string, recoveryCodes []string) error {
+	err := db.updateVersioned(id, model.AnyVersion, func(user *model.User) error {
+		user.TOTPEnabled = true
+		user.TOTPSecret = secret
+		user.RecoveryCodes = append([]string(nil), recoveryCodes...)
+		return nil
+	})
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+
+	return err
+}
+
+func (db *memoryDB) DisableTOTP(ctx context.Context, id string) error {
+	err := db.updateVersioned(id, model.AnyVersion, func(user *model.User) error {
+		user.TOTPEnabled = false
+		user.TOTPSecret = ""
+		user.RecoveryCodes = []string{}
+		return nil
+	})
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+
+	return err
+}
+
+func (db *memoryDB) UseRecoveryCode(ctx context.Context, id string, code string) (bool, error) {
+	err := db.updateVersioned(id, model.AnyVersion, func(user *model.User) error {
+		codes := user.RecoveryCodes[:0:0]
+		for _, stored := range user.RecoveryCodes {
+			if stored != code {
+				codes = append(codes, stored)
+			}
+		}
+		if len(codes) == len(user.RecoveryCodes) {
+			return mongo.ErrNoDocuments
+		}
+
+		user.RecoveryCodes = codes
+		return nil
+	})
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (db *memoryDB) GetByID(ctx context.Context, id string) (model.User, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	user, ok := db.users[id]
+	if !ok {
+		return model.User{}, mongo.ErrNoDocuments
+	}
+
+	return copyUser(user), nil
+}
+
+func (db *memoryDB) GetByUsername(ctx context.Context, username string) (model.User, error) {
+	key := model.NormalizeUsername(username)
+	return db.find(func(user model.User) bool {
+		return user.UsernameKey == key
+	})
+}
+
+func (db *memoryDB) GetByEmail(ctx context.Context, email string) (model.User, error) {
+	return db.find(func(user model.User) bool {
+		return strings.EqualFold(user.Email, email)
+	})
+}
+
+func (db *memoryDB) GetPublicByID(ctx context.Context, id string) (model.UserInfo, error) {
+	user, err := db.GetByID(ctx, id)
+	if err != nil {
+		return model.UserInfo{}, err
+	}
+
+	return model.PublicFromUser(user), nil
+}
+
+func (db *memoryDB) SearchByUsername(ctx context.Context, username string) (model.UserInfo, error) {
+	user, err := db.GetByUsername(ctx, username)
+	if err != nil {
+		return model.UserInfo{}, err
+	}
+
+	return model.PublicFromUser(user), nil
+}
+
+func (db *memoryDB) GetBySession(ctx context.Context, session string) (model.User, error) {
+	return db.find(func(user model.User) bool {
+		for _, stored := range user.Sessions {
+			if stored.Token == session {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (db *memoryDB) UpsertSession(ctx context.Context, id string, session model.Session) error {
+	session.Current = false
+
+	return db.update(id, func(user *model.User) error {
+		for i, stored := range user.Sessions {
+			if stored.Token == session.Token {
+				user.Sessions[i] = session
+				return nil
+			}
+		}
+
+		user.Sessions = append(user.Sessions, session)
+		return nil
+	})
+}
+
+func (db *memoryDB) DeleteSession(ctx context.Context, id string, token string) error {
+	return db.deleteSessions(id, func(session model.Session) bool {
+		return session.Token == token
+	})
+}
+
+func (db *memoryDB) DeleteOtherSessions(ctx context.Context, id string, keepToken string) error {
+	return db.deleteSessions(id, func(session model.Session) bool {
+		return session.Token != keepToken
+	})
+}
+
+func (db *memoryDB) SessionUserIDs(ctx context.Context) ([]string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	ids := []string{}
+	for id, user := range db.users {
+		if len(user.Sessions) > 0 {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+func (db *memoryDB) deleteSessions(id string, match func(session model.Session) bool) error {
+	err := db.update(id, func(user *model.User) error {
+		sessions := make([]model.Session, 0, len(user.Sessions))
+		for _, session := range user.Sessions {
+			if !match(session) {
+				sessions = append(sessions, session)
+			}
+		}
+		user.Sessions = sessions
+		return nil
+	})
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+
+	return err
+}
+
+// update applies fn to a copy of the user and stores it when fn succeeds.
+func (db *memoryDB) update(id string, fn func(user *model.User) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	stored, ok := db.users[id]
+	if !ok {
+		return mongo.ErrNoDocuments
+	}
+
+	user := copyUser(stored)
+	err := fn(&user)
+	if err != nil {
+		return err
+	}
+	db.users[id] = user
+
+	return nil
+}
+
+func (db *memoryDB) find(match func(user model.User) bool) (model.User, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, user := range db.users {
+		if match(user) {
+			return copyUser(user), nil
+		}
+	}
+
+	return model.User{}, mongo.ErrNoDocuments
+}
+
+// checkUnique reports a duplicate key error when another user than id already
+// has the normalized username or, ignoring case, email. Callers must hold the
+// write lock.
+func (db *memoryDB) checkUnique(id string, username string, email string) error {
+	key := model.NormalizeUsername(username)
+	for _, user := range db.users {
+		if user.ID == id {
+			continue
+		}
+		if user.UsernameKey == key {
+			return DuplicateKeyError(UsernameIndex, "usernamekey", key)
+		}
+		if email != "" && strings.EqualFold(user.Email, email) {
+			return DuplicateKeyError(EmailIndex, "email", email)
+		}
+	}
+
+	return nil
+}
+
+func copyUser(user model.User) model.User {
+	user.EmailVerifiedAt = copyTime(user.EmailVerifiedAt)
+	user.Sessions = copySessions(user.Sessions)
+	user.Roles = append([]string(nil), user.Roles...)
+	user.RecoveryCodes = append([]string(nil), user.RecoveryCodes...)
+
+	return user
+}
+
+func copySessions(sessions []model.Session) []model.Session {
+	if sessions == nil {
+		return nil
+	}
+
+	return append(make([]model.Session, 0, len(sessions)), sessions...)
+}
+
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+
+	c := *t
+	return &c
+}
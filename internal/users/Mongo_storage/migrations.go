@@ -0,0 +1,433 @@
+package Mongo_storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sillamilla/user_microservice/internal/users/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"os"
+	"time"
+)
+
+// Migration is one versioned change to the database. Down undoes Up.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, db *mongo.Database) error
+	Down    func(ctx context.Context, db *mongo.Database) error
+}
+
+// migrations must stay sorted by version. Never edit a migration that was
+// released, add a new one instead.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create_user_indexes",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection("users").Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{
+					Keys:    bson.D{{Key: "id", Value: 1}},
+					Options: options.Index().SetName("id_unique").SetUnique(true),
+				},
+				{
+					Keys:    bson.D{{Key: "username", Value: 1}},
+					Options: options.Index().SetName("username_unique").SetUnique(true),
+				},
+				{
+					Keys: bson.D{{Key: "email", Value: 1}},
+					Options: options.Index().
+						SetName(EmailIndex).
+						SetUnique(true).
+						SetCollation(emailCollation).
+						SetPartialFilterExpression(bson.M{"email": bson.M{"$gt": ""}}),
+				},
+				{
+					// Users without sessions are left out, a unique index would
+					// otherwise treat all their empty arrays as the same key.
+					Keys: bson.D{{Key: "sessions.token", Value: 1}},
+					Options: options.Index().
+						SetName("session_token_unique").
+						SetUnique(true).
+						SetPartialFilterExpression(bson.M{"sessions.token": bson.M{"$exists": true}}),
+				},
+			})
+			return err
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			return dropIndexes(ctx, db.Collection("users"), "id_unique", "username_unique", EmailIndex, "session_token_unique")
+		},
+	},
+	{
+		Version: 2,
+		Name:    "normalized_username_key",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			users := db.Collection("users")
+			cursor, err := users.Find(ctx, bson.M{}, options.Find().SetProjection(bson.M{"id": 1, "username": 1}))
+			if err != nil {
+				return err
+			}
+			defer cursor.Close(ctx)
+
+			for cursor.Next(ctx) {
+				var user model.User
+				err = cursor.Decode(&user)
+				if err != nil {
+					return err
+				}
+
+				_, err = users.UpdateOne(ctx, bson.M{"id": user.ID}, bson.M{"$set": bson.M{"usernamekey": model.NormalizeUsername(user.Username)}})
+				if err != nil {
+					return err
+				}
+			}
+			err = cursor.Err()
+			if err != nil {
+				return err
+			}
+
+			// Fails when existing usernames collide after normalization, they
+			// have to be renamed by hand first.
+			_, err = users.Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys:    bson.D{{Key: "usernamekey", Value: 1}},
+				Options: options.Index().SetName(UsernameIndex).SetUnique(true),
+			})
+			if err != nil {
+				return err
+			}
+
+			return dropIndexes(ctx, users, "username_unique")
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			users := db.Collection("users")
+			_, err := users.Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys:    bson.D{{Key: "username", Value: 1}},
+				Options: options.Index().SetName("username_unique").SetUnique(true),
+			})
+			if err != nil {
+				return err
+			}
+
+			err = dropIndexes(ctx, users, UsernameIndex)
+			if err != nil {
+				return err
+			}
+
+			_, err = users.UpdateMany(ctx, bson.M{}, bson.M{"$unset": bson.M{"usernamekey": ""}})
+			return err
+		},
+	},
+	{
+		// Sessions used to store the token itself. Only SHA-256 digests are
+		// stored now, so the old sessions can never be resolved again and
+		// are removed instead of left readable in the database.
+		Version: 3,
+		Name:    "drop_plaintext_sessions",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection("users").UpdateMany(ctx,
+				bson.M{"sessions.0": bson.M{"$exists": true}},
+				bson.M{"$pull": bson.M{"sessions": bson.M{"token": bson.M{"$not": sessionDigest}}}},
+			)
+			return err
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			return nil
+		},
+	},
+	{
+		// SignUp stored the creation time as createdAt, which model.User
+		// never decoded. It stores createdat now.
+		Version: 4,
+		Name:    "rename_created_at",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection("users").UpdateMany(ctx,
+				bson.M{"createdAt": bson.M{"$exists": true}},
+				bson.M{"$rename": bson.M{"createdAt": "createdat"}},
+			)
+			return err
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection("users").UpdateMany(ctx,
+				bson.M{"createdat": bson.M{"$exists": true}},
+				bson.M{"$rename": bson.M{"createdat": "createdAt"}},
+			)
+			return err
+		},
+	},
+	{
+		// Before sessions, a user had a single session field holding the
+		// token itself. Migration 3 missed it.
+		Version: 5,
+		Name:    "drop_plaintext_session_field",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection("users").UpdateMany(ctx,
+				bson.M{"session": bson.M{"$exists": true}},
+				bson.M{"$unset": bson.M{"session": ""}},
+			)
+			return err
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			return nil
+		},
+	},
+}
+
+// sessionDigest matches a hex SHA-256 digest.
+var sessionDigest = primitive.Regex{Pattern: "^[0-9a-f]{64}$"}
+
+// ErrNotMigrated is returned by CheckMigrations when the database lacks
+// migrations this binary needs.
+var ErrNotMigrated = errors.New("database is not migrated")
+
+type appliedMigration struct {
+	Version   int       `bson:"version"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"appliedat"`
+}
+
+// migrationLock is the _id of the document in schema_migrations that whoever
+// migrates holds. A lock older than migrationLockTTL was left by a migration
+// that died and is taken over. The holder refreshes it every
+// migrationLockRefresh, so a long migration keeps it.
+const (
+	migrationLock        = "lock"
+	migrationLockTTL     = 15 * time.Minute
+	migrationLockRefresh = migrationLockTTL / 5
+	migrationLockPoll    = 500 * time.Millisecond
+)
+
+type lockDocument struct {
+	ID       string    `bson:"_id"`
+	Owner    string    `bson:"owner"`
+	LockedAt time.Time `bson:"lockedat"`
+}
+
+// MigrateUp applies every migration that is not recorded in
+// schema_migrations yet and returns the ones it applied. Concurrent calls wait
+// for each other, so every migration is applied once.
+func MigrateUp(ctx context.Context, mo *mongo.Client) ([]Migration, error) {
+	db := mo.Database("users_microservice")
+	_, err := db.Collection("schema_migrations").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "version", Value: 1}},
+		Options: options.Index().SetName("version_unique").SetUnique(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, unlock, err := lockMigrations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// Read only now, whoever held the lock before may have migrated.
+	current, err := MigrationVersion(ctx, mo)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	for _, migration := range migrations {
+		if migration.Version <= current {
+			continue
+		}
+
+		err = migration.Up(ctx, db)
+		if err != nil {
+			return applied, fmt.Errorf("migration %d %s: %w", migration.Version, migration.Name, err)
+		}
+
+		_, err = db.Collection("schema_migrations").InsertOne(ctx, appliedMigration{
+			Version:   migration.Version,
+			Name:      migration.Name,
+			AppliedAt: time.Now(),
+		})
+		if err != nil {
+			return applied, err
+		}
+		applied = append(applied, migration)
+	}
+
+	return applied, nil
+}
+
+// MigrateDown reverts the latest steps applied migrations and returns the ones
+// it reverted, newest first.
+func MigrateDown(ctx context.Context, mo *mongo.Client, steps int) ([]Migration, error) {
+	db := mo.Database("users_microservice")
+
+	ctx, unlock, err := lockMigrations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var reverted []Migration
+	for i := len(migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+		migration := migrations[i]
+
+		count, err := db.Collection("schema_migrations").CountDocuments(ctx, bson.M{"version": migration.Version})
+		if err != nil {
+			return reverted, err
+		}
+		if count == 0 {
+			continue
+		}
+
+		err = migration.Down(ctx, db)
+		if err != nil {
+			return reverted, fmt.Errorf("migration %d %s: %w", migration.Version, migration.Name, err)
+		}
+
+		_, err = db.Collection("schema_migrations").DeleteOne(ctx, bson.M{"version": migration.Version})
+		if err != nil {
+			return reverted, err
+		}
+		reverted = append(reverted, migration)
+	}
+
+	return reverted, nil
+}
+
+// MigrationVersion returns the highest applied migration, 0 for a database
+// that was never migrated.
+func MigrationVersion(ctx context.Context, mo *mongo.Client) (int, error) {
+	var latest appliedMigration
+
+	opts := options.FindOne().SetSort(bson.D{{Key: "version", Value: -1}})
+	filter := bson.M{"version": bson.M{"$exists": true}}
+	err := mo.Database("users_microservice").Collection("schema_migrations").FindOne(ctx, filter, opts).Decode(&latest)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return latest.Version, nil
+}
+
+// LatestMigration is the version this binary migrates to.
+func LatestMigration() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// CheckMigrations fails with ErrNotMigrated unless all migrations of this
+// binary were applied.
+func CheckMigrations(ctx context.Context, mo *mongo.Client) error {
+	current, err := MigrationVersion(ctx, mo)
+	if err != nil {
+		return err
+	}
+	if current < LatestMigration() {
+		return fmt.Errorf("%w: at version %d, need %d", ErrNotMigrated, current, LatestMigration())
+	}
+
+	return nil
+}
+
+// lockMigrations waits until it holds the migration lock and returns the
+// function that releases it. The lock is refreshed until then, the returned
+// context is canceled when the lock is lost so the migration stops before
+// another one takes over.
+func lockMigrations(ctx context.Context, db *mongo.Database) (context.Context, func(), error) {
+	collection := db.Collection("schema_migrations")
+	owner, _ := os.Hostname()
+	owner = fmt.Sprintf("%s:%d", owner, os.Getpid())
+
+	for {
+		lock := lockDocument{ID: migrationLock, Owner: owner, LockedAt: time.Now()}
+		_, err := collection.InsertOne(ctx, lock)
+		if err == nil {
+			break
+		} else if !mongo.IsDuplicateKeyError(err) {
+			return nil, nil, fmt.Errorf("lock migrations: %w", err)
+		}
+
+		_, err = collection.DeleteOne(ctx, bson.M{"_id": migrationLock, "lockedat": bson.M{"$lt": time.Now().Add(-migrationLockTTL)}})
+		if err != nil {
+			return nil, nil, fmt.Errorf("lock migrations: %w", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, fmt.Errorf("lock migrations: %w", ctx.Err())
+		case <-time.After(migrationLockPoll):
+		}
+	}
+
+	locked, stop := context.WithCancel(ctx)
+	refreshed := make(chan struct{})
+	go func() {
+		defer close(refreshed)
+		refreshMigrationLock(locked, stop, collection, owner)
+	}()
+
+	return locked, func() {
+		stop()
+		<-refreshed
+
+		// Released even when ctx is done, a stale lock would hold off the
+		// next migration for migrationLockTTL.
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		_, _ = collection.DeleteOne(ctx, bson.M{"_id": migrationLock, "owner": owner})
+	}, nil
+}
+
+// refreshMigrationLock moves lockedat of the lock owner holds forward every
+// migrationLockRefresh until ctx is done. It cancels ctx when the lock was
+// taken over, or could not be refreshed for so long that it may have been.
+func refreshMigrationLock(ctx context.Context, cancel context.CancelFunc, collection *mongo.Collection, owner string) {
+	ticker := time.NewTicker(migrationLockRefresh)
+	defer ticker.Stop()
+
+	refreshedAt := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		result, err := collection.UpdateOne(ctx,
+			bson.M{"_id": migrationLock, "owner": owner},
+			bson.M{"$set": bson.M{"lockedat": now}},
+		)
+		if err == nil && result.MatchedCount == 0 {
+			cancel()
+			return
+		} else if err == nil {
+			refreshedAt = now
+		} else if now.Sub(refreshedAt) >= migrationLockTTL-migrationLockRefresh {
+			cancel()
+			return
+		}
+	}
+}
+
+// dropIndexes drops the named indexes, ignoring ones that do not exist.
+func dropIndexes(ctx context.Context, collection *mongo.Collection, names ...string) error {
+	for _, name := range names {
+		_, err := collection.Indexes().DropOne(ctx, name)
+		var cmdErr mongo.CommandError
+		if errors.As(err, &cmdErr) && (cmdErr.Code == indexNotFound || cmdErr.Code == namespaceNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Mongo server error codes.
+const (
+	namespaceNotFound = 26
+	indexNotFound     = 27
+)
@@ -2,27 +2,48 @@ package Mongo_storage
 
 import (
 	"context"
+	"errors"
 	"github.com/sillamilla/user_microservice/internal/users/model"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"strings"
+	"time"
 )
 
 type Storage interface {
 	SignUp(ctx context.Context, user model.User) error
 	SignIn(ctx context.Context, input model.Input) (model.User, error)
 
-	EditProfile(ctx context.Context, id string, input model.UpdateUser) error
-	EditPassword(ctx context.Context, id string, password string) error
+	EditProfile(ctx context.Context, id string, input model.PatchUser, version int64) error
+	EditPassword(ctx context.Context, id string, password string, version int64) error
+	SetEmailVerified(ctx context.Context, id string, email string, verifiedAt *time.Time) error
+
+	EnableTOTP(ctx context.Context, id string, secret string, recoveryCodes []string) error
+	DisableTOTP(ctx context.Context, id string) error
+	UseRecoveryCode(ctx context.Context, id string, code string) (bool, error)
 
 	GetByID(ctx context.Context, id string) (model.User, error)
 	GetByUsername(ctx context.Context, username string) (model.User, error)
+	GetByEmail(ctx context.Context, email string) (model.User, error)
 
-	UpsertSession(ctx context.Context, id string, session string) error
+	UpsertSession(ctx context.Context, id string, session model.Session) error
+	DeleteSession(ctx context.Context, id string, token string) error
+	DeleteOtherSessions(ctx context.Context, id string, keepToken string) error
 	GetBySession(ctx context.Context, session string) (model.User, error)
+	// SessionUserIDs lists the ids of users with at least one session.
+	SessionUserIDs(ctx context.Context) ([]string, error)
+
+	// GetPublicByID and SearchByUsername read only the public view of a user.
+	GetPublicByID(ctx context.Context, id string) (model.UserInfo, error)
 	SearchByUsername(ctx context.Context, username string) (model.UserInfo, error)
 }
 
+var emailCollation = &options.Collation{Locale: "en", Strength: 2}
+
+// publicFields are the fields of model.UserInfo.
+var publicFields = bson.M{"_id": 0, "id": 1, "username": 1, "bio": 1, "icon": 1}
+
 type mongoDB struct {
 	mo *mongo.Client
 }
@@ -34,7 +55,7 @@ func New(mo *mongo.Client) Storage {
 }
 
 func (db *mongoDB) SignUp(ctx context.Context, user model.User) error {
-	_, err := db.mo.Database("users_microservice").Collection("users").InsertOne(ctx, bson.M{"id": user.ID, "username": user.Username, "password": user.Password, "session": user.Session, "createdAt": user.CreatedAt})
+	_, err := db.mo.Database("users_microservice").Collection("users").InsertOne(ctx, bson.M{"id": user.ID, "username": user.Username, "usernamekey": model.NormalizeUsername(user.Username), "email": user.Email, "password": user.Password, "sessions": user.Sessions, "roles": user.Roles, "version": user.Version, "createdat": user.CreatedAt})
 	if err != nil {
 		return err
 	}
@@ -45,7 +66,7 @@ func (db *mongoDB) SignUp(ctx context.Context, user model.User) error {
 func (db *mongoDB) SignIn(ctx context.Context, input model.Input) (model.User, error) {
 	var user model.User
 
-	filter := bson.M{"username": input.Username, "password": input.Password}
+	filter := bson.M{"usernamekey": model.NormalizeUsername(input.Username), "password": input.Password}
 	err := db.mo.Database("users_microservice").Collection("users").FindOne(ctx, filter).Decode(&user)
 	if err != nil {
 		return model.User{}, err
@@ -54,25 +75,132 @@ func (db *mongoDB) SignIn(ctx context.Context, input model.Input) (model.User, e
 	return user, nil
 }
 
-func (db *mongoDB) EditProfile(ctx context.Context, id string, input model.UpdateUser) error {
+// ErrVersionConflict is returned by updates whose expected version no longer
+// matches the stored document.
+var ErrVersionConflict = errors.New("version conflict")
+
+// Names of the unique indexes. Duplicate key errors name the index that
+// rejected the write.
+const (
+	UsernameIndex = "username_key_unique"
+	EmailIndex    = "email_ci_unique"
+)
+
+// IsDuplicateIndex reports whether err is a duplicate key error raised by the
+// unique index named index.
+func IsDuplicateIndex(err error, index string) bool {
+	var writeErr mongo.WriteException
+	if !errors.As(err, &writeErr) {
+		return false
+	}
+
+	for _, e := range writeErr.WriteErrors {
+		if e.Code == 11000 && strings.Contains(e.Message, "index: "+index+" ") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DuplicateKeyError builds the error Mongo returns for a unique index
+// violation, so mongo.IsDuplicateKeyError recognises it. Backends other than
+// Mongo return it to honour the Storage contract.
+func DuplicateKeyError(index string, field string, value string) error {
+	return mongo.WriteException{
+		WriteErrors: mongo.WriteErrors{{
+			Code:    11000,
+			Message: "E11000 duplicate key error collection: users_microservice.users index: " + index + " dup key: { " + field + ": \"" + value + "\" }",
+		}},
+	}
+}
+
+// EditProfile sets only the fields of input that are not nil.
+func (db *mongoDB) EditProfile(ctx context.Context, id string, input model.PatchUser, version int64) error {
+	fields := bson.M{}
+	if input.Username != nil {
+		fields["username"] = *input.Username
+		fields["usernamekey"] = model.NormalizeUsername(*input.Username)
+	}
+	if input.Email != nil {
+		fields["email"] = *input.Email
+	}
+	if input.Bio != nil {
+		fields["bio"] = *input.Bio
+	}
+	if input.Icon != nil {
+		fields["icon"] = *input.Icon
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	return db.updateVersioned(ctx, id, version, fields)
+}
+
+func (db *mongoDB) EditPassword(ctx context.Context, id string, password string, version int64) error {
+	return db.updateVersioned(ctx, id, version, bson.M{"password": password})
+}
+
+// updateVersioned sets fields and bumps the version counter, but only while
+// the stored version equals version. model.AnyVersion skips the check.
+// Documents written before versioning count as version 0.
+func (db *mongoDB) updateVersioned(ctx context.Context, id string, version int64, fields bson.M) error {
+	collection := db.mo.Database("users_microservice").Collection("users")
+
 	filter := bson.M{"id": id}
-	update := bson.M{"$set": bson.M{"username": input.Username, "email": input.Email, "bio": input.Bio, "icon": input.Icon}}
-	options := options.Update().SetUpsert(true)
+	if version == 0 {
+		filter["version"] = bson.M{"$in": bson.A{0, nil}}
+	} else if version != model.AnyVersion {
+		filter["version"] = version
+	}
+	update := bson.M{"$set": fields, "$inc": bson.M{"version": 1}}
+
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount > 0 {
+		return nil
+	}
+
+	count, err := collection.CountDocuments(ctx, bson.M{"id": id})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return ErrVersionConflict
+}
 
-	_, err := db.mo.Database("users_microservice").Collection("users").UpdateOne(ctx, filter, update, options)
+// SetEmailVerified stores when the user's address was verified, nil marks it
+// unverified. Nothing is changed when the stored email is no longer email.
+//
+// It and the two-factor updates below bump the version like every other
+// change to the user's own view. Session updates do not, sessions are not
+// part of that view.
+func (db *mongoDB) SetEmailVerified(ctx context.Context, id string, email string, verifiedAt *time.Time) error {
+	filter := bson.M{"id": id, "email": email}
+	update := bson.M{"$set": bson.M{"emailverifiedat": verifiedAt}, "$inc": bson.M{"version": 1}}
+
+	result, err := db.mo.Database("users_microservice").Collection("users").UpdateOne(ctx, filter, update)
 	if err != nil {
 		return err
 	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
 
 	return nil
 }
 
-func (db *mongoDB) EditPassword(ctx context.Context, id string, password string) error {
+func (db *mongoDB) EnableTOTP(ctx context.Context, id string, secret string, recoveryCodes []string) error {
 	filter := bson.M{"id": id}
-	update := bson.M{"$set": bson.M{"password": password}}
-	options := options.Update().SetUpsert(true)
+	update := bson.M{"$set": bson.M{"totpenabled": true, "totpsecret": secret, "recoverycodes": recoveryCodes}, "$inc": bson.M{"version": 1}}
 
-	_, err := db.mo.Database("users_microservice").Collection("users").UpdateOne(ctx, filter, update, options)
+	_, err := db.mo.Database("users_microservice").Collection("users").UpdateOne(ctx, filter, update)
 	if err != nil {
 		return err
 	}
@@ -80,6 +208,32 @@ func (db *mongoDB) EditPassword(ctx context.Context, id string, password string)
 	return nil
 }
 
+func (db *mongoDB) DisableTOTP(ctx context.Context, id string) error {
+	filter := bson.M{"id": id}
+	update := bson.M{"$set": bson.M{"totpenabled": false, "totpsecret": "", "recoverycodes": []string{}}, "$inc": bson.M{"version": 1}}
+
+	_, err := db.mo.Database("users_microservice").Collection("users").UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UseRecoveryCode removes the hashed recovery code and reports whether it was
+// present, so every code works only once.
+func (db *mongoDB) UseRecoveryCode(ctx context.Context, id string, code string) (bool, error) {
+	filter := bson.M{"id": id, "recoverycodes": code}
+	update := bson.M{"$pull": bson.M{"recoverycodes": code}, "$inc": bson.M{"version": 1}}
+
+	result, err := db.mo.Database("users_microservice").Collection("users").UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+
+	return result.ModifiedCount == 1, nil
+}
+
 func (db *mongoDB) GetByID(ctx context.Context, id string) (model.User, error) {
 	var user model.User
 
@@ -95,7 +249,7 @@ func (db *mongoDB) GetByID(ctx context.Context, id string) (model.User, error) {
 func (db *mongoDB) GetByUsername(ctx context.Context, username string) (model.User, error) {
 	var user model.User
 
-	filter := bson.M{"username": username}
+	filter := bson.M{"usernamekey": model.NormalizeUsername(username)}
 	err := db.mo.Database("users_microservice").Collection("users").FindOne(ctx, filter).Decode(&user)
 	if err != nil {
 		return model.User{}, err
@@ -104,11 +258,36 @@ func (db *mongoDB) GetByUsername(ctx context.Context, username string) (model.Us
 	return user, nil
 }
 
+func (db *mongoDB) GetByEmail(ctx context.Context, email string) (model.User, error) {
+	var user model.User
+
+	filter := bson.M{"email": email}
+	opts := options.FindOne().SetCollation(emailCollation)
+	err := db.mo.Database("users_microservice").Collection("users").FindOne(ctx, filter, opts).Decode(&user)
+	if err != nil {
+		return model.User{}, err
+	}
+
+	return user, nil
+}
+
+func (db *mongoDB) GetPublicByID(ctx context.Context, id string) (model.UserInfo, error) {
+	var user model.UserInfo
+
+	filter := bson.M{"id": id}
+	err := db.mo.Database("users_microservice").Collection("users").FindOne(ctx, filter, options.FindOne().SetProjection(publicFields)).Decode(&user)
+	if err != nil {
+		return model.UserInfo{}, err
+	}
+
+	return user, nil
+}
+
 func (db *mongoDB) SearchByUsername(ctx context.Context, username string) (model.UserInfo, error) {
 	var user model.UserInfo
 
-	filter := bson.M{"username": username}
-	err := db.mo.Database("users_microservice").Collection("users").FindOne(ctx, filter).Decode(&user)
+	filter := bson.M{"usernamekey": model.NormalizeUsername(username)}
+	err := db.mo.Database("users_microservice").Collection("users").FindOne(ctx, filter, options.FindOne().SetProjection(publicFields)).Decode(&user)
 	if err != nil {
 		return model.UserInfo{}, err
 	}
@@ -119,7 +298,7 @@ func (db *mongoDB) SearchByUsername(ctx context.Context, username string) (model
 func (db *mongoDB) GetBySession(ctx context.Context, session string) (model.User, error) {
 	var user model.User
 
-	filter := bson.M{"session": session}
+	filter := bson.M{"sessions.token": session}
 	err := db.mo.Database("users_microservice").Collection("users").FindOne(ctx, filter).Decode(&user)
 	if err != nil {
 		return model.User{}, err
@@ -128,11 +307,65 @@ func (db *mongoDB) GetBySession(ctx context.Context, session string) (model.User
 	return user, nil
 }
 
-func (db *mongoDB) UpsertSession(ctx context.Context, id string, session string) error {
+func (db *mongoDB) UpsertSession(ctx context.Context, id string, session model.Session) error {
+	collection := db.mo.Database("users_microservice").Collection("users")
+
+	filter := bson.M{"id": id, "sessions.token": session.Token}
+	update := bson.M{"$set": bson.M{"sessions.$": session}}
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount > 0 {
+		return nil
+	}
+
+	filter = bson.M{"id": id}
+	update = bson.M{"$push": bson.M{"sessions": session}}
+	result, err = collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+func (db *mongoDB) DeleteSession(ctx context.Context, id string, token string) error {
+	filter := bson.M{"id": id}
+	update := bson.M{"$pull": bson.M{"sessions": bson.M{"token": token}}}
+	_, err := db.mo.Database("users_microservice").Collection("users").UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *mongoDB) SessionUserIDs(ctx context.Context) ([]string, error) {
+	filter := bson.M{"sessions.0": bson.M{"$exists": true}}
+	values, err := db.mo.Database("users_microservice").Collection("users").Distinct(ctx, "id", filter)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(values))
+	for _, value := range values {
+		id, ok := value.(string)
+		if ok {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+func (db *mongoDB) DeleteOtherSessions(ctx context.Context, id string, keepToken string) error {
 	filter := bson.M{"id": id}
-	update := bson.M{"$set": bson.M{"session": session}}
-	options := options.Update().SetUpsert(true)
-	_, err := db.mo.Database("users_microservice").Collection("users").UpdateOne(ctx, filter, update, options)
+	update := bson.M{"$pull": bson.M{"sessions": bson.M{"token": bson.M{"$ne": keepToken}}}}
+	_, err := db.mo.Database("users_microservice").Collection("users").UpdateOne(ctx, filter, update)
 	if err != nil {
 		return err
 	}
@@ -1 +1,168 @@
-package Mongo_storage
+package Mongo_storage_test
+
+import (
+	"context"
+	"github.com/sillamilla/user_microservice/internal/users/Mongo_storage"
+	"github.com/sillamilla/user_microservice/internal/users/Redis_storage"
+	"github.com/sillamilla/user_microservice/internal/users/storagetest"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryConformance(t *testing.T) {
+	storagetest.RunUserStorage(t, func(t *testing.T) Mongo_storage.Storage {
+		return Mongo_storage.NewMemory()
+	})
+}
+
+// TestCachedConformance checks the cache never serves a user an update has
+// replaced, the suite reads back after every write.
+func TestCachedConformance(t *testing.T) {
+	storagetest.RunUserStorage(t, func(t *testing.T) Mongo_storage.Storage {
+		return Mongo_storage.NewCached(Mongo_storage.NewMemory(), Redis_storage.NewMemory(), Mongo_storage.CacheConfig{TTL: time.Minute})
+	})
+}
+
+// TestMongoConformance runs against the server in MONGO_TEST_ADDRESS. It drops
+// the database before every subtest, never point it at real data.
+func TestMongoConformance(t *testing.T) {
+	mo := connect(t)
+	ctx := context.Background()
+
+	storagetest.RunUserStorage(t, func(t *testing.T) Mongo_storage.Storage {
+		err := mo.Database("users_microservice").Drop(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = Mongo_storage.MigrateUp(ctx, mo)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return Mongo_storage.New(mo)
+	})
+}
+
+// TestMongoMigrations migrates documents written before the migrations, in the
+// database of MONGO_TEST_ADDRESS like TestMongoConformance.
+func TestMongoMigrations(t *testing.T) {
+	mo := connect(t)
+	ctx := context.Background()
+
+	db := mo.Database("users_microservice")
+	err := db.Drop(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createdAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	_, err = db.Collection("users").InsertOne(ctx, bson.M{
+		"id":        "1",
+		"username":  "Alice",
+		"session":   "plaintext-token",
+		"sessions":  bson.A{bson.M{"id": "s1", "token": "plaintext-token"}},
+		"createdAt": createdAt,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Mongo_storage.MigrateUp(ctx, mo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stored bson.M
+	err = db.Collection("users").FindOne(ctx, bson.M{"id": "1"}).Decode(&stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := stored["createdAt"]; ok {
+		t.Errorf("createdAt was not renamed: %v", stored)
+	}
+	if _, ok := stored["session"]; ok {
+		t.Errorf("the plaintext session field was kept: %v", stored)
+	}
+	if sessions, _ := stored["sessions"].(bson.A); len(sessions) != 0 {
+		t.Errorf("plaintext sessions were kept: %v", sessions)
+	}
+
+	user, err := Mongo_storage.New(mo).GetByID(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.CreatedAt.Equal(createdAt) {
+		t.Errorf("created at %v after the migration, want %v", user.CreatedAt, createdAt)
+	}
+	if user.UsernameKey != "alice" {
+		t.Errorf("username key %q after the migration, want alice", user.UsernameKey)
+	}
+}
+
+// TestMongoConcurrentMigrateUp migrates from several processes at once, which
+// must apply every migration exactly once.
+func TestMongoConcurrentMigrateUp(t *testing.T) {
+	mo := connect(t)
+	ctx := context.Background()
+
+	err := mo.Database("users_microservice").Drop(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	applied := make([]int, 4)
+	errs := make([]error, len(applied))
+	for i := range applied {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			migrations, err := Mongo_storage.MigrateUp(ctx, mo)
+			applied[i], errs[i] = len(migrations), err
+		}(i)
+	}
+	wg.Wait()
+
+	total := 0
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("MigrateUp %d: %v", i, err)
+		}
+		total += applied[i]
+	}
+	if total != Mongo_storage.LatestMigration() {
+		t.Fatalf("applied %d migrations in total, want %d", total, Mongo_storage.LatestMigration())
+	}
+
+	err = Mongo_storage.CheckMigrations(ctx, mo)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// connect connects to MONGO_TEST_ADDRESS and skips the test when it is not set.
+func connect(t *testing.T) *mongo.Client {
+	t.Helper()
+
+	address := os.Getenv("MONGO_TEST_ADDRESS")
+	if address == "" {
+		t.Skip("MONGO_TEST_ADDRESS is not set")
+	}
+
+	ctx := context.Background()
+	mo, err := mongo.Connect(ctx, options.Client().ApplyURI(address))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = mo.Disconnect(ctx)
+	})
+
+	return mo
+}
@@ -0,0 +1,133 @@
+package Postgres_storage
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"github.com/sillamilla/user_microservice/internal/users/model"
+	"io/fs"
+	"strings"
+)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// migrationLock is the advisory lock key that keeps two instances from
+// migrating at the same time.
+const migrationLock = 72910614
+
+// Migrate applies the embedded migrations that are not recorded in
+// schema_migrations yet, in file name order. Every migration runs in its own
+// transaction.
+func Migrate(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    TEXT PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return err
+	}
+
+	entries, err := fs.ReadDir(migrations, "migrations")
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		version := strings.TrimSuffix(entry.Name(), ".sql")
+		script, err := migrations.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return err
+		}
+
+		err = applyMigration(ctx, db, version, string(script))
+		if err != nil {
+			return fmt.Errorf("migration %s: %w", version, err)
+		}
+	}
+
+	return nil
+}
+
+// beforeMigration holds the steps SQL can not do, each runs in the
+// transaction of its migration right before the script.
+var beforeMigration = map[string]func(ctx context.Context, tx *sql.Tx) error{
+	"0005_username_key_not_null": backfillUsernameKeys,
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, version string, script string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationLock)
+	if err != nil {
+		return err
+	}
+
+	var applied bool
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, version).Scan(&applied)
+	if err != nil {
+		return err
+	}
+	if applied {
+		return nil
+	}
+
+	if before := beforeMigration[version]; before != nil {
+		err = before(ctx, tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, script)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, version)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// backfillUsernameKeys sets username_key for rows written before it existed.
+// It fails when two existing usernames collide after normalization, those
+// have to be renamed by hand.
+func backfillUsernameKeys(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `SELECT id, username FROM users WHERE username_key IS NULL`)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]string)
+	for rows.Next() {
+		var id, username string
+		err = rows.Scan(&id, &username)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		keys[id] = model.NormalizeUsername(username)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	for id, key := range keys {
+		_, err = tx.ExecContext(ctx, `UPDATE users SET username_key = $1 WHERE id = $2`, key, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,33 @@
+CREATE TABLE users (
+    id                TEXT PRIMARY KEY,
+    username          TEXT        NOT NULL,
+    email             TEXT        NOT NULL DEFAULT '',
+    email_verified_at TIMESTAMPTZ,
+    password          TEXT        NOT NULL,
+    bio               TEXT        NOT NULL DEFAULT '',
+    icon              TEXT        NOT NULL DEFAULT '',
+    roles             TEXT[]      NOT NULL DEFAULT '{}',
+    totp_enabled      BOOLEAN     NOT NULL DEFAULT FALSE,
+    totp_secret       TEXT        NOT NULL DEFAULT '',
+    recovery_codes    TEXT[]      NOT NULL DEFAULT '{}',
+    version           BIGINT      NOT NULL DEFAULT 1,
+    created_at        TIMESTAMPTZ NOT NULL
+);
+
+CREATE UNIQUE INDEX username_unique ON users (username);
+
+-- Emails are unique regardless of case, users without an email are exempt.
+CREATE UNIQUE INDEX email_ci_unique ON users (lower(email)) WHERE email <> '';
+
+CREATE TABLE user_sessions (
+    user_id      TEXT        NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    token        TEXT        NOT NULL,
+    id           TEXT        NOT NULL,
+    user_agent   TEXT        NOT NULL DEFAULT '',
+    ip           TEXT        NOT NULL DEFAULT '',
+    created_at   TIMESTAMPTZ NOT NULL,
+    last_seen_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (user_id, token)
+);
+
+CREATE INDEX user_sessions_token ON user_sessions (token);
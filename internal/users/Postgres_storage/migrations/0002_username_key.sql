@@ -0,0 +1,7 @@
+-- username_key holds model.NormalizeUsername(username). Existing rows are
+-- filled in by Migrate, which can not be done in SQL.
+ALTER TABLE users ADD COLUMN username_key TEXT;
+
+CREATE UNIQUE INDEX username_key_unique ON users (username_key);
+
+DROP INDEX username_unique;
@@ -0,0 +1,3 @@
+-- Sessions used to store the token itself, only SHA-256 digests are stored
+-- now. The old sessions can never be resolved again.
+DELETE FROM user_sessions WHERE token !~ '^[0-9a-f]{64}$';
@@ -0,0 +1,3 @@
+-- Sessions end at expires_at. Sessions from before have none and are given
+-- created_at plus the configured lifetime by the service.
+ALTER TABLE user_sessions ADD COLUMN expires_at TIMESTAMPTZ;
@@ -0,0 +1,3 @@
+-- Every row has a username_key by now, Migrate backfills rows from before
+-- 0002 right before this runs.
+ALTER TABLE users ALTER COLUMN username_key SET NOT NULL;
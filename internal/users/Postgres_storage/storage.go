@@ -0,0 +1,363 @@
+package Postgres_storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/lib/pq"
+	"github.com/sillamilla/user_microservice/internal/users/Mongo_storage"
+	"github.com/sillamilla/user_microservice/internal/users/model"
+	"go.mongodb.org/mongo-driver/mongo"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Postgres error codes, see https://www.postgresql.org/docs/current/errcodes-appendix.html
+const (
+	uniqueViolation     = "23505"
+	foreignKeyViolation = "23503"
+)
+
+type postgresDB struct {
+	db *sql.DB
+}
+
+// New returns a Mongo_storage.Storage backed by Postgres. It returns the same
+// errors as the Mongo storage: mongo.ErrNoDocuments when nothing matched, a
+// duplicate key error for taken usernames and emails and
+// Mongo_storage.ErrVersionConflict for stale versions. Run Migrate first.
+func New(db *sql.DB) Mongo_storage.Storage {
+	return &postgresDB{
+		db: db,
+	}
+}
+
+const userColumns = `id, username, email, email_verified_at, password, bio, icon, roles, totp_enabled, totp_secret, recovery_codes, version, created_at`
+
+func (db *postgresDB) SignUp(ctx context.Context, user model.User) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO users (id, username, username_key, email, password, roles, version, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		user.ID, user.Username, model.NormalizeUsername(user.Username), user.Email, user.Password, pq.Array(user.Roles), user.Version, user.CreatedAt)
+	if err != nil {
+		return convertError(err, user.Username, user.Email)
+	}
+
+	for _, session := range user.Sessions {
+		err = upsertSession(ctx, tx, user.ID, session)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (db *postgresDB) SignIn(ctx context.Context, input model.Input) (model.User, error) {
+	return db.getUser(ctx, `username_key = $1 AND password = $2`, model.NormalizeUsername(input.Username), input.Password)
+}
+
+func (db *postgresDB) EditProfile(ctx context.Context, id string, input model.PatchUser, version int64) error {
+	var columns []string
+	var args []interface{}
+	set := func(column string, value string) {
+		args = append(args, value)
+		columns = append(columns, column+" = $"+strconv.Itoa(len(args)))
+	}
+
+	username, email := "", ""
+	if input.Username != nil {
+		username = *input.Username
+		set("username", username)
+		set("username_key", model.NormalizeUsername(username))
+	}
+	if input.Email != nil {
+		email = *input.Email
+		set("email", email)
+	}
+	if input.Bio != nil {
+		set("bio", *input.Bio)
+	}
+	if input.Icon != nil {
+		set("icon", *input.Icon)
+	}
+	if len(columns) == 0 {
+		return nil
+	}
+
+	err := db.updateVersioned(ctx, id, version, strings.Join(columns, ", "), args)
+	if err != nil {
+		return convertError(err, username, email)
+	}
+
+	return nil
+}
+
+func (db *postgresDB) EditPassword(ctx context.Context, id string, password string, version int64) error {
+	return db.updateVersioned(ctx, id, version, "password = $1", []interface{}{password})
+}
+
+// updateVersioned runs UPDATE users SET set, bumping the version, while the
+// stored version equals version. model.AnyVersion skips the check. The
+// placeholders in set are numbered from $1 and bound to args.
+func (db *postgresDB) updateVersioned(ctx context.Context, id string, version int64, set string, args []interface{}) error {
+	args = append(args, id)
+	query := `UPDATE users SET ` + set + `, version = version + 1 WHERE id = $` + strconv.Itoa(len(args))
+	if version != model.AnyVersion {
+		args = append(args, version)
+		query += ` AND version = $` + strconv.Itoa(len(args))
+	}
+
+	result, err := db.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	matched, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if matched > 0 {
+		return nil
+	}
+
+	var exists bool
+	err = db.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`, id).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return mongo.ErrNoDocuments
+	}
+
+	return Mongo_storage.ErrVersionConflict
+}
+
+func (db *postgresDB) SetEmailVerified(ctx context.Context, id string, email string, verifiedAt *time.Time) error {
+	result, err := db.db.ExecContext(ctx, `UPDATE users SET email_verified_at = $3, version = version + 1 WHERE id = $1 AND email = $2`, id, email, verifiedAt)
+	if err != nil {
+		return err
+	}
+
+	matched, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if matched == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+func (db *postgresDB) EnableTOTP(ctx context.Context, id string, secret string, recoveryCodes []string) error {
+	_, err := db.db.ExecContext(ctx, `UPDATE users SET totp_enabled = TRUE, totp_secret = $2, recovery_codes = $3, version = version + 1 WHERE id = $1`, id, secret, pq.Array(recoveryCodes))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *postgresDB) DisableTOTP(ctx context.Context, id string) error {
+	_, err := db.db.ExecContext(ctx, `UPDATE users SET totp_enabled = FALSE, totp_secret = '', recovery_codes = '{}', version = version + 1 WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *postgresDB) UseRecoveryCode(ctx context.Context, id string, code string) (bool, error) {
+	result, err := db.db.ExecContext(ctx, `UPDATE users SET recovery_codes = array_remove(recovery_codes, $2), version = version + 1 WHERE id = $1 AND $2 = ANY (recovery_codes)`, id, code)
+	if err != nil {
+		return false, err
+	}
+
+	used, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return used == 1, nil
+}
+
+func (db *postgresDB) GetByID(ctx context.Context, id string) (model.User, error) {
+	return db.getUser(ctx, `id = $1`, id)
+}
+
+func (db *postgresDB) GetByUsername(ctx context.Context, username string) (model.User, error) {
+	return db.getUser(ctx, `username_key = $1`, model.NormalizeUsername(username))
+}
+
+func (db *postgresDB) GetByEmail(ctx context.Context, email string) (model.User, error) {
+	return db.getUser(ctx, `lower(email) = lower($1) AND email <> ''`, email)
+}
+
+func (db *postgresDB) GetPublicByID(ctx context.Context, id string) (model.UserInfo, error) {
+	return db.getPublic(ctx, `id = $1`, id)
+}
+
+func (db *postgresDB) SearchByUsername(ctx context.Context, username string) (model.UserInfo, error) {
+	return db.getPublic(ctx, `username_key = $1`, model.NormalizeUsername(username))
+}
+
+func (db *postgresDB) getPublic(ctx context.Context, where string, args ...interface{}) (model.UserInfo, error) {
+	var user model.UserInfo
+
+	err := db.db.QueryRowContext(ctx, `SELECT id, username, bio, icon FROM users WHERE `+where, args...).
+		Scan(&user.ID, &user.Username, &user.Bio, &user.Icon)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.UserInfo{}, mongo.ErrNoDocuments
+	} else if err != nil {
+		return model.UserInfo{}, err
+	}
+
+	return user, nil
+}
+
+func (db *postgresDB) GetBySession(ctx context.Context, session string) (model.User, error) {
+	return db.getUser(ctx, `id = (SELECT user_id FROM user_sessions WHERE token = $1 LIMIT 1)`, session)
+}
+
+func (db *postgresDB) UpsertSession(ctx context.Context, id string, session model.Session) error {
+	err := upsertSession(ctx, db.db, id, session)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *postgresDB) DeleteSession(ctx context.Context, id string, token string) error {
+	_, err := db.db.ExecContext(ctx, `DELETE FROM user_sessions WHERE user_id = $1 AND token = $2`, id, token)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *postgresDB) SessionUserIDs(ctx context.Context) ([]string, error) {
+	rows, err := db.db.QueryContext(ctx, `SELECT DISTINCT user_id FROM user_sessions`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+func (db *postgresDB) DeleteOtherSessions(ctx context.Context, id string, keepToken string) error {
+	_, err := db.db.ExecContext(ctx, `DELETE FROM user_sessions WHERE user_id = $1 AND token <> $2`, id, keepToken)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func upsertSession(ctx context.Context, ex execer, id string, session model.Session) error {
+	_, err := ex.ExecContext(ctx, `INSERT INTO user_sessions (user_id, token, id, user_agent, ip, created_at, last_seen_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (user_id, token) DO UPDATE SET
+			id = excluded.id,
+			user_agent = excluded.user_agent,
+			ip = excluded.ip,
+			created_at = excluded.created_at,
+			last_seen_at = excluded.last_seen_at,
+			expires_at = excluded.expires_at`,
+		id, session.Token, session.ID, session.UserAgent, session.IP, session.CreatedAt, session.LastSeenAt,
+		sql.NullTime{Time: session.ExpiresAt, Valid: !session.ExpiresAt.IsZero()})
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == foreignKeyViolation {
+		return mongo.ErrNoDocuments
+	}
+
+	return err
+}
+
+// getUser loads the user matching where together with its sessions.
+func (db *postgresDB) getUser(ctx context.Context, where string, args ...interface{}) (model.User, error) {
+	var user model.User
+	var verifiedAt sql.NullTime
+
+	err := db.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE `+where, args...).Scan(
+		&user.ID, &user.Username, &user.Email, &verifiedAt, &user.Password, &user.Bio, &user.Icon,
+		pq.Array(&user.Roles), &user.TOTPEnabled, &user.TOTPSecret, pq.Array(&user.RecoveryCodes),
+		&user.Version, &user.CreatedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.User{}, mongo.ErrNoDocuments
+	} else if err != nil {
+		return model.User{}, err
+	}
+	if verifiedAt.Valid {
+		user.EmailVerifiedAt = &verifiedAt.Time
+	}
+
+	rows, err := db.db.QueryContext(ctx, `SELECT id, token, user_agent, ip, created_at, last_seen_at, expires_at FROM user_sessions WHERE user_id = $1 ORDER BY created_at`, user.ID)
+	if err != nil {
+		return model.User{}, err
+	}
+	defer rows.Close()
+
+	user.Sessions = []model.Session{}
+	for rows.Next() {
+		session := model.Session{UserID: user.ID}
+		var expiresAt sql.NullTime
+		err = rows.Scan(&session.ID, &session.Token, &session.UserAgent, &session.IP, &session.CreatedAt, &session.LastSeenAt, &expiresAt)
+		if err != nil {
+			return model.User{}, err
+		}
+		session.ExpiresAt = expiresAt.Time
+		user.Sessions = append(user.Sessions, session)
+	}
+	err = rows.Err()
+	if err != nil {
+		return model.User{}, err
+	}
+
+	return user, nil
+}
+
+// convertError turns unique violations into the duplicate key error the
+// Storage contract promises.
+func convertError(err error, username string, email string) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != uniqueViolation {
+		return err
+	}
+
+	switch pqErr.Constraint {
+	case Mongo_storage.UsernameIndex:
+		return Mongo_storage.DuplicateKeyError(pqErr.Constraint, "username_key", model.NormalizeUsername(username))
+	case Mongo_storage.EmailIndex:
+		return Mongo_storage.DuplicateKeyError(pqErr.Constraint, "email", email)
+	default:
+		return Mongo_storage.DuplicateKeyError(pqErr.Constraint, "id", "")
+	}
+}
@@ -0,0 +1,43 @@
+package Postgres_storage_test
+
+import (
+	"context"
+	"database/sql"
+	"github.com/sillamilla/user_microservice/internal/users/Mongo_storage"
+	"github.com/sillamilla/user_microservice/internal/users/Postgres_storage"
+	"github.com/sillamilla/user_microservice/internal/users/storagetest"
+	"os"
+	"testing"
+)
+
+// TestPostgresConformance runs against the database in POSTGRES_TEST_DSN. It
+// drops the user tables before every subtest, never point it at real data.
+func TestPostgresConformance(t *testing.T) {
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_TEST_DSN is not set")
+	}
+
+	ctx := context.Background()
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	storagetest.RunUserStorage(t, func(t *testing.T) Mongo_storage.Storage {
+		_, err := db.ExecContext(ctx, `DROP TABLE IF EXISTS user_sessions, users, schema_migrations`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = Postgres_storage.Migrate(ctx, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return Postgres_storage.New(db)
+	})
+}
@@ -0,0 +1,42 @@
+package Redis_storage_test
+
+import (
+	"context"
+	"github.com/redis/go-redis/v9"
+	"github.com/sillamilla/user_microservice/internal/users/Redis_storage"
+	"github.com/sillamilla/user_microservice/internal/users/storagetest"
+	"os"
+	"testing"
+)
+
+func TestMemoryConformance(t *testing.T) {
+	storagetest.RunSessionStorage(t, func(t *testing.T) Redis_storage.Storage {
+		return Redis_storage.NewMemory()
+	})
+}
+
+// TestRedisConformance runs against the server in REDIS_TEST_ADDRESS. It
+// flushes the database before every subtest, never point it at real data.
+func TestRedisConformance(t *testing.T) {
+	address := os.Getenv("REDIS_TEST_ADDRESS")
+	if address == "" {
+		t.Skip("REDIS_TEST_ADDRESS is not set")
+	}
+
+	re := redis.NewClient(&redis.Options{
+		Addr:     address,
+		Password: os.Getenv("REDIS_TEST_PASSWORD"),
+	})
+	t.Cleanup(func() {
+		_ = re.Close()
+	})
+
+	storagetest.RunSessionStorage(t, func(t *testing.T) Redis_storage.Storage {
+		err := re.FlushDB(context.Background()).Err()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return Redis_storage.New(re)
+	})
+}
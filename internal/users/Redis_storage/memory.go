@@ -0,0 +1,544 @@
+package Redis_storage
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/redis/go-redis/v9"
+	"github.com/sillamilla/user_microservice/internal/users/model"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryEntry is a string value or, when members is not nil, a set. A zero
+// expiresAt means the key does not expire.
+type memoryEntry struct {
+	value     string
+	members   map[string]struct{}
+	expiresAt time.Time
+}
+
+type memoryDB struct {
+	mu        sync.Mutex
+	keys      map[string]memoryEntry
+	now       func() time.Time
+	lastSweep time.Time
+}
+
+// NewMemory returns a Storage that keeps its keys in process memory with the
+// same layout, expiry and errors (redis.Nil for missing keys) as the Redis
+// storage. It is meant for tests and running the service without Redis.
+func NewMemory() Storage {
+	return &memoryDB{
+		keys: make(map[string]memoryEntry),
+		now:  time.Now,
+	}
+}
+
+// memorySweepInterval is how often expired keys that were never read again
+// are dropped.
+const memorySweepInterval = time.Minute
+
+func (db *memoryDB) UpsertSession(ctx context.Context, session model.Session, ttl time.Duration) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	userKey := "user_session_digests:" + session.UserID
+	db.set("session_digest:"+session.Token, string(data), ttl)
+	db.sadd(userKey, session.Token)
+	db.extend(userKey, ttl)
+
+	return nil
+}
+
+func (db *memoryDB) GetSession(ctx context.Context, token string) (model.Session, error) {
+	db.mu.Lock()
+	data, ok := db.get("session_digest:" + token)
+	db.mu.Unlock()
+	if !ok {
+		return model.Session{}, redis.Nil
+	}
+
+	var session model.Session
+	err := json.Unmarshal([]byte(data), &session)
+	if err != nil {
+		return model.Session{}, err
+	}
+
+	return session, nil
+}
+
+func (db *memoryDB) ListSessions(ctx context.Context, userID string) ([]model.Session, error) {
+	userKey := "user_session_digests:" + userID
+
+	db.mu.Lock()
+	tokens := db.smembers(userKey)
+	db.mu.Unlock()
+
+	sessions := make([]model.Session, 0, len(tokens))
+	for _, token := range tokens {
+		session, err := db.GetSession(ctx, token)
+		if err == redis.Nil {
+			db.mu.Lock()
+			db.srem(userKey, token)
+			db.mu.Unlock()
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+func (db *memoryDB) DeleteSession(ctx context.Context, userID string, token string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.del("session_digest:" + token)
+	db.srem("user_session_digests:"+userID, token)
+
+	return nil
+}
+
+func (db *memoryDB) SessionUserIDs(ctx context.Context) ([]string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	ids := []string{}
+	for key := range db.keys {
+		if !strings.HasPrefix(key, "user_session_digests:") {
+			continue
+		}
+		_, ok := db.entry(key)
+		if ok {
+			ids = append(ids, strings.TrimPrefix(key, "user_session_digests:"))
+		}
+	}
+
+	return ids, nil
+}
+
+func (db *memoryDB) SaveRefreshToken(ctx context.Context, token model.RefreshToken) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	ttl := token.ExpiresAt.Sub(db.now())
+	userKey := "user_refresh_families:" + token.UserID
+	db.set("refresh:"+token.Hash, string(data), ttl)
+	db.set("refresh_family:"+token.Family, token.UserID, ttl)
+	db.sadd(userKey, token.Family)
+	db.expire(userKey, ttl)
+
+	return nil
+}
+
+func (db *memoryDB) GetRefreshToken(ctx context.Context, hash string) (model.RefreshToken, error) {
+	db.mu.Lock()
+	data, ok := db.get("refresh:" + hash)
+	db.mu.Unlock()
+	if !ok {
+		return model.RefreshToken{}, redis.Nil
+	}
+
+	var token model.RefreshToken
+	err := json.Unmarshal([]byte(data), &token)
+	if err != nil {
+		return model.RefreshToken{}, err
+	}
+
+	return token, nil
+}
+
+func (db *memoryDB) UseRefreshToken(ctx context.Context, token model.RefreshToken) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.setNX("refresh_used:"+token.Hash, "1", token.ExpiresAt.Sub(db.now())), nil
+}
+
+func (db *memoryDB) RefreshFamilyActive(ctx context.Context, family string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	_, ok := db.get("refresh_family:" + family)
+	return ok, nil
+}
+
+func (db *memoryDB) RevokeRefreshFamily(ctx context.Context, family string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.del("refresh_family:" + family)
+
+	return nil
+}
+
+func (db *memoryDB) RevokeUserRefreshFamilies(ctx context.Context, userID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	userKey := "user_refresh_families:" + userID
+	for _, family := range db.smembers(userKey) {
+		db.del("refresh_family:" + family)
+	}
+	db.del(userKey)
+
+	return nil
+}
+
+func (db *memoryDB) SavePasswordReset(ctx context.Context, hash string, userID string, ttl time.Duration) error {
+	return db.setString("password_reset:"+hash, userID, ttl)
+}
+
+func (db *memoryDB) ConsumePasswordReset(ctx context.Context, hash string) (string, error) {
+	return db.getDel("password_reset:" + hash)
+}
+
+func (db *memoryDB) SaveEmailVerification(ctx context.Context, hash string, verification model.EmailVerification, ttl time.Duration) error {
+	data, err := json.Marshal(verification)
+	if err != nil {
+		return err
+	}
+
+	return db.setString("email_verify:"+hash, string(data), ttl)
+}
+
+func (db *memoryDB) ConsumeEmailVerification(ctx context.Context, hash string) (model.EmailVerification, error) {
+	data, err := db.getDel("email_verify:" + hash)
+	if err != nil {
+		return model.EmailVerification{}, err
+	}
+
+	var verification model.EmailVerification
+	err = json.Unmarshal([]byte(data), &verification)
+	if err != nil {
+		return model.EmailVerification{}, err
+	}
+
+	return verification, nil
+}
+
+func (db *memoryDB) SaveTOTPEnrollment(ctx context.Context, userID string, secret string, ttl time.Duration) error {
+	return db.setString("totp_enrollment:"+userID, secret, ttl)
+}
+
+func (db *memoryDB) GetTOTPEnrollment(ctx context.Context, userID string) (string, error) {
+	return db.getString("totp_enrollment:" + userID)
+}
+
+func (db *memoryDB) DeleteTOTPEnrollment(ctx context.Context, userID string) error {
+	return db.delKeys("totp_enrollment:" + userID)
+}
+
+func (db *memoryDB) UseTOTPStep(ctx context.Context, userID string, step int64) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	key := "totp_used:" + userID + ":" + strconv.FormatInt(step, 10)
+	return db.setNX(key, "1", 5*time.Minute), nil
+}
+
+func (db *memoryDB) SaveSignInChallenge(ctx context.Context, hash string, userID string, ttl time.Duration) error {
+	return db.setString("signin_challenge:"+hash, userID, ttl)
+}
+
+func (db *memoryDB) GetSignInChallenge(ctx context.Context, hash string) (string, error) {
+	return db.getString("signin_challenge:" + hash)
+}
+
+func (db *memoryDB) DeleteSignInChallenge(ctx context.Context, hash string) error {
+	return db.delKeys("signin_challenge:" + hash)
+}
+
+func (db *memoryDB) LoginLockTTL(ctx context.Context, key string) (time.Duration, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	entry, ok := db.entry("login_lock:" + key)
+	if !ok || entry.expiresAt.IsZero() {
+		return 0, nil
+	}
+
+	return entry.expiresAt.Sub(db.now()), nil
+}
+
+func (db *memoryDB) RegisterLoginFailure(ctx context.Context, key string, window time.Duration) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	failuresKey := "login_failures:" + key
+	entry, _ := db.entry(failuresKey)
+	failures, err := strconv.ParseInt(entry.value, 10, 64)
+	if entry.value != "" && err != nil {
+		return 0, err
+	}
+
+	failures++
+	entry.value = strconv.FormatInt(failures, 10)
+	if entry.expiresAt.IsZero() && window > 0 {
+		entry.expiresAt = db.now().Add(window)
+	}
+	db.keys[failuresKey] = entry
+
+	return failures, nil
+}
+
+func (db *memoryDB) LockLogin(ctx context.Context, key string, ttl time.Duration) error {
+	return db.setString("login_lock:"+key, "1", ttl)
+}
+
+func (db *memoryDB) ResetLoginFailures(ctx context.Context, key string) error {
+	return db.delKeys("login_failures:"+key, "login_lock:"+key)
+}
+
+func (db *memoryDB) SaveUnlockToken(ctx context.Context, hash string, username string, ttl time.Duration) error {
+	return db.setString("login_unlock:"+hash, username, ttl)
+}
+
+func (db *memoryDB) ConsumeUnlockToken(ctx context.Context, hash string) (string, error) {
+	return db.getDel("login_unlock:" + hash)
+}
+
+func (db *memoryDB) GetCachedUser(ctx context.Context, id string) (UserStorage, error) {
+	data, err := db.getString("user_cache:" + id)
+	if err != nil {
+		return UserStorage{}, err
+	}
+
+	var user UserStorage
+	err = json.Unmarshal([]byte(data), &user)
+	if err != nil {
+		return UserStorage{}, err
+	}
+
+	return user, nil
+}
+
+func (db *memoryDB) CacheUser(ctx context.Context, user UserStorage, ttl time.Duration) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	_, held := db.get("user_cache_hold:" + user.ID)
+	if !held {
+		db.set("user_cache:"+user.ID, string(data), ttl)
+	}
+
+	return nil
+}
+
+func (db *memoryDB) InvalidateCachedUser(ctx context.Context, id string, hold time.Duration) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.set("user_cache_hold:"+id, "1", hold)
+	db.del("user_cache:" + id)
+
+	return nil
+}
+
+func (db *memoryDB) GetCachedUserID(ctx context.Context, lookup string) (string, error) {
+	return db.getString("user_cache_lookup:" + lookup)
+}
+
+func (db *memoryDB) CacheUserID(ctx context.Context, lookup string, id string, ttl time.Duration) error {
+	return db.setString("user_cache_lookup:"+lookup, id, ttl)
+}
+
+func (db *memoryDB) setString(key string, value string, ttl time.Duration) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.set(key, value, ttl)
+
+	return nil
+}
+
+func (db *memoryDB) getString(key string) (string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	value, ok := db.get(key)
+	if !ok {
+		return "", redis.Nil
+	}
+
+	return value, nil
+}
+
+func (db *memoryDB) getDel(key string) (string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	value, ok := db.get(key)
+	if !ok {
+		return "", redis.Nil
+	}
+	db.del(key)
+
+	return value, nil
+}
+
+func (db *memoryDB) delKeys(keys ...string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.del(keys...)
+
+	return nil
+}
+
+// The helpers below work like the Redis commands they are named after. They
+// must be called with db.mu held.
+
+// entry returns the live entry stored under key, dropping it when it expired.
+func (db *memoryDB) entry(key string) (memoryEntry, bool) {
+	now := db.now()
+	if now.Sub(db.lastSweep) > memorySweepInterval {
+		db.sweep(now)
+	}
+
+	entry, ok := db.keys[key]
+	if !ok {
+		return memoryEntry{}, false
+	}
+	if !entry.expiresAt.IsZero() && !entry.expiresAt.After(now) {
+		delete(db.keys, key)
+		return memoryEntry{}, false
+	}
+
+	return entry, true
+}
+
+func (db *memoryDB) get(key string) (string, bool) {
+	entry, ok := db.entry(key)
+	if !ok || entry.members != nil {
+		return "", false
+	}
+
+	return entry.value, true
+}
+
+// set stores value under key. Like go-redis, a ttl of zero or less keeps the
+// key forever.
+func (db *memoryDB) set(key string, value string, ttl time.Duration) {
+	entry := memoryEntry{value: value}
+	if ttl > 0 {
+		entry.expiresAt = db.now().Add(ttl)
+	}
+
+	db.keys[key] = entry
+}
+
+func (db *memoryDB) setNX(key string, value string, ttl time.Duration) bool {
+	_, ok := db.entry(key)
+	if ok {
+		return false
+	}
+
+	db.set(key, value, ttl)
+	return true
+}
+
+func (db *memoryDB) del(keys ...string) {
+	for _, key := range keys {
+		delete(db.keys, key)
+	}
+}
+
+// expire sets the ttl of an existing key. A ttl of zero or less deletes it,
+// as EXPIRE does.
+func (db *memoryDB) expire(key string, ttl time.Duration) {
+	entry, ok := db.entry(key)
+	if !ok {
+		return
+	}
+	if ttl <= 0 {
+		delete(db.keys, key)
+		return
+	}
+
+	entry.expiresAt = db.now().Add(ttl)
+	db.keys[key] = entry
+}
+
+// extend makes key live for at least ttl from now, like EXPIRE NX followed by
+// EXPIRE GT.
+func (db *memoryDB) extend(key string, ttl time.Duration) {
+	entry, ok := db.entry(key)
+	if !ok {
+		return
+	}
+
+	expiresAt := db.now().Add(ttl)
+	if entry.expiresAt.IsZero() || expiresAt.After(entry.expiresAt) {
+		entry.expiresAt = expiresAt
+		db.keys[key] = entry
+	}
+}
+
+func (db *memoryDB) sadd(key string, member string) {
+	entry, ok := db.entry(key)
+	if !ok || entry.members == nil {
+		entry = memoryEntry{members: make(map[string]struct{})}
+	}
+
+	entry.members[member] = struct{}{}
+	db.keys[key] = entry
+}
+
+func (db *memoryDB) srem(key string, member string) {
+	entry, ok := db.entry(key)
+	if !ok || entry.members == nil {
+		return
+	}
+
+	delete(entry.members, member)
+	if len(entry.members) == 0 {
+		delete(db.keys, key)
+	}
+}
+
+func (db *memoryDB) smembers(key string) []string {
+	entry, ok := db.entry(key)
+	if !ok {
+		return nil
+	}
+
+	members := make([]string, 0, len(entry.members))
+	for member := range entry.members {
+		members = append(members, member)
+	}
+
+	return members
+}
+
+// sweep drops every expired key, so keys that are never read again do not
+// keep memory forever.
+func (db *memoryDB) sweep(now time.Time) {
+	for key, entry := range db.keys {
+		if !entry.expiresAt.IsZero() && !entry.expiresAt.After(now) {
+			delete(db.keys, key)
+		}
+	}
+
+	db.lastSweep = now
+}
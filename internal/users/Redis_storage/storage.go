@@ -2,14 +2,63 @@ package Redis_storage
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"github.com/redis/go-redis/v9"
+	"github.com/sillamilla/user_microservice/internal/users/model"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type Storage interface {
-	UpsertSession(ctx context.Context, id string, session string) error
-	Logout(ctx context.Context, id string) error
-	GetSession(ctx context.Context, id string) (string, error)
+	UpsertSession(ctx context.Context, session model.Session, ttl time.Duration) error
+	GetSession(ctx context.Context, token string) (model.Session, error)
+	ListSessions(ctx context.Context, userID string) ([]model.Session, error)
+	DeleteSession(ctx context.Context, userID string, token string) error
+	// SessionUserIDs lists the ids of users that may have live sessions.
+	SessionUserIDs(ctx context.Context) ([]string, error)
+
+	SaveRefreshToken(ctx context.Context, token model.RefreshToken) error
+	GetRefreshToken(ctx context.Context, hash string) (model.RefreshToken, error)
+	UseRefreshToken(ctx context.Context, token model.RefreshToken) (bool, error)
+	RefreshFamilyActive(ctx context.Context, family string) (bool, error)
+	RevokeRefreshFamily(ctx context.Context, family string) error
+	RevokeUserRefreshFamilies(ctx context.Context, userID string) error
+
+	SavePasswordReset(ctx context.Context, hash string, userID string, ttl time.Duration) error
+	ConsumePasswordReset(ctx context.Context, hash string) (string, error)
+
+	SaveEmailVerification(ctx context.Context, hash string, verification model.EmailVerification, ttl time.Duration) error
+	ConsumeEmailVerification(ctx context.Context, hash string) (model.EmailVerification, error)
+
+	SaveTOTPEnrollment(ctx context.Context, userID string, secret string, ttl time.Duration) error
+	GetTOTPEnrollment(ctx context.Context, userID string) (string, error)
+	DeleteTOTPEnrollment(ctx context.Context, userID string) error
+	UseTOTPStep(ctx context.Context, userID string, step int64) (bool, error)
+
+	LoginLockTTL(ctx context.Context, key string) (time.Duration, error)
+	RegisterLoginFailure(ctx context.Context, key string, window time.Duration) (int64, error)
+	LockLogin(ctx context.Context, key string, ttl time.Duration) error
+	ResetLoginFailures(ctx context.Context, key string) error
+	SaveUnlockToken(ctx context.Context, hash string, username string, ttl time.Duration) error
+	ConsumeUnlockToken(ctx context.Context, hash string) (string, error)
+
+	SaveSignInChallenge(ctx context.Context, hash string, userID string, ttl time.Duration) error
+	GetSignInChallenge(ctx context.Context, hash string) (string, error)
+	DeleteSignInChallenge(ctx context.Context, hash string) error
+
+	// GetCachedUser returns the cached user with id, redis.Nil when none is.
+	GetCachedUser(ctx context.Context, id string) (UserStorage, error)
+	// CacheUser caches user for ttl unless it was invalidated less than the
+	// hold passed to InvalidateCachedUser ago, so a read that started before
+	// an update cannot cache what the update replaced.
+	CacheUser(ctx context.Context, user UserStorage, ttl time.Duration) error
+	InvalidateCachedUser(ctx context.Context, id string, hold time.Duration) error
+	// GetCachedUserID returns the user id cached for lookup, a username key,
+	// redis.Nil when none is.
+	GetCachedUserID(ctx context.Context, lookup string) (string, error)
+	CacheUserID(ctx context.Context, lookup string, id string, ttl time.Duration) error
 }
 
 type redisDB struct {
@@ -22,9 +71,182 @@ func New(re *redis.Client) Storage {
 	}
 }
 
-func (db *redisDB) UpsertSession(ctx context.Context, id string, session string) error {
-	key := "sessions:" + id
-	err := db.re.Set(ctx, key, session, 5*time.Hour).Err()
+// Sessions are stored under session_digest:<token digest> and indexed per
+// user in the user_session_digests:<user id> set so all devices of a user can
+// be listed. Sessions from before tokens were hashed used other keys and are
+// left to expire.
+//
+// The session expires after ttl, which must be positive. The index is only
+// ever extended, so it lives as long as the longest lived session in it. That
+// takes EXPIRE NX and GT, so the server must run Redis 7.0 or newer.
+func (db *redisDB) UpsertSession(ctx context.Context, session model.Session, ttl time.Duration) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	userKey := "user_session_digests:" + session.UserID
+	_, err = db.re.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, "session_digest:"+session.Token, data, ttl)
+		pipe.SAdd(ctx, userKey, session.Token)
+		pipe.ExpireNX(ctx, userKey, ttl)
+		pipe.ExpireGT(ctx, userKey, ttl)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *redisDB) GetSession(ctx context.Context, token string) (model.Session, error) {
+	data, err := db.re.Get(ctx, "session_digest:"+token).Bytes()
+	if err != nil {
+		return model.Session{}, err
+	}
+
+	var session model.Session
+	err = json.Unmarshal(data, &session)
+	if err != nil {
+		return model.Session{}, err
+	}
+
+	return session, nil
+}
+
+func (db *redisDB) ListSessions(ctx context.Context, userID string) ([]model.Session, error) {
+	userKey := "user_session_digests:" + userID
+	tokens, err := db.re.SMembers(ctx, userKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]model.Session, 0, len(tokens))
+	for _, token := range tokens {
+		session, err := db.GetSession(ctx, token)
+		if errors.Is(err, redis.Nil) {
+			err = db.re.SRem(ctx, userKey, token).Err()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+func (db *redisDB) DeleteSession(ctx context.Context, userID string, token string) error {
+	_, err := db.re.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, "session_digest:"+token)
+		pipe.SRem(ctx, "user_session_digests:"+userID, token)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *redisDB) SessionUserIDs(ctx context.Context) ([]string, error) {
+	ids := []string{}
+	iter := db.re.Scan(ctx, 0, "user_session_digests:*", 100).Iterator()
+	for iter.Next(ctx) {
+		ids = append(ids, strings.TrimPrefix(iter.Val(), "user_session_digests:"))
+	}
+	err := iter.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+func (db *redisDB) SaveRefreshToken(ctx context.Context, token model.RefreshToken) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	ttl := time.Until(token.ExpiresAt)
+	_, err = db.re.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, "refresh:"+token.Hash, data, ttl)
+		pipe.Set(ctx, "refresh_family:"+token.Family, token.UserID, ttl)
+		pipe.SAdd(ctx, "user_refresh_families:"+token.UserID, token.Family)
+		pipe.Expire(ctx, "user_refresh_families:"+token.UserID, ttl)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *redisDB) GetRefreshToken(ctx context.Context, hash string) (model.RefreshToken, error) {
+	data, err := db.re.Get(ctx, "refresh:"+hash).Bytes()
+	if err != nil {
+		return model.RefreshToken{}, err
+	}
+
+	var token model.RefreshToken
+	err = json.Unmarshal(data, &token)
+	if err != nil {
+		return model.RefreshToken{}, err
+	}
+
+	return token, nil
+}
+
+// UseRefreshToken marks the token as consumed. It reports false when the token
+// had already been used, which means it was replayed.
+func (db *redisDB) UseRefreshToken(ctx context.Context, token model.RefreshToken) (bool, error) {
+	first, err := db.re.SetNX(ctx, "refresh_used:"+token.Hash, 1, time.Until(token.ExpiresAt)).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return first, nil
+}
+
+func (db *redisDB) RefreshFamilyActive(ctx context.Context, family string) (bool, error) {
+	n, err := db.re.Exists(ctx, "refresh_family:"+family).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+func (db *redisDB) RevokeRefreshFamily(ctx context.Context, family string) error {
+	err := db.re.Del(ctx, "refresh_family:"+family).Err()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *redisDB) RevokeUserRefreshFamilies(ctx context.Context, userID string) error {
+	userKey := "user_refresh_families:" + userID
+	families, err := db.re.SMembers(ctx, userKey).Result()
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(families)+1)
+	for _, family := range families {
+		keys = append(keys, "refresh_family:"+family)
+	}
+	keys = append(keys, userKey)
+
+	err = db.re.Del(ctx, keys...).Err()
 	if err != nil {
 		return err
 	}
@@ -32,9 +254,8 @@ func (db *redisDB) UpsertSession(ctx context.Context, id string, session string)
 	return nil
 }
 
-func (db *redisDB) Logout(ctx context.Context, id string) error {
-	key := "sessions:" + id
-	err := db.re.Del(ctx, key).Err()
+func (db *redisDB) SavePasswordReset(ctx context.Context, hash string, userID string, ttl time.Duration) error {
+	err := db.re.Set(ctx, "password_reset:"+hash, userID, ttl).Err()
 	if err != nil {
 		return err
 	}
@@ -42,13 +263,253 @@ func (db *redisDB) Logout(ctx context.Context, id string) error {
 	return nil
 }
 
-func (db *redisDB) GetSession(ctx context.Context, id string) (string, error) {
-	key := "sessions:" + id
-	session, err := db.re.Get(ctx, key).Result()
+// ConsumePasswordReset returns the user the reset token was issued for and
+// deletes it in the same step, so a token can only be used once.
+func (db *redisDB) ConsumePasswordReset(ctx context.Context, hash string) (string, error) {
+	userID, err := db.re.GetDel(ctx, "password_reset:"+hash).Result()
 	if err != nil {
 		return "", err
 	}
 
-	return session, nil
+	return userID, nil
+}
+
+func (db *redisDB) SaveEmailVerification(ctx context.Context, hash string, verification model.EmailVerification, ttl time.Duration) error {
+	data, err := json.Marshal(verification)
+	if err != nil {
+		return err
+	}
+
+	err = db.re.Set(ctx, "email_verify:"+hash, data, ttl).Err()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *redisDB) ConsumeEmailVerification(ctx context.Context, hash string) (model.EmailVerification, error) {
+	data, err := db.re.GetDel(ctx, "email_verify:"+hash).Bytes()
+	if err != nil {
+		return model.EmailVerification{}, err
+	}
+
+	var verification model.EmailVerification
+	err = json.Unmarshal(data, &verification)
+	if err != nil {
+		return model.EmailVerification{}, err
+	}
+
+	return verification, nil
+}
+
+// SaveTOTPEnrollment keeps a secret that was handed out but not yet confirmed
+// with a code.
+func (db *redisDB) SaveTOTPEnrollment(ctx context.Context, userID string, secret string, ttl time.Duration) error {
+	err := db.re.Set(ctx, "totp_enrollment:"+userID, secret, ttl).Err()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *redisDB) GetTOTPEnrollment(ctx context.Context, userID string) (string, error) {
+	secret, err := db.re.Get(ctx, "totp_enrollment:"+userID).Result()
+	if err != nil {
+		return "", err
+	}
+
+	return secret, nil
+}
+
+func (db *redisDB) DeleteTOTPEnrollment(ctx context.Context, userID string) error {
+	err := db.re.Del(ctx, "totp_enrollment:"+userID).Err()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UseTOTPStep records that the code of a time step was accepted. It reports
+// false when the step was already used.
+func (db *redisDB) UseTOTPStep(ctx context.Context, userID string, step int64) (bool, error) {
+	key := "totp_used:" + userID + ":" + strconv.FormatInt(step, 10)
+	first, err := db.re.SetNX(ctx, key, 1, 5*time.Minute).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return first, nil
+}
+
+func (db *redisDB) SaveSignInChallenge(ctx context.Context, hash string, userID string, ttl time.Duration) error {
+	err := db.re.Set(ctx, "signin_challenge:"+hash, userID, ttl).Err()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *redisDB) GetSignInChallenge(ctx context.Context, hash string) (string, error) {
+	userID, err := db.re.Get(ctx, "signin_challenge:"+hash).Result()
+	if err != nil {
+		return "", err
+	}
+
+	return userID, nil
+}
+
+func (db *redisDB) DeleteSignInChallenge(ctx context.Context, hash string) error {
+	err := db.re.Del(ctx, "signin_challenge:"+hash).Err()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// LoginLockTTL returns how long sign-in stays blocked for key, zero when it
+// is not blocked.
+func (db *redisDB) LoginLockTTL(ctx context.Context, key string) (time.Duration, error) {
+	ttl, err := db.re.PTTL(ctx, "login_lock:"+key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if ttl < 0 {
+		return 0, nil
+	}
+
+	return ttl, nil
+}
+
+// RegisterLoginFailure counts a failed sign-in for key. The counter expires
+// window after the first failure. Both run in one transaction, a counter left
+// without expiry would lock the key out for good. EXPIRE NX needs Redis 7.
+func (db *redisDB) RegisterLoginFailure(ctx context.Context, key string, window time.Duration) (int64, error) {
+	failuresKey := "login_failures:" + key
+	var failures *redis.IntCmd
+	_, err := db.re.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		failures = pipe.Incr(ctx, failuresKey)
+		pipe.ExpireNX(ctx, failuresKey, window)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return failures.Val(), nil
+}
+
+func (db *redisDB) LockLogin(ctx context.Context, key string, ttl time.Duration) error {
+	err := db.re.Set(ctx, "login_lock:"+key, 1, ttl).Err()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
 
+func (db *redisDB) ResetLoginFailures(ctx context.Context, key string) error {
+	err := db.re.Del(ctx, "login_failures:"+key, "login_lock:"+key).Err()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *redisDB) SaveUnlockToken(ctx context.Context, hash string, username string, ttl time.Duration) error {
+	err := db.re.Set(ctx, "login_unlock:"+hash, username, ttl).Err()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *redisDB) ConsumeUnlockToken(ctx context.Context, hash string) (string, error) {
+	username, err := db.re.GetDel(ctx, "login_unlock:"+hash).Result()
+	if err != nil {
+		return "", err
+	}
+
+	return username, nil
+}
+
+// Cached users are stored under user_cache:<id>. user_cache_hold:<id> exists
+// for a short while after each invalidation and blocks caching the user, and
+// user_cache_lookup:<lookup> maps usernames to user ids. Lookup keys are not
+// invalidated, readers check the user they point to.
+func (db *redisDB) GetCachedUser(ctx context.Context, id string) (UserStorage, error) {
+	data, err := db.re.Get(ctx, "user_cache:"+id).Bytes()
+	if err != nil {
+		return UserStorage{}, err
+	}
+
+	var user UserStorage
+	err = json.Unmarshal(data, &user)
+	if err != nil {
+		return UserStorage{}, err
+	}
+
+	return user, nil
+}
+
+// cacheUserScript sets KEYS[1] to ARGV[1] for ARGV[2] milliseconds unless
+// KEYS[2] exists.
+var cacheUserScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[2]) == 1 then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+return 1
+`)
+
+func (db *redisDB) CacheUser(ctx context.Context, user UserStorage, ttl time.Duration) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	keys := []string{"user_cache:" + user.ID, "user_cache_hold:" + user.ID}
+	err = cacheUserScript.Run(ctx, db.re, keys, data, ttl.Milliseconds()).Err()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *redisDB) InvalidateCachedUser(ctx context.Context, id string, hold time.Duration) error {
+	_, err := db.re.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, "user_cache_hold:"+id, 1, hold)
+		pipe.Del(ctx, "user_cache:"+id)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *redisDB) GetCachedUserID(ctx context.Context, lookup string) (string, error) {
+	id, err := db.re.Get(ctx, "user_cache_lookup:"+lookup).Result()
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+func (db *redisDB) CacheUserID(ctx context.Context, lookup string, id string, ttl time.Duration) error {
+	err := db.re.Set(ctx, "user_cache_lookup:"+lookup, id, ttl).Err()
+	if err != nil {
+		return err
+	}
+
+	return nil
 }
@@ -1 +1,41 @@
 package Redis_storage
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/sillamilla/user_microservice/internal/users/model"
+	"testing"
+	"time"
+)
+
+func TestMemorySessionExpires(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	db := &memoryDB{keys: make(map[string]memoryEntry), now: func() time.Time { return now }}
+
+	ttl := time.Hour
+	err := db.UpsertSession(ctx, model.Session{ID: "s1", Token: "token", UserID: "u1"}, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.GetSession(ctx, "token")
+	if err != nil {
+		t.Fatalf("GetSession: %v", err)
+	}
+
+	now = now.Add(ttl)
+	_, err = db.GetSession(ctx, "token")
+	if !errors.Is(err, redis.Nil) {
+		t.Fatalf("GetSession after expiry error = %v, want redis.Nil", err)
+	}
+
+	sessions, err := db.ListSessions(ctx, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 0 {
+		t.Fatalf("ListSessions returned %d expired sessions", len(sessions))
+	}
+}
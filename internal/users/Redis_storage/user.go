@@ -2,27 +2,31 @@ package Redis_storage
 
 import (
 	"github.com/sillamilla/user_microservice/internal/users/model"
-	"time"
 )
 
+// UserStorage is the cached form of a user. It holds only the public view,
+// password hashes, second factor secrets and sessions are never cached.
 type UserStorage struct {
-	ID        string    `json:"id"`
-	Username  string    `json:"username"`
-	Email     string    `json:"email"`
-	Password  string    `json:"password"`
-	Bio       string    `json:"bio"`
-	Icon      string    `json:"icon"`
-	CreatedAt time.Time `json:"create_at"`
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Bio      string `json:"bio"`
+	Icon     string `json:"icon"`
 }
 
-func UserFromInput(ID string, user model.Input, createdAt time.Time) UserStorage {
+func UserFromInfo(user model.UserInfo) UserStorage {
 	return UserStorage{
-		ID:        ID,
-		Username:  user.Username,
-		Password:  user.Password,
-		CreatedAt: createdAt,
-		Email:     "",
-		Bio:       "",
-		Icon:      "",
+		ID:       user.ID,
+		Username: user.Username,
+		Bio:      user.Bio,
+		Icon:     user.Icon,
+	}
+}
+
+func (u UserStorage) Info() model.UserInfo {
+	return model.UserInfo{
+		ID:       u.ID,
+		Username: u.Username,
+		Bio:      u.Bio,
+		Icon:     u.Icon,
 	}
 }
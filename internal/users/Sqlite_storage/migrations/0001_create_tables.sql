@@ -0,0 +1,59 @@
+CREATE TABLE users (
+    id                TEXT PRIMARY KEY,
+    username          TEXT     NOT NULL,
+    email             TEXT     NOT NULL DEFAULT '',
+    email_verified_at DATETIME,
+    password          TEXT     NOT NULL,
+    bio               TEXT     NOT NULL DEFAULT '',
+    icon              TEXT     NOT NULL DEFAULT '',
+    roles             TEXT     NOT NULL DEFAULT '[]',
+    totp_enabled      BOOLEAN  NOT NULL DEFAULT FALSE,
+    totp_secret       TEXT     NOT NULL DEFAULT '',
+    recovery_codes    TEXT     NOT NULL DEFAULT '[]',
+    version           INTEGER  NOT NULL DEFAULT 1,
+    created_at        DATETIME NOT NULL
+);
+
+CREATE UNIQUE INDEX username_unique ON users (username);
+
+-- Emails are unique regardless of case, users without an email are exempt.
+CREATE UNIQUE INDEX email_ci_unique ON users (lower(email)) WHERE email <> '';
+
+CREATE TABLE user_sessions (
+    user_id      TEXT     NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    token        TEXT     NOT NULL,
+    id           TEXT     NOT NULL,
+    user_agent   TEXT     NOT NULL DEFAULT '',
+    ip           TEXT     NOT NULL DEFAULT '',
+    created_at   DATETIME NOT NULL,
+    last_seen_at DATETIME NOT NULL,
+    PRIMARY KEY (user_id, token)
+);
+
+CREATE INDEX user_sessions_token ON user_sessions (token);
+
+-- The tables below replace Redis. expires_at is in unix milliseconds, NULL
+-- means the row never expires.
+CREATE TABLE sessions (
+    token      TEXT PRIMARY KEY,
+    user_id    TEXT    NOT NULL,
+    data       TEXT    NOT NULL,
+    expires_at INTEGER
+);
+
+CREATE INDEX sessions_user_id ON sessions (user_id);
+
+CREATE TABLE refresh_families (
+    family     TEXT PRIMARY KEY,
+    user_id    TEXT    NOT NULL,
+    expires_at INTEGER
+);
+
+CREATE INDEX refresh_families_user_id ON refresh_families (user_id);
+
+-- kv holds everything else under the same key names the Redis storage uses.
+CREATE TABLE kv (
+    key        TEXT PRIMARY KEY,
+    value      TEXT    NOT NULL,
+    expires_at INTEGER
+);
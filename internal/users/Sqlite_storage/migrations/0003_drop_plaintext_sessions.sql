@@ -0,0 +1,5 @@
+-- Sessions used to store the token itself, only SHA-256 digests are stored
+-- now. The old sessions can never be resolved again.
+DELETE FROM user_sessions WHERE length(token) <> 64 OR token GLOB '*[^0-9a-f]*';
+
+DELETE FROM sessions WHERE length(token) <> 64 OR token GLOB '*[^0-9a-f]*';
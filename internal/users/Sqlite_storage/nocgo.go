@@ -0,0 +1,8 @@
+//go:build !cgo
+
+package Sqlite_storage
+
+// The SQLite driver, github.com/mattn/go-sqlite3, is C compiled with cgo.
+// Build with CGO_ENABLED=1 and a C compiler, this stops the build with a
+// readable error otherwise.
+var _ = Sqlite_storage_requires_cgo_build_with_CGO_ENABLED_1
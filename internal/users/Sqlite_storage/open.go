@@ -0,0 +1,24 @@
+package Sqlite_storage
+
+import (
+	"database/sql"
+	"net/url"
+)
+
+// Open opens the SQLite database at path, creating it when missing. Writes
+// are serialised through a single connection because SQLite only allows one
+// writer at a time.
+func Open(path string) (*sql.DB, error) {
+	params := url.Values{}
+	params.Set("_foreign_keys", "on")
+	params.Set("_busy_timeout", "5000")
+	params.Set("_journal_mode", "WAL")
+
+	db, err := sql.Open("sqlite3", "file:"+path+"?"+params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	return db, nil
+}
@@ -0,0 +1,451 @@
+package Sqlite_storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/sillamilla/user_microservice/internal/users/Redis_storage"
+	"github.com/sillamilla/user_microservice/internal/users/model"
+	"strconv"
+	"time"
+)
+
+type sessionsDB struct {
+	db  *sql.DB
+	now func() time.Time
+}
+
+// NewSessions returns a Redis_storage.Storage backed by SQLite. Missing and
+// expired keys return redis.Nil like Redis does. Expired rows are skipped on
+// read and deleted by Sweep. Run Migrate first.
+func NewSessions(db *sql.DB) Redis_storage.Storage {
+	return &sessionsDB{
+		db:  db,
+		now: time.Now,
+	}
+}
+
+// live is the condition for rows that have not expired at ?.
+const live = `(expires_at IS NULL OR expires_at > ?)`
+
+func (db *sessionsDB) UpsertSession(ctx context.Context, session model.Session, ttl time.Duration) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.db.ExecContext(ctx, `INSERT INTO sessions (token, user_id, data, expires_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (token) DO UPDATE SET user_id = excluded.user_id, data = excluded.data, expires_at = excluded.expires_at`,
+		session.Token, session.UserID, string(data), db.expiresAt(ttl))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *sessionsDB) GetSession(ctx context.Context, token string) (model.Session, error) {
+	var data string
+	err := db.db.QueryRowContext(ctx, `SELECT data FROM sessions WHERE token = ? AND `+live, token, db.millis()).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.Session{}, redis.Nil
+	} else if err != nil {
+		return model.Session{}, err
+	}
+
+	var session model.Session
+	err = json.Unmarshal([]byte(data), &session)
+	if err != nil {
+		return model.Session{}, err
+	}
+
+	return session, nil
+}
+
+func (db *sessionsDB) ListSessions(ctx context.Context, userID string) ([]model.Session, error) {
+	rows, err := db.db.QueryContext(ctx, `SELECT data FROM sessions WHERE user_id = ? AND `+live, userID, db.millis())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []model.Session{}
+	for rows.Next() {
+		var data string
+		err = rows.Scan(&data)
+		if err != nil {
+			return nil, err
+		}
+
+		var session model.Session
+		err = json.Unmarshal([]byte(data), &session)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+func (db *sessionsDB) DeleteSession(ctx context.Context, userID string, token string) error {
+	_, err := db.db.ExecContext(ctx, `DELETE FROM sessions WHERE token = ? AND user_id = ?`, token, userID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *sessionsDB) SessionUserIDs(ctx context.Context) ([]string, error) {
+	rows, err := db.db.QueryContext(ctx, `SELECT DISTINCT user_id FROM sessions WHERE `+live, db.millis())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+func (db *sessionsDB) SaveRefreshToken(ctx context.Context, token model.RefreshToken) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	ttl := token.ExpiresAt.Sub(db.now())
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = db.set(ctx, tx, "refresh:"+token.Hash, string(data), ttl)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO refresh_families (family, user_id, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (family) DO UPDATE SET user_id = excluded.user_id, expires_at = excluded.expires_at`,
+		token.Family, token.UserID, db.expiresAt(ttl))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *sessionsDB) GetRefreshToken(ctx context.Context, hash string) (model.RefreshToken, error) {
+	data, err := db.get(ctx, "refresh:"+hash)
+	if err != nil {
+		return model.RefreshToken{}, err
+	}
+
+	var token model.RefreshToken
+	err = json.Unmarshal([]byte(data), &token)
+	if err != nil {
+		return model.RefreshToken{}, err
+	}
+
+	return token, nil
+}
+
+func (db *sessionsDB) UseRefreshToken(ctx context.Context, token model.RefreshToken) (bool, error) {
+	return db.setNX(ctx, "refresh_used:"+token.Hash, token.ExpiresAt.Sub(db.now()))
+}
+
+func (db *sessionsDB) RefreshFamilyActive(ctx context.Context, family string) (bool, error) {
+	var active bool
+	err := db.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM refresh_families WHERE family = ? AND `+live+`)`, family, db.millis()).Scan(&active)
+	if err != nil {
+		return false, err
+	}
+
+	return active, nil
+}
+
+func (db *sessionsDB) RevokeRefreshFamily(ctx context.Context, family string) error {
+	_, err := db.db.ExecContext(ctx, `DELETE FROM refresh_families WHERE family = ?`, family)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *sessionsDB) RevokeUserRefreshFamilies(ctx context.Context, userID string) error {
+	_, err := db.db.ExecContext(ctx, `DELETE FROM refresh_families WHERE user_id = ?`, userID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *sessionsDB) SavePasswordReset(ctx context.Context, hash string, userID string, ttl time.Duration) error {
+	return db.set(ctx, db.db, "password_reset:"+hash, userID, ttl)
+}
+
+func (db *sessionsDB) ConsumePasswordReset(ctx context.Context, hash string) (string, error) {
+	return db.getDel(ctx, "password_reset:"+hash)
+}
+
+func (db *sessionsDB) SaveEmailVerification(ctx context.Context, hash string, verification model.EmailVerification, ttl time.Duration) error {
+	data, err := json.Marshal(verification)
+	if err != nil {
+		return err
+	}
+
+	return db.set(ctx, db.db, "email_verify:"+hash, string(data), ttl)
+}
+
+func (db *sessionsDB) ConsumeEmailVerification(ctx context.Context, hash string) (model.EmailVerification, error) {
+	data, err := db.getDel(ctx, "email_verify:"+hash)
+	if err != nil {
+		return model.EmailVerification{}, err
+	}
+
+	var verification model.EmailVerification
+	err = json.Unmarshal([]byte(data), &verification)
+	if err != nil {
+		return model.EmailVerification{}, err
+	}
+
+	return verification, nil
+}
+
+func (db *sessionsDB) SaveTOTPEnrollment(ctx context.Context, userID string, secret string, ttl time.Duration) error {
+	return db.set(ctx, db.db, "totp_enrollment:"+userID, secret, ttl)
+}
+
+func (db *sessionsDB) GetTOTPEnrollment(ctx context.Context, userID string) (string, error) {
+	return db.get(ctx, "totp_enrollment:"+userID)
+}
+
+func (db *sessionsDB) DeleteTOTPEnrollment(ctx context.Context, userID string) error {
+	return db.del(ctx, "totp_enrollment:"+userID)
+}
+
+func (db *sessionsDB) UseTOTPStep(ctx context.Context, userID string, step int64) (bool, error) {
+	return db.setNX(ctx, "totp_used:"+userID+":"+strconv.FormatInt(step, 10), 5*time.Minute)
+}
+
+func (db *sessionsDB) SaveSignInChallenge(ctx context.Context, hash string, userID string, ttl time.Duration) error {
+	return db.set(ctx, db.db, "signin_challenge:"+hash, userID, ttl)
+}
+
+func (db *sessionsDB) GetSignInChallenge(ctx context.Context, hash string) (string, error) {
+	return db.get(ctx, "signin_challenge:"+hash)
+}
+
+func (db *sessionsDB) DeleteSignInChallenge(ctx context.Context, hash string) error {
+	return db.del(ctx, "signin_challenge:"+hash)
+}
+
+func (db *sessionsDB) LoginLockTTL(ctx context.Context, key string) (time.Duration, error) {
+	var expiresAt sql.NullInt64
+	err := db.db.QueryRowContext(ctx, `SELECT expires_at FROM kv WHERE key = ? AND `+live, "login_lock:"+key, db.millis()).Scan(&expiresAt)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !expiresAt.Valid) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(expiresAt.Int64-db.millis()) * time.Millisecond, nil
+}
+
+func (db *sessionsDB) RegisterLoginFailure(ctx context.Context, key string, window time.Duration) (int64, error) {
+	failuresKey := "login_failures:" + key
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM kv WHERE key = ? AND NOT `+live, failuresKey, db.millis())
+	if err != nil {
+		return 0, err
+	}
+
+	var failures int64
+	err = tx.QueryRowContext(ctx, `INSERT INTO kv (key, value, expires_at) VALUES (?, '1', ?)
+		ON CONFLICT (key) DO UPDATE SET value = CAST(value AS INTEGER) + 1
+		RETURNING CAST(value AS INTEGER)`, failuresKey, db.expiresAt(window)).Scan(&failures)
+	if err != nil {
+		return 0, err
+	}
+
+	return failures, tx.Commit()
+}
+
+func (db *sessionsDB) LockLogin(ctx context.Context, key string, ttl time.Duration) error {
+	return db.set(ctx, db.db, "login_lock:"+key, "1", ttl)
+}
+
+func (db *sessionsDB) ResetLoginFailures(ctx context.Context, key string) error {
+	return db.del(ctx, "login_failures:"+key, "login_lock:"+key)
+}
+
+func (db *sessionsDB) SaveUnlockToken(ctx context.Context, hash string, username string, ttl time.Duration) error {
+	return db.set(ctx, db.db, "login_unlock:"+hash, username, ttl)
+}
+
+func (db *sessionsDB) ConsumeUnlockToken(ctx context.Context, hash string) (string, error) {
+	return db.getDel(ctx, "login_unlock:"+hash)
+}
+
+func (db *sessionsDB) GetCachedUser(ctx context.Context, id string) (Redis_storage.UserStorage, error) {
+	data, err := db.get(ctx, "user_cache:"+id)
+	if err != nil {
+		return Redis_storage.UserStorage{}, err
+	}
+
+	var user Redis_storage.UserStorage
+	err = json.Unmarshal([]byte(data), &user)
+	if err != nil {
+		return Redis_storage.UserStorage{}, err
+	}
+
+	return user, nil
+}
+
+func (db *sessionsDB) CacheUser(ctx context.Context, user Redis_storage.UserStorage, ttl time.Duration) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.db.ExecContext(ctx, `INSERT INTO kv (key, value, expires_at)
+		SELECT ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM kv WHERE key = ? AND `+live+`)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at`,
+		"user_cache:"+user.ID, string(data), db.expiresAt(ttl), "user_cache_hold:"+user.ID, db.millis())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *sessionsDB) InvalidateCachedUser(ctx context.Context, id string, hold time.Duration) error {
+	err := db.set(ctx, db.db, "user_cache_hold:"+id, "1", hold)
+	if err != nil {
+		return err
+	}
+
+	return db.del(ctx, "user_cache:"+id)
+}
+
+func (db *sessionsDB) GetCachedUserID(ctx context.Context, lookup string) (string, error) {
+	return db.get(ctx, "user_cache_lookup:"+lookup)
+}
+
+func (db *sessionsDB) CacheUserID(ctx context.Context, lookup string, id string, ttl time.Duration) error {
+	return db.set(ctx, db.db, "user_cache_lookup:"+lookup, id, ttl)
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// set stores value under key. Like go-redis, a ttl of zero or less keeps the
+// key forever.
+func (db *sessionsDB) set(ctx context.Context, ex execer, key string, value string, ttl time.Duration) error {
+	_, err := ex.ExecContext(ctx, `INSERT INTO kv (key, value, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at`,
+		key, value, db.expiresAt(ttl))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *sessionsDB) get(ctx context.Context, key string) (string, error) {
+	var value string
+	err := db.db.QueryRowContext(ctx, `SELECT value FROM kv WHERE key = ? AND `+live, key, db.millis()).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", redis.Nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return value, nil
+}
+
+// getDel deletes key and returns its value, in one statement so a key can
+// only be consumed once.
+func (db *sessionsDB) getDel(ctx context.Context, key string) (string, error) {
+	var value string
+	err := db.db.QueryRowContext(ctx, `DELETE FROM kv WHERE key = ? AND `+live+` RETURNING value`, key, db.millis()).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", redis.Nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return value, nil
+}
+
+// setNX stores key unless a live value exists and reports whether it did.
+func (db *sessionsDB) setNX(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	result, err := db.db.ExecContext(ctx, `INSERT INTO kv (key, value, expires_at) VALUES (?, '1', ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at
+		WHERE NOT `+live,
+		key, db.expiresAt(ttl), db.millis())
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+func (db *sessionsDB) del(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		_, err := db.db.ExecContext(ctx, `DELETE FROM kv WHERE key = ?`, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (db *sessionsDB) millis() int64 {
+	return db.now().UnixNano() / int64(time.Millisecond)
+}
+
+// expiresAt returns the expiry column value for ttl, nil for keys without
+// expiry.
+func (db *sessionsDB) expiresAt(ttl time.Duration) interface{} {
+	if ttl <= 0 {
+		return nil
+	}
+
+	return db.now().Add(ttl).UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,89 @@
+package Sqlite_storage_test
+
+import (
+	"context"
+	"database/sql"
+	"github.com/sillamilla/user_microservice/internal/users/Mongo_storage"
+	"github.com/sillamilla/user_microservice/internal/users/Redis_storage"
+	"github.com/sillamilla/user_microservice/internal/users/Sqlite_storage"
+	"github.com/sillamilla/user_microservice/internal/users/model"
+	"github.com/sillamilla/user_microservice/internal/users/storagetest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := Sqlite_storage.Open(filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	err = Sqlite_storage.Migrate(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func TestUsersConformance(t *testing.T) {
+	storagetest.RunUserStorage(t, func(t *testing.T) Mongo_storage.Storage {
+		return Sqlite_storage.NewUsers(openTestDB(t))
+	})
+}
+
+func TestSessionsConformance(t *testing.T) {
+	storagetest.RunSessionStorage(t, func(t *testing.T) Redis_storage.Storage {
+		return Sqlite_storage.NewSessions(openTestDB(t))
+	})
+}
+
+func TestMigrateTwice(t *testing.T) {
+	db := openTestDB(t)
+
+	err := Sqlite_storage.Migrate(context.Background(), db)
+	if err != nil {
+		t.Fatalf("second Migrate: %v", err)
+	}
+}
+
+func TestDeleteExpired(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	sessions := Sqlite_storage.NewSessions(db)
+
+	err := sessions.UpsertSession(ctx, model.Session{ID: "s1", Token: "t1", UserID: "1"}, 5*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sessions.SavePasswordReset(ctx, "reset", "1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sessions.LockLogin(ctx, "user:alice", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Sqlite_storage.DeleteExpired(ctx, db, time.Now().Add(6*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for table, want := range map[string]int{"sessions": 0, "kv": 1} {
+		var n int
+		err = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM `+table).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Fatalf("%s has %d rows after DeleteExpired, want %d", table, n, want)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package Sqlite_storage
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+// Sweep deletes expired sessions, refresh token families and keys every
+// interval until ctx is done. Reads already skip expired rows, sweeping only
+// keeps the database from growing.
+func Sweep(ctx context.Context, db *sql.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := DeleteExpired(ctx, db, time.Now())
+			if err != nil {
+				log.Printf("Sqlite_storage.Sweep: %v", err)
+			}
+		}
+	}
+}
+
+// DeleteExpired deletes every row that expired before now.
+func DeleteExpired(ctx context.Context, db *sql.DB, now time.Time) error {
+	millis := now.UnixNano() / int64(time.Millisecond)
+	for _, table := range []string{"sessions", "refresh_families", "kv"} {
+		_, err := db.ExecContext(ctx, `DELETE FROM `+table+` WHERE expires_at <= ?`, millis)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,401 @@
+package Sqlite_storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/mattn/go-sqlite3"
+	"github.com/sillamilla/user_microservice/internal/users/Mongo_storage"
+	"github.com/sillamilla/user_microservice/internal/users/model"
+	"go.mongodb.org/mongo-driver/mongo"
+	"strings"
+	"time"
+)
+
+type usersDB struct {
+	db *sql.DB
+}
+
+// NewUsers returns a Mongo_storage.Storage backed by SQLite. It returns the
+// same errors as the Mongo storage. Run Migrate first.
+func NewUsers(db *sql.DB) Mongo_storage.Storage {
+	return &usersDB{
+		db: db,
+	}
+}
+
+const userColumns = `id, username, email, email_verified_at, password, bio, icon, roles, totp_enabled, totp_secret, recovery_codes, version, created_at`
+
+func (db *usersDB) SignUp(ctx context.Context, user model.User) error {
+	roles, err := json.Marshal(stringsOrEmpty(user.Roles))
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO users (id, username, username_key, email, password, roles, version, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		user.ID, user.Username, model.NormalizeUsername(user.Username), user.Email, user.Password, string(roles), user.Version, user.CreatedAt)
+	if err != nil {
+		return convertError(err, user.Username, user.Email)
+	}
+
+	for _, session := range user.Sessions {
+		err = upsertUserSession(ctx, tx, user.ID, session)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (db *usersDB) SignIn(ctx context.Context, input model.Input) (model.User, error) {
+	return db.getUser(ctx, `username_key = ? AND password = ?`, model.NormalizeUsername(input.Username), input.Password)
+}
+
+func (db *usersDB) EditProfile(ctx context.Context, id string, input model.PatchUser, version int64) error {
+	var columns []string
+	var args []interface{}
+	set := func(column string, value string) {
+		columns = append(columns, column+" = ?")
+		args = append(args, value)
+	}
+
+	username, email := "", ""
+	if input.Username != nil {
+		username = *input.Username
+		set("username", username)
+		set("username_key", model.NormalizeUsername(username))
+	}
+	if input.Email != nil {
+		email = *input.Email
+		set("email", email)
+	}
+	if input.Bio != nil {
+		set("bio", *input.Bio)
+	}
+	if input.Icon != nil {
+		set("icon", *input.Icon)
+	}
+	if len(columns) == 0 {
+		return nil
+	}
+
+	err := db.updateVersioned(ctx, id, version, strings.Join(columns, ", "), args)
+	if err != nil {
+		return convertError(err, username, email)
+	}
+
+	return nil
+}
+
+func (db *usersDB) EditPassword(ctx context.Context, id string, password string, version int64) error {
+	return db.updateVersioned(ctx, id, version, "password = ?", []interface{}{password})
+}
+
+// updateVersioned runs UPDATE users SET set, bumping the version, while the
+// stored version equals version. model.AnyVersion skips the check.
+func (db *usersDB) updateVersioned(ctx context.Context, id string, version int64, set string, args []interface{}) error {
+	query := `UPDATE users SET ` + set + `, version = version + 1 WHERE id = ?`
+	args = append(args, id)
+	if version != model.AnyVersion {
+		query += ` AND version = ?`
+		args = append(args, version)
+	}
+
+	matched, err := db.exec(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	if matched > 0 {
+		return nil
+	}
+
+	exists, err := db.exists(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return mongo.ErrNoDocuments
+	}
+
+	return Mongo_storage.ErrVersionConflict
+}
+
+func (db *usersDB) SetEmailVerified(ctx context.Context, id string, email string, verifiedAt *time.Time) error {
+	matched, err := db.exec(ctx, `UPDATE users SET email_verified_at = ?, version = version + 1 WHERE id = ? AND email = ?`, verifiedAt, id, email)
+	if err != nil {
+		return err
+	}
+	if matched == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+func (db *usersDB) EnableTOTP(ctx context.Context, id string, secret string, recoveryCodes []string) error {
+	codes, err := json.Marshal(stringsOrEmpty(recoveryCodes))
+	if err != nil {
+		return err
+	}
+
+	_, err = db.exec(ctx, `UPDATE users SET totp_enabled = TRUE, totp_secret = ?, recovery_codes = ?, version = version + 1 WHERE id = ?`, secret, string(codes), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *usersDB) DisableTOTP(ctx context.Context, id string) error {
+	_, err := db.exec(ctx, `UPDATE users SET totp_enabled = FALSE, totp_secret = '', recovery_codes = '[]', version = version + 1 WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UseRecoveryCode removes code from the JSON array of recovery codes. The
+// update only matches while the code is still in the array, so every code
+// works once even under concurrent use.
+func (db *usersDB) UseRecoveryCode(ctx context.Context, id string, code string) (bool, error) {
+	used, err := db.exec(ctx, `UPDATE users
+		SET recovery_codes = (SELECT json_group_array(value) FROM json_each(users.recovery_codes) WHERE value <> ?), version = version + 1
+		WHERE id = ? AND EXISTS (SELECT 1 FROM json_each(users.recovery_codes) WHERE value = ?)`, code, id, code)
+	if err != nil {
+		return false, err
+	}
+
+	return used == 1, nil
+}
+
+func (db *usersDB) GetByID(ctx context.Context, id string) (model.User, error) {
+	return db.getUser(ctx, `id = ?`, id)
+}
+
+func (db *usersDB) GetByUsername(ctx context.Context, username string) (model.User, error) {
+	return db.getUser(ctx, `username_key = ?`, model.NormalizeUsername(username))
+}
+
+func (db *usersDB) GetByEmail(ctx context.Context, email string) (model.User, error) {
+	return db.getUser(ctx, `lower(email) = lower(?) AND email <> ''`, email)
+}
+
+func (db *usersDB) GetPublicByID(ctx context.Context, id string) (model.UserInfo, error) {
+	return db.getPublic(ctx, `id = ?`, id)
+}
+
+func (db *usersDB) SearchByUsername(ctx context.Context, username string) (model.UserInfo, error) {
+	return db.getPublic(ctx, `username_key = ?`, model.NormalizeUsername(username))
+}
+
+func (db *usersDB) getPublic(ctx context.Context, where string, args ...interface{}) (model.UserInfo, error) {
+	var user model.UserInfo
+
+	err := db.db.QueryRowContext(ctx, `SELECT id, username, bio, icon FROM users WHERE `+where, args...).
+		Scan(&user.ID, &user.Username, &user.Bio, &user.Icon)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.UserInfo{}, mongo.ErrNoDocuments
+	} else if err != nil {
+		return model.UserInfo{}, err
+	}
+
+	return user, nil
+}
+
+func (db *usersDB) GetBySession(ctx context.Context, session string) (model.User, error) {
+	return db.getUser(ctx, `id = (SELECT user_id FROM user_sessions WHERE token = ? LIMIT 1)`, session)
+}
+
+func (db *usersDB) UpsertSession(ctx context.Context, id string, session model.Session) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)`, id).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return mongo.ErrNoDocuments
+	}
+
+	err = upsertUserSession(ctx, tx, id, session)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *usersDB) DeleteSession(ctx context.Context, id string, token string) error {
+	_, err := db.exec(ctx, `DELETE FROM user_sessions WHERE user_id = ? AND token = ?`, id, token)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (db *usersDB) SessionUserIDs(ctx context.Context) ([]string, error) {
+	rows, err := db.db.QueryContext(ctx, `SELECT DISTINCT user_id FROM user_sessions`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+func (db *usersDB) DeleteOtherSessions(ctx context.Context, id string, keepToken string) error {
+	_, err := db.exec(ctx, `DELETE FROM user_sessions WHERE user_id = ? AND token <> ?`, id, keepToken)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func upsertUserSession(ctx context.Context, tx *sql.Tx, id string, session model.Session) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO user_sessions (user_id, token, id, user_agent, ip, created_at, last_seen_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id, token) DO UPDATE SET
+			id = excluded.id,
+			user_agent = excluded.user_agent,
+			ip = excluded.ip,
+			created_at = excluded.created_at,
+			last_seen_at = excluded.last_seen_at,
+			expires_at = excluded.expires_at`,
+		id, session.Token, session.ID, session.UserAgent, session.IP, session.CreatedAt, session.LastSeenAt,
+		sql.NullTime{Time: session.ExpiresAt, Valid: !session.ExpiresAt.IsZero()})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// getUser loads the user matching where together with its sessions.
+func (db *usersDB) getUser(ctx context.Context, where string, args ...interface{}) (model.User, error) {
+	var user model.User
+	var verifiedAt sql.NullTime
+	var roles, codes string
+
+	err := db.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE `+where, args...).Scan(
+		&user.ID, &user.Username, &user.Email, &verifiedAt, &user.Password, &user.Bio, &user.Icon,
+		&roles, &user.TOTPEnabled, &user.TOTPSecret, &codes, &user.Version, &user.CreatedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model.User{}, mongo.ErrNoDocuments
+	} else if err != nil {
+		return model.User{}, err
+	}
+	if verifiedAt.Valid {
+		user.EmailVerifiedAt = &verifiedAt.Time
+	}
+
+	err = json.Unmarshal([]byte(roles), &user.Roles)
+	if err != nil {
+		return model.User{}, err
+	}
+	err = json.Unmarshal([]byte(codes), &user.RecoveryCodes)
+	if err != nil {
+		return model.User{}, err
+	}
+
+	rows, err := db.db.QueryContext(ctx, `SELECT id, token, user_agent, ip, created_at, last_seen_at, expires_at FROM user_sessions WHERE user_id = ? ORDER BY created_at`, user.ID)
+	if err != nil {
+		return model.User{}, err
+	}
+	defer rows.Close()
+
+	user.Sessions = []model.Session{}
+	for rows.Next() {
+		session := model.Session{UserID: user.ID}
+		var expiresAt sql.NullTime
+		err = rows.Scan(&session.ID, &session.Token, &session.UserAgent, &session.IP, &session.CreatedAt, &session.LastSeenAt, &expiresAt)
+		if err != nil {
+			return model.User{}, err
+		}
+		session.ExpiresAt = expiresAt.Time
+		user.Sessions = append(user.Sessions, session)
+	}
+	err = rows.Err()
+	if err != nil {
+		return model.User{}, err
+	}
+
+	return user, nil
+}
+
+func (db *usersDB) exists(ctx context.Context, id string) (bool, error) {
+	var exists bool
+	err := db.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)`, id).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
+
+// exec runs query and returns the number of affected rows.
+func (db *usersDB) exec(ctx context.Context, query string, args ...interface{}) (int64, error) {
+	result, err := db.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// convertError turns unique violations into the duplicate key error the
+// Storage contract promises.
+func convertError(err error, username string, email string) error {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) || sqliteErr.ExtendedCode != sqlite3.ErrConstraintUnique {
+		return err
+	}
+
+	switch {
+	case strings.Contains(sqliteErr.Error(), "username_key"):
+		return Mongo_storage.DuplicateKeyError(Mongo_storage.UsernameIndex, "username_key", model.NormalizeUsername(username))
+	case strings.Contains(sqliteErr.Error(), Mongo_storage.EmailIndex):
+		return Mongo_storage.DuplicateKeyError(Mongo_storage.EmailIndex, "email", email)
+	default:
+		return Mongo_storage.DuplicateKeyError("id", "id", "")
+	}
+}
+
+// stringsOrEmpty keeps nil slices from being stored as JSON null.
+func stringsOrEmpty(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+
+	return values
+}
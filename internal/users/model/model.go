@@ -5,16 +5,29 @@ import (
 )
 
 type User struct {
-	ID        string    `json:"id"`
-	Username  string    `json:"username"`
-	Email     string    `json:"email"`
-	Password  string    `json:"password"`
-	Session   string    `json:"session"`
-	Bio       string    `json:"bio"`
-	Icon      string    `json:"icon"`
-	CreatedAt time.Time `json:"create_at"`
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	// UsernameKey is NormalizeUsername(Username). Storage keeps it unique and
+	// looks users up by it.
+	UsernameKey     string     `json:"-"`
+	Email           string     `json:"email"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	Password        string     `json:"-"`
+	Sessions        []Session  `json:"-"`
+	Bio             string     `json:"bio"`
+	Icon            string     `json:"icon"`
+	Roles           []string   `json:"roles"`
+	TOTPEnabled     bool       `json:"totp_enabled"`
+	TOTPSecret      string     `json:"-"`
+	RecoveryCodes   []string   `json:"-"`
+	Version         int64      `json:"version"`
+	CreatedAt       time.Time  `json:"create_at"`
 }
 
+// AnyVersion disables the optimistic concurrency check of an update.
+const AnyVersion int64 = -1
+
+// UserInfo is the public view of a user, the only fields other users see.
 type UserInfo struct {
 	ID       string `json:"id"`
 	Username string `json:"username"`
@@ -30,26 +43,152 @@ type UpdateUser struct {
 	Icon     string `json:"icon"`
 }
 
+// PatchUser is a partial profile update, nil fields are left untouched.
+type PatchUser struct {
+	Username *string `json:"username"`
+	Email    *string `json:"email"`
+	Bio      *string `json:"bio"`
+	Icon     *string `json:"icon"`
+}
+
 type Input struct {
 	Username string `json:"username"`
+	Email    string `json:"email"`
 	Password string `json:"password"`
 }
 
+// EmailVerification is the stored state of a verification link. Email is
+// kept so a link sent for an old address can not verify a newer one.
+type EmailVerification struct {
+	UserID string `json:"user_id"`
+	Email  string `json:"email"`
+}
+
 type ChangePassword struct {
 	Old        string `json:"old"`
 	New        string `json:"new"`
 	ConfirmNew string `json:"confirm_new"`
 }
 
-func UserFromInput(ID string, user Input, session string, createdAt time.Time) User {
+type ForgotPassword struct {
+	Email string `json:"email"`
+}
+
+type VerifyEmail struct {
+	Token string `json:"token"`
+}
+
+type ResetPassword struct {
+	Token      string `json:"token"`
+	New        string `json:"new"`
+	ConfirmNew string `json:"confirm_new"`
+}
+
+type Tokens struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	TokenType    string    `json:"token_type"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// Auth is the result of a sign-in. When the user has two-factor
+// authentication enabled only Challenge is set and has to be completed
+// through SignInSecondFactor.
+type Auth struct {
+	User      SelfUser `json:"user"`
+	Session   string   `json:"session"`
+	Tokens    Tokens   `json:"tokens"`
+	Challenge string   `json:"challenge,omitempty"`
+}
+
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type TOTPCode struct {
+	Code string `json:"code"`
+}
+
+type SecondFactor struct {
+	Challenge string `json:"challenge"`
+	// Code is either a current TOTP code or one of the recovery codes.
+	Code string `json:"code"`
+}
+
+type DisableTOTP struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+// Session is one signed-in device. Token is the SHA-256 digest of the
+// session token everywhere except in the response that creates the session,
+// the token itself is never stored. ID is the public handle used to list and
+// revoke sessions. ExpiresAt is the absolute end of the session, it also ends
+// once it has not been seen for the configured idle timeout.
+type Session struct {
+	ID         string    `json:"id"`
+	Token      string    `json:"token,omitempty"`
+	UserID     string    `json:"user_id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	Current    bool      `json:"current" bson:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// Identity is the authenticated caller of a request. Session is empty when
+// the caller used an access token instead of a session.
+type Identity struct {
+	User    User
+	Session Session
+}
+
+// Client describes the device a request came from. Session is the
+// credential the request carried, if any, a sign-in ends that session.
+type Client struct {
+	UserAgent string
+	IP        string
+	Session   string
+}
+
+type RefreshInput struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshToken is the stored state of an issued refresh token. Only the
+// SHA-256 digest of the token is kept. Tokens rotated from the same sign-in
+// share a Family so a reused token can revoke the whole chain. The Family is
+// the ID of the session that sign-in opened.
+type RefreshToken struct {
+	Hash      string    `json:"hash"`
+	UserID    string    `json:"user_id"`
+	Family    string    `json:"family"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+type Unlock struct {
+	Token string `json:"token"`
+}
+
+func UserFromInput(ID string, user Input, createdAt time.Time) User {
 	return User{
-		ID:        ID,
-		Username:  user.Username,
-		Password:  user.Password,
-		Session:   session,
-		CreatedAt: createdAt,
-		Email:     "",
-		Bio:       "",
-		Icon:      "",
+		ID:          ID,
+		Username:    user.Username,
+		UsernameKey: NormalizeUsername(user.Username),
+		Password:    user.Password,
+		Sessions:    []Session{},
+		CreatedAt:   createdAt,
+		Email:       user.Email,
+		Bio:         "",
+		Icon:        "",
+		Roles:       []string{RoleUser},
+		Version:     1,
 	}
 }
@@ -0,0 +1,16 @@
+package model
+
+import (
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// NormalizeUsername returns the key usernames are compared by: NFKC
+// normalized and case folded, so "Artist", "artist" and "ＡＲＴＩＳＴ" are the
+// same name.
+func NormalizeUsername(username string) string {
+	folded := cases.Fold().String(norm.NFKC.String(username))
+
+	// Case folding can produce sequences that are no longer in NFKC.
+	return norm.NFKC.String(folded)
+}
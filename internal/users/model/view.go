@@ -0,0 +1,70 @@
+package model
+
+import (
+	"time"
+)
+
+// The views below are what leaves the service. User itself carries the
+// password hash, session digests and TOTP secrets and is only used inside
+// the service and the storages, every response is projected into one of
+// these explicitly. UserInfo is the public view.
+
+// SelfUser is the view of the signed-in user's own account.
+type SelfUser struct {
+	ID              string     `json:"id"`
+	Username        string     `json:"username"`
+	Email           string     `json:"email"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	Bio             string     `json:"bio"`
+	Icon            string     `json:"icon"`
+	Roles           []string   `json:"roles"`
+	TOTPEnabled     bool       `json:"totp_enabled"`
+	Version         int64      `json:"version"`
+	CreatedAt       time.Time  `json:"create_at"`
+}
+
+// AdminUser is the view admins get of any account. Sessions are listed
+// without their token digests.
+type AdminUser struct {
+	SelfUser
+	Sessions          []Session `json:"sessions"`
+	RecoveryCodesLeft int       `json:"recovery_codes_left"`
+}
+
+func PublicFromUser(user User) UserInfo {
+	return UserInfo{
+		ID:       user.ID,
+		Username: user.Username,
+		Bio:      user.Bio,
+		Icon:     user.Icon,
+	}
+}
+
+func SelfFromUser(user User) SelfUser {
+	return SelfUser{
+		ID:              user.ID,
+		Username:        user.Username,
+		Email:           user.Email,
+		EmailVerifiedAt: user.EmailVerifiedAt,
+		Bio:             user.Bio,
+		Icon:            user.Icon,
+		Roles:           user.Roles,
+		TOTPEnabled:     user.TOTPEnabled,
+		Version:         user.Version,
+		CreatedAt:       user.CreatedAt,
+	}
+}
+
+func AdminFromUser(user User) AdminUser {
+	sessions := make([]Session, 0, len(user.Sessions))
+	for _, session := range user.Sessions {
+		session.Token = ""
+		sessions = append(sessions, session)
+	}
+
+	return AdminUser{
+		SelfUser:          SelfFromUser(user),
+		Sessions:          sessions,
+		RecoveryCodesLeft: len(user.RecoveryCodes),
+	}
+}
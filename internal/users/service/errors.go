@@ -0,0 +1,75 @@
+package service
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sillamilla/user_microservice/internal/users/validation"
+	"time"
+)
+
+var (
+	ErrNotFound     = errors.New("not found")
+	ErrConflict     = errors.New("conflict")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrValidation   = errors.New("validation failed")
+	// ErrPreconditionFailed means the caller edited an outdated version.
+	ErrPreconditionFailed = errors.New("precondition failed")
+	ErrTooManyRequests    = errors.New("too many requests")
+)
+
+// Error is a domain error returned by Service. Message is safe to show to
+// clients, Kind is one of the sentinel errors above and can be matched with
+// errors.Is. RetryAfter is set for ErrTooManyRequests, Fields lists every
+// invalid input field for ErrValidation.
+type Error struct {
+	Kind       error
+	Message    string
+	RetryAfter time.Duration
+	Fields     []validation.FieldError
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
+
+func newError(kind error, message string) error {
+	return &Error{
+		Kind:    kind,
+		Message: message,
+	}
+}
+
+func newRetryError(message string, retryAfter time.Duration) error {
+	return &Error{
+		Kind:       ErrTooManyRequests,
+		Message:    message,
+		RetryAfter: retryAfter,
+	}
+}
+
+// newValidationError returns nil when fields is empty. Message repeats the
+// first field's message for clients that only show one.
+func newValidationError(fields []validation.FieldError) error {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	return &Error{
+		Kind:    ErrValidation,
+		Message: fields[0].Message,
+		Fields:  fields,
+	}
+}
+
+// fieldErrors collects the problems of several fields, skipping nil ones.
+type fieldErrors []validation.FieldError
+
+func (f *fieldErrors) add(err *validation.FieldError) {
+	if err != nil {
+		*f = append(*f, *err)
+	}
+}
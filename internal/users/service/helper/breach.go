@@ -0,0 +1,294 @@
+package helper
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// BreachChecker tells whether a password appears in known breach corpora
+// often enough to be refused. Implementations work offline on local data.
+type BreachChecker interface {
+	Breached(password string) (bool, error)
+}
+
+// IsBreached checks password with checker. A nil checker disables the check.
+func IsBreached(checker BreachChecker, password string) (bool, error) {
+	if checker == nil {
+		return false, nil
+	}
+
+	return checker.Breached(password)
+}
+
+type shardChecker struct {
+	dir       string
+	threshold int64
+}
+
+// NewShardChecker reads the HIBP range format: dir holds one file per
+// 5-character SHA-1 prefix, named like 21BD1 or 21BD1.txt, with a
+// SUFFIX:COUNT line per hash. A password is breached when its count is at
+// least threshold.
+func NewShardChecker(dir string, threshold int64) BreachChecker {
+	return &shardChecker{
+		dir:       dir,
+		threshold: threshold,
+	}
+}
+
+func (c *shardChecker) Breached(password string) (bool, error) {
+	digest := sha1Hex(password)
+	prefix, suffix := digest[:5], digest[5:]
+
+	file, err := os.Open(filepath.Join(c.dir, prefix+".txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		file, err = os.Open(filepath.Join(c.dir, prefix))
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		hash, count, err := parseBreachLine(scanner.Text())
+		if err != nil {
+			return false, err
+		}
+		if strings.EqualFold(hash, suffix) {
+			return count >= c.threshold, nil
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return false, err
+	}
+
+	return false, nil
+}
+
+// BloomFilter is a compact set of SHA-1 hashes from a breach corpus. It has
+// no false negatives and a false positive rate chosen at build time, so a
+// few strong passwords may be refused. Only hashes seen at least MinCount
+// times are added.
+type BloomFilter struct {
+	bits     []uint64
+	m        uint64
+	k        uint32
+	MinCount int64
+}
+
+const bloomMagic = "HIBPBLM1"
+
+// NewBloomFilter sizes a filter for n hashes at the false positive rate p.
+func NewBloomFilter(n uint64, p float64, minCount int64) *BloomFilter {
+	if n == 0 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k := uint32(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k == 0 {
+		k = 1
+	}
+
+	return &BloomFilter{
+		bits:     make([]uint64, (m+63)/64),
+		m:        m,
+		k:        k,
+		MinCount: minCount,
+	}
+}
+
+// BuildBloomFilter reads a raw HIBP file of HASH:COUNT lines with full
+// 40-character SHA-1 hashes and adds the ones seen at least minCount times.
+// The file is read twice, once to size the filter.
+func BuildBloomFilter(path string, p float64, minCount int64) (*BloomFilter, error) {
+	var n uint64
+	err := scanBreachFile(path, minCount, func([]byte) {
+		n++
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	filter := NewBloomFilter(n, p, minCount)
+	err = scanBreachFile(path, minCount, filter.add)
+	if err != nil {
+		return nil, err
+	}
+
+	return filter, nil
+}
+
+// LoadBloomFilter reads a filter written by WriteTo.
+func LoadBloomFilter(path string) (*BloomFilter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	magic := make([]byte, len(bloomMagic))
+	_, err = io.ReadFull(r, magic)
+	if err != nil {
+		return nil, err
+	}
+	if string(magic) != bloomMagic {
+		return nil, fmt.Errorf("%s is not a breach bloom filter", path)
+	}
+
+	var header struct {
+		M        uint64
+		K        uint32
+		MinCount int64
+	}
+	err = binary.Read(r, binary.BigEndian, &header)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := &BloomFilter{
+		bits:     make([]uint64, (header.M+63)/64),
+		m:        header.M,
+		k:        header.K,
+		MinCount: header.MinCount,
+	}
+	err = binary.Read(r, binary.BigEndian, filter.bits)
+	if err != nil {
+		return nil, err
+	}
+
+	return filter, nil
+}
+
+// WriteTo writes the filter in the format LoadBloomFilter reads.
+func (f *BloomFilter) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	_, err := bw.WriteString(bloomMagic)
+	if err != nil {
+		return 0, err
+	}
+
+	err = binary.Write(bw, binary.BigEndian, struct {
+		M        uint64
+		K        uint32
+		MinCount int64
+	}{f.m, f.k, f.MinCount})
+	if err != nil {
+		return 0, err
+	}
+
+	err = binary.Write(bw, binary.BigEndian, f.bits)
+	if err != nil {
+		return 0, err
+	}
+
+	err = bw.Flush()
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(bloomMagic) + 20 + 8*len(f.bits)), nil
+}
+
+func (f *BloomFilter) Breached(password string) (bool, error) {
+	digest := sha1.Sum([]byte(password))
+	return f.contains(digest[:]), nil
+}
+
+// positions derives the k bit positions from the digest by double hashing,
+// SHA-1 output is already uniform so no further hashing is needed.
+func (f *BloomFilter) positions(digest []byte, visit func(bit uint64) bool) {
+	h1 := binary.BigEndian.Uint64(digest[0:8])
+	h2 := binary.BigEndian.Uint64(digest[8:16]) | 1
+	for i := uint64(0); i < uint64(f.k); i++ {
+		if !visit((h1 + i*h2) % f.m) {
+			return
+		}
+	}
+}
+
+func (f *BloomFilter) add(digest []byte) {
+	f.positions(digest, func(bit uint64) bool {
+		f.bits[bit/64] |= 1 << (bit % 64)
+		return true
+	})
+}
+
+func (f *BloomFilter) contains(digest []byte) bool {
+	found := true
+	f.positions(digest, func(bit uint64) bool {
+		found = f.bits[bit/64]&(1<<(bit%64)) != 0
+		return found
+	})
+
+	return found
+}
+
+// scanBreachFile calls add with the binary digest of every hash in path seen
+// at least minCount times.
+func scanBreachFile(path string, minCount int64, add func(digest []byte)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	digest := make([]byte, sha1.Size)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		hash, count, err := parseBreachLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if hash == "" || count < minCount {
+			continue
+		}
+
+		if len(hash) != 2*sha1.Size {
+			return fmt.Errorf("%s:%d: %q is not a SHA-1 hash", path, line, hash)
+		}
+		_, err = hex.Decode(digest, []byte(hash))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %q is not a SHA-1 hash", path, line, hash)
+		}
+		add(digest)
+	}
+
+	return scanner.Err()
+}
+
+// parseBreachLine splits a HASH:COUNT line. Lines without a count, as in
+// some exports, count once.
+func parseBreachLine(line string) (string, int64, error) {
+	line = strings.TrimSpace(line)
+	hash, count, ok := strings.Cut(line, ":")
+	if !ok {
+		return hash, 1, nil
+	}
+
+	n, err := strconv.ParseInt(count, 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid count in %q", line)
+	}
+
+	return hash, n, nil
+}
+
+func sha1Hex(password string) string {
+	digest := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(digest[:]))
+}
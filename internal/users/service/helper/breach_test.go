@@ -0,0 +1,94 @@
+package helper
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShardChecker(t *testing.T) {
+	dir := t.TempDir()
+	password := sha1Hex("password1")
+	rare := sha1Hex("rarely-leaked")
+	writeFile(t, filepath.Join(dir, password[:5]+".txt"), "0000000000000000000000000000000000A:3\r\n"+password[5:]+":2413945\r\n")
+	writeFile(t, filepath.Join(dir, rare[:5]), strings.ToLower(rare[5:])+":2\n")
+
+	checker := NewShardChecker(dir, 3)
+	for _, tt := range []struct {
+		password string
+		want     bool
+	}{
+		{"password1", true},
+		{"rarely-leaked", false},
+		{"correct horse battery staple", false},
+	} {
+		got, err := checker.Breached(tt.password)
+		if err != nil {
+			t.Fatalf("Breached(%q): %v", tt.password, err)
+		}
+		if got != tt.want {
+			t.Errorf("Breached(%q) = %v, want %v", tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	dir := t.TempDir()
+	raw := filepath.Join(dir, "pwned.txt")
+	writeFile(t, raw, sha1Hex("password1")+":2413945\n"+sha1Hex("qwerty123")+":100\n\n"+sha1Hex("rarely-leaked")+":1\n")
+
+	built, err := BuildBloomFilter(raw, 0.001, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "breach.bloom")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = built.WriteTo(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filter, err := LoadBloomFilter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.MinCount != 2 {
+		t.Fatalf("MinCount = %d, want 2", filter.MinCount)
+	}
+
+	for _, tt := range []struct {
+		password string
+		want     bool
+	}{
+		{"password1", true},
+		{"qwerty123", true},
+		{"rarely-leaked", false},
+		{"correct horse battery staple", false},
+	} {
+		got, err := IsBreached(filter, tt.password)
+		if err != nil {
+			t.Fatalf("Breached(%q): %v", tt.password, err)
+		}
+		if got != tt.want {
+			t.Errorf("Breached(%q) = %v, want %v", tt.password, got, tt.want)
+		}
+	}
+}
+
+func writeFile(t *testing.T, path string, data string) {
+	t.Helper()
+
+	err := os.WriteFile(path, []byte(data), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
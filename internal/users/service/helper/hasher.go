@@ -0,0 +1,191 @@
+package helper
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+// Password hash algorithms.
+const (
+	Argon2id = "argon2id"
+	Bcrypt   = "bcrypt"
+)
+
+// ErrPasswordTooLong is returned by Hash when the algorithm can not hash the
+// whole password. bcrypt stops at 72 bytes.
+var ErrPasswordTooLong = errors.New("password is too long for the hash algorithm")
+
+// ErrUnknownHash is returned by Verify for hashes in no supported format.
+var ErrUnknownHash = errors.New("unknown password hash format")
+
+// Hasher hashes passwords in PHC string format. Verify accepts hashes of
+// every supported algorithm, so stored hashes keep working after the
+// configured algorithm or its parameters change. NeedsRehash tells when a
+// stored hash should be replaced by one made with the current settings.
+type Hasher interface {
+	Hash(password string) (string, error)
+	Verify(hash string, password string) (bool, error)
+	NeedsRehash(hash string) bool
+}
+
+// Argon2Params are the argon2id cost parameters. Memory is in KiB.
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2Params follow the OWASP recommendation for argon2id.
+var DefaultArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+type HasherConfig struct {
+	// Algorithm is argon2id or bcrypt.
+	Algorithm  string
+	Argon2     Argon2Params
+	BcryptCost int
+}
+
+type hasher struct {
+	cfg HasherConfig
+}
+
+func NewHasher(cfg HasherConfig) (Hasher, error) {
+	switch cfg.Algorithm {
+	case Argon2id:
+		if cfg.Argon2.Memory == 0 || cfg.Argon2.Iterations == 0 || cfg.Argon2.Parallelism == 0 {
+			return nil, errors.New("argon2id memory, iterations and parallelism must be set")
+		}
+		if cfg.Argon2.SaltLength == 0 {
+			cfg.Argon2.SaltLength = DefaultArgon2Params.SaltLength
+		}
+		if cfg.Argon2.KeyLength == 0 {
+			cfg.Argon2.KeyLength = DefaultArgon2Params.KeyLength
+		}
+	case Bcrypt:
+		if cfg.BcryptCost < bcrypt.MinCost || cfg.BcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	default:
+		return nil, fmt.Errorf("unknown password hash algorithm %q", cfg.Algorithm)
+	}
+
+	return &hasher{
+		cfg: cfg,
+	}, nil
+}
+
+func (h *hasher) Hash(password string) (string, error) {
+	if h.cfg.Algorithm == Bcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.cfg.BcryptCost)
+		if errors.Is(err, bcrypt.ErrPasswordTooLong) {
+			return "", ErrPasswordTooLong
+		} else if err != nil {
+			return "", err
+		}
+
+		return string(hash), nil
+	}
+
+	params := h.cfg.Argon2
+	salt := make([]byte, params.SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, params.Memory, params.Iterations, params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h *hasher) Verify(hash string, password string) (bool, error) {
+	if isBcrypt(hash) {
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		return true, nil
+	}
+
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+
+	other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (h *hasher) NeedsRehash(hash string) bool {
+	if isBcrypt(hash) {
+		if h.cfg.Algorithm != Bcrypt {
+			return true
+		}
+
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost < h.cfg.BcryptCost
+	}
+
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil || h.cfg.Algorithm != Argon2id {
+		return true
+	}
+
+	want := h.cfg.Argon2
+	return params.Memory < want.Memory || params.Iterations < want.Iterations || params.Parallelism < want.Parallelism ||
+		uint32(len(salt)) < want.SaltLength || uint32(len(key)) < want.KeyLength
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// decodeArgon2id parses $argon2id$v=19$m=65536,t=3,p=2$salt$key.
+func decodeArgon2id(hash string) (Argon2Params, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != Argon2id {
+		return Argon2Params{}, nil, nil, ErrUnknownHash
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return Argon2Params{}, nil, nil, ErrUnknownHash
+	}
+
+	var params Argon2Params
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil {
+		return Argon2Params{}, nil, nil, ErrUnknownHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Argon2Params{}, nil, nil, ErrUnknownHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return Argon2Params{}, nil, nil, ErrUnknownHash
+	}
+
+	return params, salt, key, nil
+}
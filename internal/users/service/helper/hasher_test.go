@@ -0,0 +1,93 @@
+package helper
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"testing"
+)
+
+var cheapArgon2 = Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1}
+
+func TestHasherArgon2id(t *testing.T) {
+	h, err := NewHasher(HasherConfig{Algorithm: Argon2id, Argon2: cheapArgon2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	long := strings.Repeat("long password ", 10)
+	hash, err := h.Hash(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("Hash = %q, want PHC argon2id", hash)
+	}
+
+	ok, err := h.Verify(hash, long)
+	if err != nil || !ok {
+		t.Fatalf("Verify(correct) = %v, %v", ok, err)
+	}
+	// bcrypt would accept this, it only sees the first 72 bytes.
+	ok, err = h.Verify(hash, long[:72])
+	if err != nil || ok {
+		t.Fatalf("Verify(prefix) = %v, %v", ok, err)
+	}
+	if h.NeedsRehash(hash) {
+		t.Fatal("NeedsRehash of a current hash")
+	}
+
+	stronger, err := NewHasher(HasherConfig{Algorithm: Argon2id, Argon2: Argon2Params{Memory: 128, Iterations: 1, Parallelism: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stronger.NeedsRehash(hash) {
+		t.Fatal("NeedsRehash after raising memory = false")
+	}
+}
+
+func TestHasherBcrypt(t *testing.T) {
+	legacy, err := bcrypt.GenerateFromPassword([]byte("secret password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	argon, err := NewHasher(HasherConfig{Algorithm: Argon2id, Argon2: cheapArgon2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := argon.Verify(string(legacy), "secret password")
+	if err != nil || !ok {
+		t.Fatalf("Verify(bcrypt) = %v, %v", ok, err)
+	}
+	ok, err = argon.Verify(string(legacy), "wrong")
+	if err != nil || ok {
+		t.Fatalf("Verify(bcrypt, wrong) = %v, %v", ok, err)
+	}
+	if !argon.NeedsRehash(string(legacy)) {
+		t.Fatal("argon2id hasher does not rehash bcrypt")
+	}
+
+	h, err := NewHasher(HasherConfig{Algorithm: Bcrypt, BcryptCost: bcrypt.MinCost + 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.NeedsRehash(string(legacy)) {
+		t.Fatal("NeedsRehash after raising the cost = false")
+	}
+	_, err = h.Hash(strings.Repeat("x", 73))
+	if err != ErrPasswordTooLong {
+		t.Fatalf("Hash(73 bytes) error = %v, want ErrPasswordTooLong", err)
+	}
+}
+
+func TestHasherUnknownHash(t *testing.T) {
+	h, err := NewHasher(HasherConfig{Algorithm: Argon2id, Argon2: cheapArgon2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = h.Verify("plaintext", "plaintext")
+	if err != ErrUnknownHash {
+		t.Fatalf("Verify error = %v, want ErrUnknownHash", err)
+	}
+}
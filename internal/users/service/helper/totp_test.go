@@ -0,0 +1,95 @@
+package helper
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key of the RFC 6238 test vectors.
+var rfcSecret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCodeMatchesRFC6238(t *testing.T) {
+	// The RFC lists 8 digit codes, these are their last 6 digits.
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, want := range vectors {
+		got, err := TOTPCode(rfcSecret, time.Unix(unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("TOTPCode at %d = %s, want %s", unix, got, want)
+		}
+	}
+}
+
+func TestValidateTOTPSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	code, err := TOTPCode(rfcSecret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		at   time.Time
+		ok   bool
+	}{
+		{"same period", now, true},
+		{"server one period ahead", now.Add(totpPeriod * time.Second), true},
+		{"server one period behind", now.Add(-totpPeriod * time.Second), true},
+		{"server two periods ahead", now.Add(2 * totpPeriod * time.Second), false},
+		{"server two periods behind", now.Add(-2 * totpPeriod * time.Second), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := ValidateTOTP(rfcSecret, code, tt.at)
+			if ok != tt.ok {
+				t.Fatalf("ValidateTOTP = %v, want %v", ok, tt.ok)
+			}
+			if ok && step != now.Unix()/totpPeriod {
+				t.Fatalf("ValidateTOTP step = %d, want the step the code was made for", step)
+			}
+		})
+	}
+}
+
+func TestValidateTOTPRejectsMalformed(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	for _, code := range []string{"", "05047", "0504711", "abcdef", " 50471"} {
+		_, ok := ValidateTOTP(rfcSecret, code, now)
+		if ok {
+			t.Errorf("ValidateTOTP accepted %q", code)
+		}
+	}
+
+	_, ok := ValidateTOTP("not base32!", "050471", now)
+	if ok {
+		t.Error("ValidateTOTP accepted an invalid secret")
+	}
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		if len(code) != 11 || code[5] != '-' || strings.ToLower(code) != code {
+			t.Errorf("recovery code %q is not xxxxx-xxxxx", code)
+		}
+		if seen[code] {
+			t.Errorf("recovery code %q repeated", code)
+		}
+		seen[code] = true
+	}
+}
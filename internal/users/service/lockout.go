@@ -0,0 +1,193 @@
+package service
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/sillamilla/user_microservice/internal/mailer"
+	"github.com/sillamilla/user_microservice/internal/users/model"
+	"github.com/sillamilla/user_microservice/internal/users/token"
+	"time"
+)
+
+// LockoutConfig controls brute-force protection on sign-in. Every failure
+// blocks further attempts for BaseDelay, doubled per failure up to MaxDelay.
+// Reaching a threshold locks the username or IP for LockoutDuration.
+// Thresholds and durations must be positive.
+type LockoutConfig struct {
+	UserThreshold   int64
+	IPThreshold     int64
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutDuration time.Duration
+	// Window is how long failures are remembered.
+	Window time.Duration
+	// UnlockURL is the frontend page the unlock token is appended to.
+	UnlockURL string
+}
+
+func userLoginKey(username string) string {
+	return "user:" + model.NormalizeUsername(username)
+}
+
+// ipLoginKey counts failures per client IP. ip must come from the peer or a
+// trusted proxy, never from a header the client controls, or every guess
+// could start a new counter.
+func ipLoginKey(ip string) string {
+	return "ip:" + ip
+}
+
+// checkLoginLock fails with ErrTooManyRequests while the username or the IP
+// is blocked.
+func (s *service) checkLoginLock(ctx context.Context, username string, ip string) error {
+	var retryAfter time.Duration
+	for _, key := range []string{userLoginKey(username), ipLoginKey(ip)} {
+		ttl, err := s.re.LoginLockTTL(ctx, key)
+		if err != nil {
+			return err
+		}
+		if ttl > retryAfter {
+			retryAfter = ttl
+		}
+	}
+
+	if retryAfter > 0 {
+		return newRetryError("Too many failed sign-in attempts, try again later", retryAfter)
+	}
+
+	return nil
+}
+
+// registerLoginFailure counts a failed attempt against the username and the
+// IP and blocks them. The owner of the account is mailed an unlock link when
+// the username gets locked.
+func (s *service) registerLoginFailure(ctx context.Context, user model.User, username string, ip string) error {
+	locked, err := s.registerFailure(ctx, userLoginKey(username), s.cfg.Lockout.UserThreshold)
+	if err != nil {
+		return err
+	}
+	if locked && user.Email != "" {
+		err = s.sendUnlock(ctx, user)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = s.registerFailure(ctx, ipLoginKey(ip), s.cfg.Lockout.IPThreshold)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// registerFailure reports true when this failure reached the threshold.
+func (s *service) registerFailure(ctx context.Context, key string, threshold int64) (bool, error) {
+	failures, err := s.re.RegisterLoginFailure(ctx, key, s.cfg.Lockout.Window)
+	if err != nil {
+		return false, err
+	}
+
+	if failures >= threshold {
+		err = s.re.LockLogin(ctx, key, s.cfg.Lockout.LockoutDuration)
+		if err != nil {
+			return false, err
+		}
+
+		return failures == threshold, nil
+	}
+
+	delay := s.cfg.Lockout.BaseDelay << (failures - 1)
+	if delay <= 0 || delay > s.cfg.Lockout.MaxDelay {
+		delay = s.cfg.Lockout.MaxDelay
+	}
+
+	err = s.re.LockLogin(ctx, key, delay)
+	if err != nil {
+		return false, err
+	}
+
+	return false, nil
+}
+
+func (s *service) resetLoginFailures(ctx context.Context, username string, ip string) error {
+	err := s.re.ResetLoginFailures(ctx, userLoginKey(username))
+	if err != nil {
+		return err
+	}
+
+	err = s.re.ResetLoginFailures(ctx, ipLoginKey(ip))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *service) sendUnlock(ctx context.Context, user model.User) error {
+	plain, hash, err := token.NewOpaque()
+	if err != nil {
+		return err
+	}
+
+	err = s.re.SaveUnlockToken(ctx, hash, user.Username, s.cfg.Lockout.LockoutDuration)
+	if err != nil {
+		return err
+	}
+
+	err = s.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Your MusicHub account has been locked",
+		Body: "Hi " + user.Username + ",\n\n" +
+			"We blocked sign-in to your account after too many failed attempts. " +
+			"If this was you, open the link below to unlock it right away. Otherwise the lock ends in " + s.cfg.Lockout.LockoutDuration.String() + ".\n\n" +
+			s.cfg.Lockout.UnlockURL + plain + "\n\n" +
+			"If it was not you, consider changing your password.",
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UnlockByToken lifts a username lockout using the link mailed on lockout.
+func (s *service) UnlockByToken(ctx context.Context, unlockToken string) error {
+	username, err := s.re.ConsumeUnlockToken(ctx, token.Hash(unlockToken))
+	if errors.Is(err, redis.Nil) {
+		return newError(ErrUnauthorized, "Invalid or expired unlock token")
+	} else if err != nil {
+		return errors.Wrap(err, "service.UnlockByToken.ConsumeUnlockToken")
+	}
+
+	err = s.re.ResetLoginFailures(ctx, userLoginKey(username))
+	if err != nil {
+		return errors.Wrap(err, "service.UnlockByToken.ResetLoginFailures")
+	}
+
+	return nil
+}
+
+// UnlockUser lifts a username lockout on behalf of an administrator.
+func (s *service) UnlockUser(ctx context.Context, identity model.Identity, username string) error {
+	if !hasRole(identity.User, model.RoleAdmin) {
+		return newError(ErrForbidden, "Admin role required")
+	}
+
+	err := s.re.ResetLoginFailures(ctx, userLoginKey(username))
+	if err != nil {
+		return errors.Wrap(err, "service.UnlockUser.ResetLoginFailures")
+	}
+
+	return nil
+}
+
+func hasRole(user model.User, role string) bool {
+	for _, r := range user.Roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,203 @@
+package service
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/sillamilla/user_microservice/internal/mailer"
+	"github.com/sillamilla/user_microservice/internal/users/Mongo_storage"
+	"github.com/sillamilla/user_microservice/internal/users/Redis_storage"
+	"github.com/sillamilla/user_microservice/internal/users/model"
+	"github.com/sillamilla/user_microservice/internal/users/token"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newLockoutService(t *testing.T, lockout LockoutConfig) (*service, *mailer.Memory) {
+	t.Helper()
+
+	tokens, err := token.New(token.Config{Algorithm: token.HS256, Secret: "test-secret", Issuer: "test", AccessTTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testConfig()
+	cfg.Lockout = lockout
+	ml := mailer.NewMemory()
+	s := New(Redis_storage.NewMemory(), Mongo_storage.NewMemory(), tokens, ml, cfg).(*service)
+
+	return s, ml
+}
+
+func signInAs(s Service, username string, password string, ip string) error {
+	_, err := s.SignIn(context.Background(), model.Input{Username: username, Password: password}, model.Client{IP: ip})
+	return err
+}
+
+func TestLoginBackoff(t *testing.T) {
+	s, _ := newLockoutService(t, LockoutConfig{
+		UserThreshold:   100,
+		IPThreshold:     100,
+		BaseDelay:       time.Second,
+		MaxDelay:        8 * time.Second,
+		LockoutDuration: time.Hour,
+		Window:          time.Hour,
+	})
+	ctx := context.Background()
+
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second}
+	for i, delay := range want {
+		_, err := s.registerFailure(ctx, "user:alice", 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ttl, err := s.re.LoginLockTTL(ctx, "user:alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ttl > delay || ttl < delay-100*time.Millisecond {
+			t.Fatalf("delay after failure %d = %v, want %v", i+1, ttl, delay)
+		}
+	}
+
+	// The shift overflows long before the threshold, the delay stays capped.
+	for i := len(want); i < 70; i++ {
+		_, err := s.registerFailure(ctx, "user:alice", 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ttl, err := s.re.LoginLockTTL(ctx, "user:alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl > 8*time.Second || ttl < 7*time.Second {
+		t.Fatalf("delay after 70 failures = %v, want the 8s cap", ttl)
+	}
+}
+
+func TestLoginLocksAtThreshold(t *testing.T) {
+	s, ml := newLockoutService(t, LockoutConfig{
+		UserThreshold:   3,
+		IPThreshold:     100,
+		BaseDelay:       time.Millisecond,
+		MaxDelay:        time.Millisecond,
+		LockoutDuration: time.Hour,
+		Window:          time.Hour,
+		UnlockURL:       "http://localhost/unlock?token=",
+	})
+	signUp(t, s, "alice")
+
+	for i := 0; i < 3; i++ {
+		err := signInAs(s, "alice", "wrong", "10.0.0.1")
+		if !errors.Is(err, ErrUnauthorized) {
+			t.Fatalf("failure %d error = %v, want ErrUnauthorized", i+1, err)
+		}
+		waitForDelay()
+	}
+
+	// The right password from another IP does not get through the lock.
+	err := signInAs(s, "alice", "correct horse battery staple", "10.0.0.2")
+	var domainErr *Error
+	if !errors.As(err, &domainErr) || domainErr.Kind != ErrTooManyRequests {
+		t.Fatalf("SignIn of a locked user error = %v, want ErrTooManyRequests", err)
+	}
+	if domainErr.RetryAfter < 59*time.Minute || domainErr.RetryAfter > time.Hour {
+		t.Fatalf("RetryAfter = %v, want about the lockout duration", domainErr.RetryAfter)
+	}
+
+	var unlockMails []mailer.Message
+	for _, message := range ml.Messages() {
+		if strings.Contains(message.Body, "http://localhost/unlock?token=") {
+			unlockMails = append(unlockMails, message)
+		}
+	}
+	if len(unlockMails) != 1 || unlockMails[0].To != "alice@example.com" {
+		t.Fatalf("unlock mails = %+v, want one to alice", unlockMails)
+	}
+	_, after, _ := strings.Cut(unlockMails[0].Body, "http://localhost/unlock?token=")
+	unlockToken, _, _ := strings.Cut(after, "\n")
+
+	err = s.UnlockByToken(context.Background(), unlockToken)
+	if err != nil {
+		t.Fatalf("UnlockByToken: %v", err)
+	}
+	err = signInAs(s, "alice", "correct horse battery staple", "10.0.0.2")
+	if err != nil {
+		t.Fatalf("SignIn after unlocking: %v", err)
+	}
+
+	err = s.UnlockByToken(context.Background(), unlockToken)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("reused unlock token error = %v, want ErrUnauthorized", err)
+	}
+}
+
+func TestUnlockUserRequiresAdmin(t *testing.T) {
+	s, _ := newLockoutService(t, LockoutConfig{
+		UserThreshold:   1,
+		IPThreshold:     100,
+		BaseDelay:       time.Millisecond,
+		MaxDelay:        time.Millisecond,
+		LockoutDuration: time.Hour,
+		Window:          time.Hour,
+	})
+	signUp(t, s, "alice")
+	ctx := context.Background()
+
+	err := signInAs(s, "alice", "wrong", "10.0.0.1")
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("SignIn error = %v, want ErrUnauthorized", err)
+	}
+
+	user := model.User{ID: "user", Roles: []string{model.RoleUser}}
+	err = s.UnlockUser(ctx, model.Identity{User: user}, "alice")
+	if !errors.Is(err, ErrForbidden) {
+		t.Fatalf("UnlockUser by a user error = %v, want ErrForbidden", err)
+	}
+	err = signInAs(s, "alice", "correct horse battery staple", "10.0.0.2")
+	if !errors.Is(err, ErrTooManyRequests) {
+		t.Fatalf("SignIn after a refused unlock error = %v, want ErrTooManyRequests", err)
+	}
+
+	admin := model.User{ID: "admin", Roles: []string{model.RoleUser, model.RoleAdmin}}
+	err = s.UnlockUser(ctx, model.Identity{User: admin}, "ALICE")
+	if err != nil {
+		t.Fatalf("UnlockUser by an admin: %v", err)
+	}
+	err = signInAs(s, "alice", "correct horse battery staple", "10.0.0.2")
+	if err != nil {
+		t.Fatalf("SignIn after unlocking: %v", err)
+	}
+}
+
+func TestLoginLocksIP(t *testing.T) {
+	s, _ := newLockoutService(t, LockoutConfig{
+		UserThreshold:   100,
+		IPThreshold:     3,
+		BaseDelay:       time.Millisecond,
+		MaxDelay:        time.Millisecond,
+		LockoutDuration: time.Hour,
+		Window:          time.Hour,
+	})
+	signUp(t, s, "alice")
+
+	// Guessing a different username each time still counts against the IP.
+	for _, username := range []string{"bob", "carol", "dave"} {
+		err := signInAs(s, username, "wrong", "10.0.0.1")
+		if !errors.Is(err, ErrUnauthorized) {
+			t.Fatalf("SignIn(%s) error = %v, want ErrUnauthorized", username, err)
+		}
+		waitForDelay()
+	}
+
+	err := signInAs(s, "alice", "correct horse battery staple", "10.0.0.1")
+	if !errors.Is(err, ErrTooManyRequests) {
+		t.Fatalf("SignIn from a locked IP error = %v, want ErrTooManyRequests", err)
+	}
+	err = signInAs(s, "alice", "correct horse battery staple", "10.0.0.2")
+	if err != nil {
+		t.Fatalf("SignIn from another IP: %v", err)
+	}
+}
@@ -5,125 +5,353 @@ import (
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"github.com/redis/go-redis/v9"
+	"github.com/sillamilla/user_microservice/internal/mailer"
 	"github.com/sillamilla/user_microservice/internal/users/Mongo_storage"
 	"github.com/sillamilla/user_microservice/internal/users/Redis_storage"
 	"github.com/sillamilla/user_microservice/internal/users/model"
 	"github.com/sillamilla/user_microservice/internal/users/service/helper"
+	"github.com/sillamilla/user_microservice/internal/users/token"
+	"github.com/sillamilla/user_microservice/internal/users/validation"
 	"go.mongodb.org/mongo-driver/mongo"
+	"log"
+	"net/mail"
+	"net/url"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 type Service interface {
-	SignUp(ctx context.Context, input model.Input) (model.User, error)
-	SignIn(ctx context.Context, input model.Input) (model.User, error)
+	SignUp(ctx context.Context, input model.Input, client model.Client) (model.Auth, error)
+	SignIn(ctx context.Context, input model.Input, client model.Client) (model.Auth, error)
+	Refresh(ctx context.Context, refreshToken string) (model.Tokens, error)
 
-	Logout(ctx context.Context, session string) error
+	Logout(ctx context.Context, identity model.Identity) error
+	Authenticate(ctx context.Context, credential string) (model.Identity, error)
 
-	GetBySession(ctx context.Context, session string) (model.User, error)
-	UpsertSessions(ctx context.Context, id string) (string, error)
-	GetSession(ctx context.Context, id string) (string, error)
+	GetBySession(ctx context.Context, session string) (model.SelfUser, error)
+	UpsertSessions(ctx context.Context, id string, client model.Client) (model.Session, string, error)
+	GetSession(ctx context.Context, session string) (model.Session, error)
+	ListSessions(ctx context.Context, identity model.Identity) ([]model.Session, error)
+	RevokeSession(ctx context.Context, identity model.Identity, sessionID string) error
+	RevokeOtherSessions(ctx context.Context, identity model.Identity) error
+	ReconcileSessions(ctx context.Context) (ReconcileResult, error)
 
-	EditProfile(ctx context.Context, id string, input model.UpdateUser) error
-	EditPassword(ctx context.Context, id string, input model.ChangePassword) error
+	EditProfile(ctx context.Context, id string, input model.UpdateUser, version int64) error
+	PatchProfile(ctx context.Context, id string, input model.PatchUser, version int64) (model.SelfUser, error)
+	EditPassword(ctx context.Context, id string, input model.ChangePassword, version int64) error
+	ForgotPassword(ctx context.Context, input model.ForgotPassword) error
+	VerifyEmail(ctx context.Context, verificationToken string) error
+	ResendVerification(ctx context.Context, identity model.Identity) error
 
-	GetByID(ctx context.Context, id string) (model.User, error)
-	GetByUsername(ctx context.Context, username string) (model.User, error)
+	SignInSecondFactor(ctx context.Context, input model.SecondFactor, client model.Client) (model.Auth, error)
+	UnlockByToken(ctx context.Context, unlockToken string) error
+	UnlockUser(ctx context.Context, identity model.Identity, username string) error
+	EnrollTOTP(ctx context.Context, identity model.Identity) (model.TOTPEnrollment, error)
+	ConfirmTOTP(ctx context.Context, identity model.Identity, input model.TOTPCode) ([]string, error)
+	DisableTOTP(ctx context.Context, identity model.Identity, input model.DisableTOTP) error
+	ResetPassword(ctx context.Context, input model.ResetPassword) error
+
+	GetByID(ctx context.Context, id string) (model.UserInfo, error)
+	GetByUsername(ctx context.Context, username string) (model.UserInfo, error)
+	GetUserAsAdmin(ctx context.Context, identity model.Identity, username string) (model.AdminUser, error)
 	SearchByUsername(ctx context.Context, username string) (model.UserInfo, error)
 }
 
+type Config struct {
+	RefreshTTL time.Duration
+	// ResetTTL is how long a password reset token stays valid.
+	ResetTTL time.Duration
+	// ResetURL is the frontend page the reset token is appended to.
+	ResetURL string
+	// VerifyTTL and VerifyURL are the same for email verification links.
+	VerifyTTL time.Duration
+	VerifyURL string
+	Lockout   LockoutConfig
+	// Validation is the username and password policy.
+	Validation validation.Config
+	// Breaches refuses passwords from breach corpora, nil disables the check.
+	Breaches helper.BreachChecker
+	// Hasher hashes new passwords, nil means argon2id with
+	// helper.DefaultArgon2Params.
+	Hasher helper.Hasher
+	// Sessions are the session lifetimes, zero values use the defaults.
+	Sessions SessionConfig
+}
+
 type service struct {
-	re Redis_storage.Storage
-	mo Mongo_storage.Storage
+	re        Redis_storage.Storage
+	mo        Mongo_storage.Storage
+	tokens    *token.Manager
+	mailer    mailer.Mailer
+	validator *validation.Validator
+	cfg       Config
+	// dummyHash is verified for sign-ins of unknown users, so they take as
+	// long as a wrong password.
+	dummyHash string
 }
 
-func New(re Redis_storage.Storage, mo Mongo_storage.Storage) Service {
+func New(re Redis_storage.Storage, mo Mongo_storage.Storage, tokens *token.Manager, mailer mailer.Mailer, cfg Config) Service {
+	if cfg.Hasher == nil {
+		cfg.Hasher, _ = helper.NewHasher(helper.HasherConfig{Algorithm: helper.Argon2id, Argon2: helper.DefaultArgon2Params})
+	}
+	if cfg.Sessions.Lifetime == 0 {
+		cfg.Sessions.Lifetime = defaultSessionLifetime
+	}
+	if cfg.Sessions.IdleTimeout == 0 {
+		cfg.Sessions.IdleTimeout = defaultSessionIdleTimeout
+	}
+	if cfg.Sessions.TouchInterval == 0 {
+		cfg.Sessions.TouchInterval = defaultSessionTouchInterval
+	}
+
+	// The hash of a random password no one can know, made with the current
+	// parameters so verifying it costs what verifying a real one does.
+	dummyHash, err := cfg.Hasher.Hash(uuid.NewString())
+	if err != nil {
+		log.Printf("service.New: hash the dummy password: %v", err)
+	}
+
 	return &service{
-		re: re,
-		mo: mo,
+		re:        re,
+		mo:        mo,
+		tokens:    tokens,
+		mailer:    mailer,
+		validator: validation.New(cfg.Validation),
+		cfg:       cfg,
+		dummyHash: dummyHash,
 	}
 }
 
-func (s *service) SignUp(ctx context.Context, input model.Input) (model.User, error) {
-	user, err := s.GetByUsername(ctx, input.Username)
-	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
-		return model.User{}, errors.Wrap(err, "service.SignUp.GetByUsername")
+func (s *service) SignUp(ctx context.Context, input model.Input, client model.Client) (model.Auth, error) {
+	input.Username = strings.TrimSpace(input.Username)
+	input.Email = strings.TrimSpace(input.Email)
+
+	var fields fieldErrors
+	fields.add(s.validator.Username(input.Username))
+	fields.add(validateEmail(input.Email))
+	fields.add(s.validator.Password(input.Password, input.Username, input.Email))
+	err := newValidationError(fields)
+	if err != nil {
+		return model.Auth{}, err
 	}
-	if user.Username != "" {
-		return model.User{}, errors.New("Username already taken")
+
+	err = s.checkBreached("password", input.Password)
+	if err != nil {
+		return model.Auth{}, errors.Wrap(err, "service.SignUp.checkBreached")
 	}
 
-	password, err := helper.HashPassword(input.Password)
+	err = s.checkEmailAvailable(ctx, "", input.Email)
 	if err != nil {
-		return model.User{}, errors.Wrap(err, "service.SignUp.HashPassword")
+		return model.Auth{}, errors.Wrap(err, "service.SignUp.checkEmailAvailable")
 	}
-	input.Password = password
 
-	id := uuid.NewString()
-	session, err := s.UpsertSessions(ctx, id)
+	password, err := s.hashPassword("password", input.Password)
 	if err != nil {
-		return model.User{}, errors.Wrap(err, "service.SignUp.UpsertSessions")
+		return model.Auth{}, errors.Wrap(err, "service.SignUp.hashPassword")
 	}
-	//todo dont work upsert session
+	input.Password = password
 
-	newUser := model.UserFromInput(id, input, session, time.Now())
+	newUser := model.UserFromInput(uuid.NewString(), input, time.Now())
 	err = s.mo.SignUp(ctx, newUser)
+	if mongo.IsDuplicateKeyError(err) {
+		return model.Auth{}, duplicateError(err)
+	} else if err != nil {
+		return model.Auth{}, errors.Wrap(err, "service.SignUp")
+	}
+
+	err = s.sendVerification(ctx, newUser)
 	if err != nil {
-		return model.User{}, errors.Wrap(err, "service.SignUp")
+		log.Printf("service.SignUp.sendVerification: user %s: %v", newUser.ID, err)
 	}
 
-	context.WithValue(ctx, "user", user)
+	auth, err := s.completeSignIn(ctx, newUser, client)
+	if err != nil {
+		return model.Auth{}, errors.Wrap(err, "service.SignUp.completeSignIn")
+	}
 
-	return user, nil
+	return auth, nil
 }
 
-func (s *service) SignIn(ctx context.Context, input model.Input) (model.User, error) {
-	user, err := s.GetByUsername(ctx, input.Username)
-	if errors.Is(err, mongo.ErrNoDocuments) {
-		return model.User{}, errors.New("User not found")
+func (s *service) SignIn(ctx context.Context, input model.Input, client model.Client) (model.Auth, error) {
+	err := s.checkLoginLock(ctx, input.Username, client.IP)
+	if err != nil {
+		return model.Auth{}, errors.Wrap(err, "service.SignIn.checkLoginLock")
+	}
+
+	// An unknown username fails like a wrong password, and takes as long,
+	// so responses do not tell which usernames exist.
+	user, err := s.getUserByUsername(ctx, input.Username)
+	if errors.Is(err, ErrNotFound) {
+		_, _ = s.cfg.Hasher.Verify(s.dummyHash, input.Password)
+
+		lockErr := s.registerLoginFailure(ctx, model.User{}, input.Username, client.IP)
+		if lockErr != nil {
+			return model.Auth{}, errors.Wrap(lockErr, "service.SignIn.registerLoginFailure")
+		}
+
+		return model.Auth{}, newError(ErrUnauthorized, "Invalid username or password")
 	} else if err != nil {
-		return model.User{}, errors.Wrap(err, "service.SignIn.GetByUsername")
+		return model.Auth{}, errors.Wrap(err, "service.SignIn.getUserByUsername")
 	}
 
-	err = helper.ComparePassword(user.Password, input.Password)
+	ok, err := s.cfg.Hasher.Verify(user.Password, input.Password)
 	if err != nil {
-		return model.User{}, errors.New("Invalid password")
+		return model.Auth{}, errors.Wrap(err, "service.SignIn.Verify")
+	}
+	if !ok {
+		err = s.registerLoginFailure(ctx, user, input.Username, client.IP)
+		if err != nil {
+			return model.Auth{}, errors.Wrap(err, "service.SignIn.registerLoginFailure")
+		}
+
+		return model.Auth{}, newError(ErrUnauthorized, "Invalid username or password")
 	}
 
+	if s.cfg.Hasher.NeedsRehash(user.Password) {
+		user.Password = s.rehashPassword(ctx, user, input.Password)
+	}
 	input.Password = user.Password
 
 	signUser, err := s.mo.SignIn(ctx, input)
 	if err != nil {
-		return model.User{}, errors.Wrap(err, "service.SignIn")
+		return model.Auth{}, errors.Wrap(err, "service.SignIn")
+	}
+
+	if signUser.TOTPEnabled {
+		challenge, err := s.newSignInChallenge(ctx, signUser.ID)
+		if err != nil {
+			return model.Auth{}, errors.Wrap(err, "service.SignIn.newSignInChallenge")
+		}
+
+		return model.Auth{Challenge: challenge}, nil
+	}
+
+	auth, err := s.completeSignIn(ctx, signUser, client)
+	if err != nil {
+		return model.Auth{}, errors.Wrap(err, "service.SignIn.completeSignIn")
+	}
+
+	return auth, nil
+}
+
+// completeSignIn opens a new session and issues tokens once every factor has
+// been checked. The session the client came with, if any, is ended.
+func (s *service) completeSignIn(ctx context.Context, user model.User, client model.Client) (model.Auth, error) {
+	err := s.resetLoginFailures(ctx, user.Username, client.IP)
+	if err != nil {
+		return model.Auth{}, errors.Wrap(err, "resetLoginFailures")
 	}
 
-	err = s.re.UpsertSession(ctx, signUser.ID, signUser.Session)
+	err = s.endPresentedSession(ctx, client.Session)
 	if err != nil {
-		return model.User{}, errors.Wrap(err, "service.SignIn.UpsertSession")
+		return model.Auth{}, errors.Wrap(err, "endPresentedSession")
 	}
 
-	context.WithValue(ctx, "user", signUser)
+	session, plain, err := s.UpsertSessions(ctx, user.ID, client)
+	if err != nil {
+		return model.Auth{}, errors.Wrap(err, "UpsertSessions")
+	}
+	user.Sessions = append(user.Sessions, session)
 
-	return signUser, nil
+	// The family is the session, so ending the session can revoke every
+	// refresh token descended from this sign-in.
+	tokens, err := s.issueTokens(ctx, user, session.ID)
+	if err != nil {
+		return model.Auth{}, errors.Wrap(err, "issueTokens")
+	}
+
+	return model.Auth{User: model.SelfFromUser(user), Session: plain, Tokens: tokens}, nil
 }
 
-func (s *service) EditProfile(ctx context.Context, id string, input model.UpdateUser) error {
-	user, err := s.GetByID(ctx, id)
+// Refresh exchanges a refresh token for a new access and refresh token pair.
+// Every refresh token can be used once; presenting a used token again revokes
+// all tokens descended from the same sign-in.
+func (s *service) Refresh(ctx context.Context, refreshToken string) (model.Tokens, error) {
+	stored, err := s.re.GetRefreshToken(ctx, token.Hash(refreshToken))
+	if errors.Is(err, redis.Nil) {
+		return model.Tokens{}, newError(ErrUnauthorized, "Invalid refresh token")
+	} else if err != nil {
+		return model.Tokens{}, errors.Wrap(err, "service.Refresh.GetRefreshToken")
+	}
+
+	active, err := s.re.RefreshFamilyActive(ctx, stored.Family)
+	if err != nil {
+		return model.Tokens{}, errors.Wrap(err, "service.Refresh.RefreshFamilyActive")
+	}
+	if !active {
+		return model.Tokens{}, newError(ErrUnauthorized, "Refresh token revoked")
+	}
+
+	first, err := s.re.UseRefreshToken(ctx, stored)
+	if err != nil {
+		return model.Tokens{}, errors.Wrap(err, "service.Refresh.UseRefreshToken")
+	}
+	if !first {
+		err = s.re.RevokeRefreshFamily(ctx, stored.Family)
+		if err != nil {
+			return model.Tokens{}, errors.Wrap(err, "service.Refresh.RevokeRefreshFamily")
+		}
+
+		return model.Tokens{}, newError(ErrUnauthorized, "Refresh token reuse detected")
+	}
+
+	user, err := s.getUser(ctx, stored.UserID)
 	if err != nil {
-		return errors.Wrap(err, "service.EditProfile.GetByID")
+		return model.Tokens{}, errors.Wrap(err, "service.Refresh.getUser")
 	}
-	if user == (model.User{}) {
-		return errors.New("User not found")
+
+	tokens, err := s.issueTokens(ctx, user, stored.Family)
+	if err != nil {
+		return model.Tokens{}, errors.Wrap(err, "service.Refresh.issueTokens")
 	}
 
-	searchUser, err := s.GetByUsername(ctx, input.Username)
-	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
-		return errors.Wrap(err, "service.EditProfile.GetByUsername")
+	return tokens, nil
+}
+
+func (s *service) issueTokens(ctx context.Context, user model.User, family string) (model.Tokens, error) {
+	roles := user.Roles
+	if len(roles) == 0 {
+		roles = []string{model.RoleUser}
 	}
-	if searchUser.Username != "" {
-		return errors.New("Username is already taken")
+
+	access, expiresAt, err := s.tokens.Issue(user.ID, user.Username, roles)
+	if err != nil {
+		return model.Tokens{}, err
 	}
 
-	err = s.mo.EditProfile(ctx, id, input)
+	refresh, hash, err := token.NewOpaque()
+	if err != nil {
+		return model.Tokens{}, err
+	}
+
+	err = s.re.SaveRefreshToken(ctx, model.RefreshToken{
+		Hash:      hash,
+		UserID:    user.ID,
+		Family:    family,
+		ExpiresAt: time.Now().Add(s.cfg.RefreshTTL),
+	})
+	if err != nil {
+		return model.Tokens{}, err
+	}
+
+	return model.Tokens{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresAt:    expiresAt,
+	}, nil
+}
+
+// EditProfile replaces every profile field, fields missing from input are
+// cleared.
+func (s *service) EditProfile(ctx context.Context, id string, input model.UpdateUser, version int64) error {
+	_, err := s.PatchProfile(ctx, id, model.PatchUser{
+		Username: &input.Username,
+		Email:    &input.Email,
+		Bio:      &input.Bio,
+		Icon:     &input.Icon,
+	}, version)
 	if err != nil {
 		return errors.Wrap(err, "service.EditProfile")
 	}
@@ -131,36 +359,420 @@ func (s *service) EditProfile(ctx context.Context, id string, input model.Update
 	return nil
 }
 
-func (s *service) EditPassword(ctx context.Context, id string, input model.ChangePassword) error {
-	user, err := s.GetByID(ctx, id)
+// PatchProfile updates only the fields set in input. The username uniqueness
+// check and email re-verification only run when those fields really change.
+// version is the version the client last read, or model.AnyVersion.
+func (s *service) PatchProfile(ctx context.Context, id string, input model.PatchUser, version int64) (model.SelfUser, error) {
+	user, err := s.getUser(ctx, id)
+	if err != nil {
+		return model.SelfUser{}, errors.Wrap(err, "service.PatchProfile.getUser")
+	}
+	if version != model.AnyVersion && version != user.Version {
+		return model.SelfUser{}, newError(ErrPreconditionFailed, "User was modified by another request")
+	}
+
+	err = s.validatePatch(&input, user)
+	if err != nil {
+		return model.SelfUser{}, err
+	}
+
+	if input.Email != nil && *input.Email == user.Email {
+		input.Email = nil
+	}
+	if input.Email != nil {
+		err = s.checkEmailAvailable(ctx, id, *input.Email)
+		if err != nil {
+			return model.SelfUser{}, errors.Wrap(err, "service.PatchProfile.checkEmailAvailable")
+		}
+	}
+
+	err = s.mo.EditProfile(ctx, id, input, version)
+	if mongo.IsDuplicateKeyError(err) {
+		return model.SelfUser{}, duplicateError(err)
+	} else if errors.Is(err, Mongo_storage.ErrVersionConflict) {
+		return model.SelfUser{}, newError(ErrPreconditionFailed, "User was modified by another request")
+	} else if err != nil {
+		return model.SelfUser{}, errors.Wrap(err, "service.PatchProfile")
+	}
+
+	if input.Email != nil {
+		err = s.mo.SetEmailVerified(ctx, id, *input.Email, nil)
+		if err != nil {
+			return model.SelfUser{}, errors.Wrap(err, "service.PatchProfile.SetEmailVerified")
+		}
+	}
+
+	updated, err := s.getUser(ctx, id)
+	if err != nil {
+		return model.SelfUser{}, errors.Wrap(err, "service.PatchProfile.getUser")
+	}
+
+	// The update is stored by now, a lost mail is fixed by resending it.
+	if input.Email != nil && *input.Email != "" {
+		err = s.sendVerification(ctx, updated)
+		if err != nil {
+			log.Printf("service.PatchProfile.sendVerification: user %s: %v", id, err)
+		}
+	}
+
+	return model.SelfFromUser(updated), nil
+}
+
+const (
+	maxBioLength  = 1000
+	maxIconLength = 2048
+)
+
+// validatePatch trims and checks every field present in input. An unchanged
+// username is dropped from input instead of checked, so users whose name
+// predates the current policy can still edit the rest of their profile.
+func (s *service) validatePatch(input *model.PatchUser, user model.User) error {
+	var fields fieldErrors
+
+	if input.Username != nil {
+		username := strings.TrimSpace(*input.Username)
+		if username == user.Username {
+			input.Username = nil
+		} else {
+			fields.add(s.validator.Username(username))
+			input.Username = &username
+		}
+	}
+
+	if input.Email != nil {
+		email := strings.TrimSpace(*input.Email)
+		if email != "" {
+			fields.add(validateEmail(email))
+		}
+		input.Email = &email
+	}
+
+	if input.Bio != nil && utf8.RuneCountInString(*input.Bio) > maxBioLength {
+		fields.add(&validation.FieldError{Field: "bio", Code: validation.CodeTooLong, Message: "Bio is too long"})
+	}
+
+	if input.Icon != nil {
+		icon := strings.TrimSpace(*input.Icon)
+		if len(icon) > maxIconLength {
+			fields.add(&validation.FieldError{Field: "icon", Code: validation.CodeTooLong, Message: "Icon URL is too long"})
+		} else if icon != "" {
+			u, err := url.Parse(icon)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				fields.add(&validation.FieldError{Field: "icon", Code: validation.CodeInvalid, Message: "Icon must be an http or https URL"})
+			}
+		}
+		input.Icon = &icon
+	}
+
+	return newValidationError(fields)
+}
+
+func (s *service) VerifyEmail(ctx context.Context, verificationToken string) error {
+	verification, err := s.re.ConsumeEmailVerification(ctx, token.Hash(verificationToken))
+	if errors.Is(err, redis.Nil) {
+		return newError(ErrUnauthorized, "Invalid or expired verification token")
+	} else if err != nil {
+		return errors.Wrap(err, "service.VerifyEmail.ConsumeEmailVerification")
+	}
+
+	now := time.Now()
+	err = s.mo.SetEmailVerified(ctx, verification.UserID, verification.Email, &now)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return newError(ErrConflict, "Email has changed since the verification link was sent")
+	} else if err != nil {
+		return errors.Wrap(err, "service.VerifyEmail.SetEmailVerified")
+	}
+
+	return nil
+}
+
+func (s *service) ResendVerification(ctx context.Context, identity model.Identity) error {
+	if identity.User.Email == "" {
+		return newError(ErrValidation, "No email address on the account")
+	}
+	if identity.User.EmailVerifiedAt != nil {
+		return newError(ErrConflict, "Email already verified")
+	}
+
+	err := s.sendVerification(ctx, identity.User)
+	if err != nil {
+		return errors.Wrap(err, "service.ResendVerification")
+	}
+
+	return nil
+}
+
+func (s *service) sendVerification(ctx context.Context, user model.User) error {
+	plain, hash, err := token.NewOpaque()
+	if err != nil {
+		return err
+	}
+
+	err = s.re.SaveEmailVerification(ctx, hash, model.EmailVerification{UserID: user.ID, Email: user.Email}, s.cfg.VerifyTTL)
+	if err != nil {
+		return err
+	}
+
+	err = s.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Confirm your MusicHub email address",
+		Body: "Hi " + user.Username + ",\n\n" +
+			"Please confirm your email address by opening the link below. It expires in " + s.cfg.VerifyTTL.String() + ".\n\n" +
+			s.cfg.VerifyURL + plain,
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// checkEmailAvailable fails with a conflict when another user than id already
+// uses email, compared case-insensitively.
+func (s *service) checkEmailAvailable(ctx context.Context, id string, email string) error {
+	if email == "" {
+		return nil
+	}
+
+	owner, err := s.mo.GetByEmail(ctx, email)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if owner.ID != id {
+		return newError(ErrConflict, "Email already taken")
+	}
+
+	return nil
+}
+
+func validateEmail(email string) *validation.FieldError {
+	if email == "" {
+		return &validation.FieldError{Field: "email", Code: validation.CodeRequired, Message: "Email is required"}
+	}
+
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return &validation.FieldError{Field: "email", Code: validation.CodeInvalid, Message: "Invalid email address"}
+	}
+
+	return nil
+}
+
+// checkBreached fails with a validation error on field when password is
+// found in the breach data.
+func (s *service) checkBreached(field string, password string) error {
+	breached, err := helper.IsBreached(s.cfg.Breaches, password)
 	if err != nil {
-		return errors.Wrap(err, "service.EditPassword.GetByID")
+		return err
 	}
+	if breached {
+		return newValidationError([]validation.FieldError{{
+			Field:   field,
+			Code:    validation.CodeBreached,
+			Message: "This password appeared in a data breach, choose a different one",
+		}})
+	}
+
+	return nil
+}
+
+// hashPassword hashes a new password. A password too long for the
+// configured algorithm is reported as a validation error on field.
+func (s *service) hashPassword(field string, password string) (string, error) {
+	hash, err := s.cfg.Hasher.Hash(password)
+	if errors.Is(err, helper.ErrPasswordTooLong) {
+		return "", newValidationError([]validation.FieldError{{
+			Field:   field,
+			Code:    validation.CodeTooLong,
+			Message: "Password is too long",
+		}})
+	} else if err != nil {
+		return "", err
+	}
+
+	return hash, nil
+}
+
+// rehashPassword replaces the outdated hash of user with one made with the
+// current settings and returns the hash now stored. The update is bound to
+// the version that was read, so it never overwrites a password changed in
+// the meantime. When another sign-in rehashed first, its hash is returned
+// if password still matches it. Other failures keep the old hash and are
+// only logged.
+func (s *service) rehashPassword(ctx context.Context, user model.User, password string) string {
+	hash, err := s.cfg.Hasher.Hash(password)
+	if err != nil {
+		log.Printf("service.rehashPassword: user %s: %v", user.ID, err)
+		return user.Password
+	}
+
+	err = s.mo.EditPassword(ctx, user.ID, hash, user.Version)
+	if errors.Is(err, Mongo_storage.ErrVersionConflict) {
+		current, err := s.mo.GetByID(ctx, user.ID)
+		if err != nil {
+			log.Printf("service.rehashPassword.GetByID: user %s: %v", user.ID, err)
+			return user.Password
+		}
+
+		ok, err := s.cfg.Hasher.Verify(current.Password, password)
+		if err == nil && ok {
+			return current.Password
+		}
+		return user.Password
+	} else if err != nil {
+		log.Printf("service.rehashPassword: user %s: %v", user.ID, err)
+		return user.Password
+	}
+
+	return hash
+}
+
+// validateNewPassword checks a password change, reported on the "new" field.
+func (s *service) validateNewPassword(password string, confirm string, userInputs ...string) error {
+	var fields fieldErrors
 
-	err = helper.ComparePassword(user.Password, input.Old)
+	err := s.validator.Password(password, userInputs...)
 	if err != nil {
-		return errors.New("Invalid password")
+		err.Field = "new"
+		fields.add(err)
 	}
+	if password != confirm {
+		fields.add(&validation.FieldError{Field: "confirm_new", Code: validation.CodeMismatch, Message: "New password and confirm new password do not match"})
+	}
+
+	return newValidationError(fields)
+}
 
-	if input.New != input.ConfirmNew {
-		return errors.New("New password and confirm new password do not match")
+func (s *service) EditPassword(ctx context.Context, id string, input model.ChangePassword, version int64) error {
+	user, err := s.getUser(ctx, id)
+	if err != nil {
+		return errors.Wrap(err, "service.EditPassword.getUser")
+	}
+	if version != model.AnyVersion && version != user.Version {
+		return newError(ErrPreconditionFailed, "User was modified by another request")
 	}
 
-	password, err := helper.HashPassword(input.New)
+	ok, err := s.cfg.Hasher.Verify(user.Password, input.Old)
 	if err != nil {
-		return errors.Wrap(err, "service.EditPassword.HashPassword")
+		return errors.Wrap(err, "service.EditPassword.Verify")
+	}
+	if !ok {
+		return newError(ErrUnauthorized, "Invalid password")
 	}
 
-	err = s.mo.EditPassword(ctx, id, password)
+	err = s.validateNewPassword(input.New, input.ConfirmNew, user.Username, user.Email)
 	if err != nil {
+		return err
+	}
+
+	err = s.checkBreached("new", input.New)
+	if err != nil {
+		return errors.Wrap(err, "service.EditPassword.checkBreached")
+	}
+
+	password, err := s.hashPassword("new", input.New)
+	if err != nil {
+		return errors.Wrap(err, "service.EditPassword.hashPassword")
+	}
+
+	err = s.mo.EditPassword(ctx, id, password, version)
+	if errors.Is(err, Mongo_storage.ErrVersionConflict) {
+		return newError(ErrPreconditionFailed, "User was modified by another request")
+	} else if err != nil {
 		return errors.Wrap(err, "service.EditPassword")
 	}
 
 	return nil
 }
 
-func (s *service) Logout(ctx context.Context, id string) error {
-	err := s.re.Logout(ctx, id)
+// ForgotPassword mails a single-use reset link. It succeeds for unknown
+// addresses as well so the endpoint can not be used to probe for accounts.
+func (s *service) ForgotPassword(ctx context.Context, input model.ForgotPassword) error {
+	if input.Email == "" {
+		return newError(ErrValidation, "Email is required")
+	}
+
+	user, err := s.mo.GetByEmail(ctx, input.Email)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "service.ForgotPassword.GetByEmail")
+	}
+
+	plain, hash, err := token.NewOpaque()
+	if err != nil {
+		return errors.Wrap(err, "service.ForgotPassword.NewOpaque")
+	}
+
+	err = s.re.SavePasswordReset(ctx, hash, user.ID, s.cfg.ResetTTL)
+	if err != nil {
+		return errors.Wrap(err, "service.ForgotPassword.SavePasswordReset")
+	}
+
+	err = s.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your MusicHub password",
+		Body: "Hi " + user.Username + ",\n\n" +
+			"Use the link below to choose a new password. It expires in " + s.cfg.ResetTTL.String() + ".\n\n" +
+			s.cfg.ResetURL + plain + "\n\n" +
+			"If you did not ask for a reset you can ignore this email.",
+	})
+	if err != nil {
+		return errors.Wrap(err, "service.ForgotPassword.Send")
+	}
+
+	return nil
+}
+
+// ResetPassword sets a new password using a token from ForgotPassword and
+// signs the user out everywhere.
+func (s *service) ResetPassword(ctx context.Context, input model.ResetPassword) error {
+	err := s.validateNewPassword(input.New, input.ConfirmNew)
+	if err != nil {
+		return err
+	}
+
+	err = s.checkBreached("new", input.New)
+	if err != nil {
+		return errors.Wrap(err, "service.ResetPassword.checkBreached")
+	}
+
+	// Hashed before the token is used up, a password the hasher refuses
+	// leaves the token valid for another try.
+	password, err := s.hashPassword("new", input.New)
+	if err != nil {
+		return errors.Wrap(err, "service.ResetPassword.hashPassword")
+	}
+
+	userID, err := s.re.ConsumePasswordReset(ctx, token.Hash(input.Token))
+	if errors.Is(err, redis.Nil) {
+		return newError(ErrUnauthorized, "Invalid or expired reset token")
+	} else if err != nil {
+		return errors.Wrap(err, "service.ResetPassword.ConsumePasswordReset")
+	}
+
+	err = s.mo.EditPassword(ctx, userID, password, model.AnyVersion)
+	if err != nil {
+		return errors.Wrap(err, "service.ResetPassword.EditPassword")
+	}
+
+	err = s.revokeAllSessions(ctx, userID)
+	if err != nil {
+		return errors.Wrap(err, "service.ResetPassword.revokeAllSessions")
+	}
+
+	return nil
+}
+
+// Logout ends the session of the caller only, other devices stay signed in.
+func (s *service) Logout(ctx context.Context, identity model.Identity) error {
+	if identity.Session.Token == "" {
+		return newError(ErrUnauthorized, "Session required")
+	}
+
+	err := s.deleteSession(ctx, identity.Session)
 	if err != nil {
 		return errors.Wrap(err, "service.Logout")
 	}
@@ -168,23 +780,75 @@ func (s *service) Logout(ctx context.Context, id string) error {
 	return nil
 }
 
-func (s *service) GetByID(ctx context.Context, id string) (model.User, error) {
+// GetByID returns the public view of a user. It reads nothing else, so a
+// cached storage can serve it.
+func (s *service) GetByID(ctx context.Context, id string) (model.UserInfo, error) {
+	byID, err := s.mo.GetPublicByID(ctx, id)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return model.UserInfo{}, newError(ErrNotFound, "User not found")
+	} else if err != nil {
+		return model.UserInfo{}, errors.Wrap(err, "service.GetByID")
+	}
+
+	return byID, nil
+}
+
+// getUser returns the whole stored user, it must not leave the service.
+func (s *service) getUser(ctx context.Context, id string) (model.User, error) {
 	byID, err := s.mo.GetByID(ctx, id)
 	if errors.Is(err, mongo.ErrNoDocuments) {
-		return model.User{}, errors.New("User not found")
+		return model.User{}, newError(ErrNotFound, "User not found")
 	} else if err != nil {
-		return model.User{}, errors.Wrap(err, "service.GetByID")
+		return model.User{}, errors.Wrap(err, "service.getUser")
 	}
 
 	return byID, nil
 }
 
-func (s *service) GetByUsername(ctx context.Context, username string) (model.User, error) {
+// duplicateError turns a duplicate key error from the storage into the
+// conflict the client sees. Usernames are only unique because of the storage
+// index, so this is the one place a taken username is reported.
+func duplicateError(err error) error {
+	if Mongo_storage.IsDuplicateIndex(err, Mongo_storage.UsernameIndex) {
+		return newError(ErrConflict, "Username already taken")
+	}
+
+	return newError(ErrConflict, "Email already taken")
+}
+
+// GetByUsername returns the public view of a user, like GetByID.
+func (s *service) GetByUsername(ctx context.Context, username string) (model.UserInfo, error) {
+	byUsername, err := s.mo.SearchByUsername(ctx, username)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return model.UserInfo{}, newError(ErrNotFound, "User not found")
+	} else if err != nil {
+		return model.UserInfo{}, errors.Wrap(err, "service.GetByUsername")
+	}
+
+	return byUsername, nil
+}
+
+// GetUserAsAdmin returns the admin view of a user, with session metadata and
+// two-factor state, to callers with the admin role.
+func (s *service) GetUserAsAdmin(ctx context.Context, identity model.Identity, username string) (model.AdminUser, error) {
+	if !hasRole(identity.User, model.RoleAdmin) {
+		return model.AdminUser{}, newError(ErrForbidden, "Admin role required")
+	}
+
+	user, err := s.getUserByUsername(ctx, username)
+	if err != nil {
+		return model.AdminUser{}, errors.Wrap(err, "service.GetUserAsAdmin")
+	}
+
+	return model.AdminFromUser(user), nil
+}
+
+func (s *service) getUserByUsername(ctx context.Context, username string) (model.User, error) {
 	byUsername, err := s.mo.GetByUsername(ctx, username)
 	if errors.Is(err, mongo.ErrNoDocuments) {
-		return model.User{}, errors.Wrap(err, "User not found")
+		return model.User{}, newError(ErrNotFound, "User not found")
 	} else if err != nil {
-		return model.User{}, errors.Wrap(err, "service.searchByUsername")
+		return model.User{}, errors.Wrap(err, "service.getUserByUsername")
 	}
 
 	return byUsername, nil
@@ -193,7 +857,7 @@ func (s *service) GetByUsername(ctx context.Context, username string) (model.Use
 func (s *service) SearchByUsername(ctx context.Context, username string) (model.UserInfo, error) {
 	byUsername, err := s.mo.SearchByUsername(ctx, username)
 	if errors.Is(err, mongo.ErrNoDocuments) {
-		return model.UserInfo{}, errors.New("User not found")
+		return model.UserInfo{}, newError(ErrNotFound, "User not found")
 	} else if err != nil {
 		return model.UserInfo{}, errors.Wrap(err, "service.searchByUsername")
 	}
@@ -201,57 +865,193 @@ func (s *service) SearchByUsername(ctx context.Context, username string) (model.
 	return byUsername, nil
 }
 
-func (s *service) UpsertSessions(ctx context.Context, id string) (string, error) {
-	sessionID, err := helper.HashPassword(uuid.New().String())
+// UpsertSessions opens a session for user id. It returns the stored session,
+// which only holds the token digest, and the token itself, which is not kept
+// anywhere and must be handed to the client.
+func (s *service) UpsertSessions(ctx context.Context, id string, client model.Client) (model.Session, string, error) {
+	plain, digest, err := token.NewSession()
+	if err != nil {
+		return model.Session{}, "", errors.Wrap(err, "service.SetSession.NewSession")
+	}
+
+	now := time.Now()
+	session := model.Session{
+		ID:         uuid.NewString(),
+		Token:      digest,
+		UserID:     id,
+		UserAgent:  client.UserAgent,
+		IP:         client.IP,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(s.cfg.Sessions.Lifetime),
+	}
+
+	err = s.saveSession(ctx, session, now)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return model.Session{}, "", newError(ErrNotFound, "User not found")
+	} else if err != nil {
+		return model.Session{}, "", errors.Wrap(err, "service.SetSession")
+	}
+
+	return session, plain, nil
+}
+
+// GetBySession returns the own view of the user holding session.
+func (s *service) GetBySession(ctx context.Context, session string) (model.SelfUser, error) {
+	current, err := s.GetSession(ctx, session)
 	if err != nil {
-		return "", errors.Wrap(err, "service.SetSession.GenerateSessionID")
+		return model.SelfUser{}, errors.Wrap(err, "service.GetBySession.GetSession")
 	}
 
-	err = s.re.UpsertSession(ctx, id, sessionID)
+	user, err := s.getUser(ctx, current.UserID)
 	if err != nil {
-		return "", errors.Wrap(err, "service.SetSession")
+		return model.SelfUser{}, errors.Wrap(err, "service.GetBySession")
 	}
-	//todo перенести
-	err = s.mo.UpsertSession(ctx, id, sessionID)
+
+	return model.SelfFromUser(user), nil
+}
+
+// GetSession resolves a session token and records it as seen, which extends
+// the session. Both stores are keyed by the token digest, so the token is
+// never compared with stored secrets. Redis is checked first, sessions that
+// only survive in Mongo are copied back unless they have expired.
+func (s *service) GetSession(ctx context.Context, session string) (model.Session, error) {
+	if !token.IsSession(session) {
+		return model.Session{}, newError(ErrUnauthorized, "Session not found")
+	}
+	now := time.Now()
+
+	current, err := s.findSession(ctx, token.Hash(session))
 	if err != nil {
-		return "", errors.Wrap(err, "service.SetSession")
+		return model.Session{}, errors.Wrap(err, "service.GetSession.findSession")
+	}
+
+	if s.sessionExpired(current, now) {
+		err = s.deleteSession(ctx, current)
+		if err != nil {
+			return model.Session{}, errors.Wrap(err, "service.GetSession.deleteSession")
+		}
+
+		return model.Session{}, newError(ErrUnauthorized, "Session expired")
 	}
 
-	context.WithValue(ctx, "session", sessionID)
+	current, err = s.touchSession(ctx, current, now)
+	if err != nil {
+		return model.Session{}, errors.Wrap(err, "service.GetSession.touchSession")
+	}
 
-	return sessionID, nil
+	return current, nil
 }
 
-func (s *service) GetBySession(ctx context.Context, session string) (model.User, error) {
-	user, err := s.mo.GetBySession(ctx, session)
-	if errors.Is(err, mongo.ErrNoDocuments) {
-		return model.User{}, errors.New("User not found")
-	} else if err != nil {
-		return model.User{}, errors.Wrap(err, "service.GetBySession")
+// ListSessions lists the live sessions of the caller as Mongo has them, with
+// the latest activity from Redis.
+func (s *service) ListSessions(ctx context.Context, identity model.Identity) ([]model.Session, error) {
+	cached, err := s.re.ListSessions(ctx, identity.User.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "service.ListSessions")
+	}
+	lastSeen := make(map[string]time.Time, len(cached))
+	for _, session := range cached {
+		lastSeen[session.Token] = session.LastSeenAt
 	}
 
-	return user, nil
+	now := time.Now()
+	sessions := []model.Session{}
+	for _, session := range identity.User.Sessions {
+		if seenAt, ok := lastSeen[session.Token]; ok && seenAt.After(session.LastSeenAt) {
+			session.LastSeenAt = seenAt
+		}
+		if s.sessionExpired(session, now) {
+			continue
+		}
+
+		session.Current = session.Token == identity.Session.Token
+		session.Token = ""
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
 }
 
-func (s *service) GetSession(ctx context.Context, id string) (string, error) {
-	session, err := s.re.GetSession(ctx, id)
+func (s *service) RevokeSession(ctx context.Context, identity model.Identity, sessionID string) error {
+	for _, stored := range identity.User.Sessions {
+		if stored.ID != sessionID {
+			continue
+		}
+
+		err := s.deleteSession(ctx, stored)
+		if err != nil {
+			return errors.Wrap(err, "service.RevokeSession")
+		}
+
+		return nil
+	}
+
+	return newError(ErrNotFound, "Session not found")
+}
+
+// RevokeOtherSessions ends every session of the caller except the one used
+// for the request. Callers authenticated with an access token lose all sessions.
+func (s *service) RevokeOtherSessions(ctx context.Context, identity model.Identity) error {
+	err := s.deleteUserSessions(ctx, identity.User.ID, identity.Session.Token)
 	if err != nil {
-		if errors.Is(err, redis.Nil) {
-			user, err := s.GetByID(ctx, id)
-			if err != nil {
-				return "", errors.Wrap(err, "service.GetSession.GetByID")
-			}
+		return errors.Wrap(err, "service.RevokeOtherSessions")
+	}
 
-			err = s.re.UpsertSession(ctx, id, user.Session)
-			if err != nil {
-				return "", errors.Wrap(err, "service.GetSession.UpsertSession")
-			}
+	return nil
+}
 
-			return user.Session, nil
-		} else {
-			return "", errors.Wrap(err, "service.GetSession")
+// Authenticate resolves the credential sent by a client. Session tokens are
+// recognized by their prefix, anything else must be an access token, which is
+// verified locally.
+func (s *service) Authenticate(ctx context.Context, credential string) (model.Identity, error) {
+	if credential == "" {
+		return model.Identity{}, newError(ErrUnauthorized, "Authentication required")
+	}
+
+	if !token.IsSession(credential) {
+		claims, err := s.tokens.Verify(credential)
+		if err != nil {
+			return model.Identity{}, newError(ErrUnauthorized, "Invalid access token")
 		}
+
+		user, err := s.getUser(ctx, claims.Subject)
+		if errors.Is(err, ErrNotFound) {
+			return model.Identity{}, newError(ErrUnauthorized, "Invalid access token")
+		} else if err != nil {
+			return model.Identity{}, errors.Wrap(err, "service.Authenticate.getUser")
+		}
+
+		return model.Identity{User: user}, nil
 	}
 
-	return session, nil
+	session, err := s.GetSession(ctx, credential)
+	if err != nil {
+		return model.Identity{}, errors.Wrap(err, "service.Authenticate.GetSession")
+	}
+
+	user, err := s.getUser(ctx, session.UserID)
+	if errors.Is(err, ErrNotFound) {
+		return model.Identity{}, newError(ErrUnauthorized, "Session not found")
+	} else if err != nil {
+		return model.Identity{}, errors.Wrap(err, "service.Authenticate.getUser")
+	}
+
+	return model.Identity{User: user, Session: session}, nil
+}
+
+// revokeAllSessions signs a user out of every device, including clients that
+// only hold refresh tokens.
+func (s *service) revokeAllSessions(ctx context.Context, userID string) error {
+	err := s.deleteUserSessions(ctx, userID, "")
+	if err != nil {
+		return err
+	}
+
+	err = s.re.RevokeUserRefreshFamilies(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	return nil
 }
@@ -1 +1,1238 @@
 package service
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/sillamilla/user_microservice/internal/mailer"
+	"github.com/sillamilla/user_microservice/internal/users/Mongo_storage"
+	"github.com/sillamilla/user_microservice/internal/users/Redis_storage"
+	"github.com/sillamilla/user_microservice/internal/users/model"
+	"github.com/sillamilla/user_microservice/internal/users/service/helper"
+	"github.com/sillamilla/user_microservice/internal/users/token"
+	"github.com/sillamilla/user_microservice/internal/users/validation"
+	"golang.org/x/crypto/bcrypt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testClient = model.Client{UserAgent: "test", IP: "127.0.0.1"}
+
+// breachList is a BreachChecker over a fixed set of passwords.
+type breachList map[string]bool
+
+func (b breachList) Breached(password string) (bool, error) {
+	return b[password], nil
+}
+
+const breachedPassword = "Tr0ub4dor&3x"
+
+func newTestService(t *testing.T) Service {
+	return newTestServiceWith(t, Mongo_storage.NewMemory())
+}
+
+func newTestServiceWith(t *testing.T, mo Mongo_storage.Storage) Service {
+	return newTestServiceConfig(t, mo, Redis_storage.NewMemory(), testConfig())
+}
+
+func newTestServiceConfig(t *testing.T, mo Mongo_storage.Storage, re Redis_storage.Storage, cfg Config) Service {
+	t.Helper()
+
+	s, _ := newTestServiceMail(t, mo, re, cfg)
+	return s
+}
+
+// newTestServiceMail also returns the mailer, for tests that follow the links
+// the service sends.
+func newTestServiceMail(t *testing.T, mo Mongo_storage.Storage, re Redis_storage.Storage, cfg Config) (Service, *mailer.Memory) {
+	t.Helper()
+
+	tokens, err := token.New(token.Config{
+		Algorithm: token.HS256,
+		Secret:    "test-secret",
+		Issuer:    "test",
+		AccessTTL: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ml := mailer.NewMemory()
+	return New(re, mo, tokens, ml, cfg), ml
+}
+
+// mailedToken returns the token of the last link starting with url that was
+// mailed to to, or fails the test.
+func mailedToken(t *testing.T, ml *mailer.Memory, to string, url string) string {
+	t.Helper()
+
+	messages := ml.Messages()
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].To != to {
+			continue
+		}
+		_, after, found := strings.Cut(messages[i].Body, url)
+		if found {
+			link, _, _ := strings.Cut(after, "\n")
+			return link
+		}
+	}
+	t.Fatalf("no link to %s was mailed to %s", url, to)
+	return ""
+}
+
+func testConfig() Config {
+	return Config{
+		RefreshTTL: time.Hour,
+		ResetTTL:   time.Hour,
+		ResetURL:   "http://localhost/reset",
+		VerifyTTL:  time.Hour,
+		VerifyURL:  "http://localhost/verify",
+		Lockout: LockoutConfig{
+			UserThreshold:   5,
+			IPThreshold:     20,
+			BaseDelay:       time.Millisecond,
+			MaxDelay:        time.Millisecond,
+			LockoutDuration: time.Minute,
+			Window:          time.Hour,
+			UnlockURL:       "http://localhost/unlock",
+		},
+		Breaches: breachList{breachedPassword: true},
+		Hasher:   testHasher,
+	}
+}
+
+// testHasher is argon2id with the cheapest parameters, the defaults would
+// make parallel tests allocate hundreds of MiB.
+var testHasher, _ = helper.NewHasher(helper.HasherConfig{
+	Algorithm: helper.Argon2id,
+	Argon2:    helper.Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1},
+})
+
+func signUp(t *testing.T, s Service, username string) model.Auth {
+	t.Helper()
+
+	auth, err := s.SignUp(context.Background(), model.Input{
+		Username: username,
+		Email:    username + "@example.com",
+		Password: "correct horse battery staple",
+	}, testClient)
+	if err != nil {
+		t.Fatalf("SignUp(%q): %v", username, err)
+	}
+
+	return auth
+}
+
+func TestSignUpAndSignIn(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+
+	signedUp := signUp(t, s, "alice")
+	if signedUp.Session == "" || signedUp.Tokens.AccessToken == "" {
+		t.Fatalf("SignUp returned no credentials: %+v", signedUp)
+	}
+
+	auth, err := s.SignIn(ctx, model.Input{Username: "alice", Password: "correct horse battery staple"}, testClient)
+	if err != nil {
+		t.Fatalf("SignIn: %v", err)
+	}
+
+	for _, credential := range []string{auth.Session, auth.Tokens.AccessToken} {
+		identity, err := s.Authenticate(ctx, credential)
+		if err != nil {
+			t.Fatalf("Authenticate: %v", err)
+		}
+		if identity.User.ID != signedUp.User.ID {
+			t.Fatalf("Authenticate returned user %q, want %q", identity.User.ID, signedUp.User.ID)
+		}
+	}
+}
+
+func TestSignUpDuplicateUsername(t *testing.T) {
+	s := newTestService(t)
+	signUp(t, s, "alice")
+
+	_, err := s.SignUp(context.Background(), model.Input{
+		Username: "alice",
+		Email:    "other@example.com",
+		Password: "correct horse battery staple",
+	}, testClient)
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("SignUp error = %v, want ErrConflict", err)
+	}
+}
+
+func TestSignUpFieldErrors(t *testing.T) {
+	s := newTestService(t)
+
+	_, err := s.SignUp(context.Background(), model.Input{
+		Username: "admin",
+		Email:    "not an email",
+		Password: "password",
+	}, testClient)
+
+	var serviceErr *Error
+	if !errors.As(err, &serviceErr) || serviceErr.Kind != ErrValidation {
+		t.Fatalf("SignUp error = %v, want ErrValidation", err)
+	}
+
+	got := make(map[string]string)
+	for _, field := range serviceErr.Fields {
+		got[field.Field] = field.Code
+	}
+	want := map[string]string{
+		"username": validation.CodeReserved,
+		"email":    validation.CodeInvalid,
+		"password": validation.CodeTooShort,
+	}
+	for field, code := range want {
+		if got[field] != code {
+			t.Errorf("field %s = %q, want %q", field, got[field], code)
+		}
+	}
+}
+
+func TestSignUpBreachedPassword(t *testing.T) {
+	s := newTestService(t)
+
+	_, err := s.SignUp(context.Background(), model.Input{
+		Username: "alice",
+		Email:    "alice@example.com",
+		Password: breachedPassword,
+	}, testClient)
+
+	var serviceErr *Error
+	if !errors.As(err, &serviceErr) || len(serviceErr.Fields) != 1 || serviceErr.Fields[0].Code != validation.CodeBreached {
+		t.Fatalf("SignUp error = %v, want a breached password error", err)
+	}
+}
+
+func TestSignUpConcurrentCaseVariants(t *testing.T) {
+	s := newTestService(t)
+	usernames := []string{"artist", "Artist", "ARTIST", "aRtIsT", "artisT", "ARTist"}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(usernames))
+	for i, username := range usernames {
+		wg.Add(1)
+		go func(i int, username string) {
+			defer wg.Done()
+			_, errs[i] = s.SignUp(context.Background(), model.Input{
+				Username: username,
+				Email:    strconv.Itoa(i) + "@example.com",
+				Password: "correct horse battery staple",
+			}, testClient)
+		}(i, username)
+	}
+	wg.Wait()
+
+	created := 0
+	for i, err := range errs {
+		var serviceErr *Error
+		switch {
+		case err == nil:
+			created++
+		case errors.As(err, &serviceErr) && serviceErr.Kind == ErrConflict && serviceErr.Message == "Username already taken":
+		default:
+			t.Fatalf("SignUp(%q) error = %v, want a username conflict", usernames[i], err)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("%d of %d concurrent sign-ups succeeded, want 1", created, len(usernames))
+	}
+}
+
+func TestPatchProfileTakenUsername(t *testing.T) {
+	s := newTestService(t)
+	signUp(t, s, "alice")
+	bob := signUp(t, s, "bob")
+
+	username := "ALICE"
+	_, err := s.PatchProfile(context.Background(), bob.User.ID, model.PatchUser{Username: &username}, model.AnyVersion)
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("PatchProfile error = %v, want ErrConflict", err)
+	}
+}
+
+func TestPatchProfileBioOnly(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	auth := signUp(t, s, "Alice")
+
+	bio := "hi"
+	updated, err := s.PatchProfile(ctx, auth.User.ID, model.PatchUser{Bio: &bio}, model.AnyVersion)
+	if err != nil {
+		t.Fatalf("PatchProfile: %v", err)
+	}
+	if updated.Bio != bio || updated.Username != "Alice" || updated.Email != "Alice@example.com" {
+		t.Fatalf("PatchProfile of the bio = %+v, want only the bio changed", updated)
+	}
+
+	stored, err := s.GetByUsername(ctx, "alice")
+	if err != nil {
+		t.Fatalf("GetByUsername: %v", err)
+	}
+	if stored.Username != "Alice" || stored.Bio != bio {
+		t.Fatalf("stored user after PatchProfile of the bio = %+v", stored)
+	}
+}
+
+// TestPatchProfileOwnUsername resubmits the caller's username, as a form
+// sending every field does, in several cases. Only the caller holds it, so
+// none of them may conflict.
+func TestPatchProfileOwnUsername(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	auth := signUp(t, s, "alice")
+
+	for _, username := range []string{"alice", "ALICE", "Alice"} {
+		username := username
+		updated, err := s.PatchProfile(ctx, auth.User.ID, model.PatchUser{Username: &username}, model.AnyVersion)
+		if err != nil {
+			t.Fatalf("PatchProfile to %q: %v", username, err)
+		}
+		if updated.Username != username {
+			t.Fatalf("PatchProfile to %q returned username %q", username, updated.Username)
+		}
+	}
+}
+
+func TestSignInRehashesBcrypt(t *testing.T) {
+	mo := Mongo_storage.NewMemory()
+	s := newTestServiceWith(t, mo)
+	ctx := context.Background()
+
+	legacy, err := bcrypt.GenerateFromPassword([]byte("correct horse battery staple"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := model.UserFromInput("1", model.Input{Username: "alice", Email: "alice@example.com", Password: string(legacy)}, time.Now())
+	err = mo.SignUp(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err = s.SignIn(ctx, model.Input{Username: "alice", Password: "correct horse battery staple"}, testClient)
+		if err != nil {
+			t.Fatalf("SignIn %d: %v", i, err)
+		}
+	}
+
+	stored, err := mo.GetByID(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored.Password, "$argon2id$") {
+		t.Fatalf("stored hash = %q, want argon2id", stored.Password)
+	}
+}
+
+func TestSessionTokenStoredAsDigest(t *testing.T) {
+	mo := Mongo_storage.NewMemory()
+	s := newTestServiceWith(t, mo)
+	ctx := context.Background()
+	auth := signUp(t, s, "alice")
+
+	if !strings.HasPrefix(auth.Session, token.SessionPrefix) || len(auth.Session) != len(token.SessionPrefix)+43 {
+		t.Fatalf("session token = %q, want %s and 256 random bits", auth.Session, token.SessionPrefix)
+	}
+
+	user, err := mo.GetByID(ctx, auth.User.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(user.Sessions) != 1 || user.Sessions[0].Token != token.Hash(auth.Session) {
+		t.Fatalf("stored sessions = %+v, want only the digest", user.Sessions)
+	}
+
+	_, err = mo.GetBySession(ctx, auth.Session)
+	if err == nil {
+		t.Fatal("GetBySession found the session by its plaintext token")
+	}
+
+	// A stored digest is useless as a credential.
+	_, err = s.Authenticate(ctx, user.Sessions[0].Token)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Authenticate(digest) error = %v, want ErrUnauthorized", err)
+	}
+}
+
+func TestSignInWrongPassword(t *testing.T) {
+	s := newTestService(t)
+	signUp(t, s, "alice")
+
+	_, err := s.SignIn(context.Background(), model.Input{Username: "alice", Password: "wrong"}, testClient)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("SignIn error = %v, want ErrUnauthorized", err)
+	}
+}
+
+// TestSignInUnknownUser checks an unknown username cannot be told apart from
+// a wrong password.
+func TestSignInUnknownUser(t *testing.T) {
+	s := newTestService(t)
+	signUp(t, s, "alice")
+	ctx := context.Background()
+
+	_, wrongPassword := s.SignIn(ctx, model.Input{Username: "alice", Password: "wrong"}, testClient)
+	// Another IP, so the delay after the first failure does not apply.
+	_, unknownUser := s.SignIn(ctx, model.Input{Username: "nobody", Password: "wrong"}, model.Client{IP: "127.0.0.2"})
+	if !errors.Is(unknownUser, ErrUnauthorized) {
+		t.Fatalf("SignIn of an unknown user error = %v, want ErrUnauthorized", unknownUser)
+	}
+	if unknownUser.Error() != wrongPassword.Error() {
+		t.Fatalf("SignIn of an unknown user = %q, of a wrong password = %q", unknownUser, wrongPassword)
+	}
+}
+
+// countingHasher counts the hashes it verifies.
+type countingHasher struct {
+	helper.Hasher
+	verified int
+}
+
+func (h *countingHasher) Verify(hash string, password string) (bool, error) {
+	h.verified++
+	return h.Hasher.Verify(hash, password)
+}
+
+// TestSignInUnknownUserVerifies checks an unknown username costs a hash
+// verification like a wrong password, so timing does not tell them apart.
+func TestSignInUnknownUserVerifies(t *testing.T) {
+	hasher := &countingHasher{Hasher: testHasher}
+	cfg := testConfig()
+	cfg.Hasher = hasher
+	s := newTestServiceConfig(t, Mongo_storage.NewMemory(), Redis_storage.NewMemory(), cfg)
+
+	_, err := s.SignIn(context.Background(), model.Input{Username: "nobody", Password: "wrong"}, testClient)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("SignIn of an unknown user error = %v, want ErrUnauthorized", err)
+	}
+	if hasher.verified != 1 {
+		t.Fatalf("SignIn of an unknown user verified %d hashes, want 1", hasher.verified)
+	}
+}
+
+func TestPatchProfileVersionConflict(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	auth := signUp(t, s, "alice")
+
+	bio := "first"
+	updated, err := s.PatchProfile(ctx, auth.User.ID, model.PatchUser{Bio: &bio}, auth.User.Version)
+	if err != nil {
+		t.Fatalf("PatchProfile: %v", err)
+	}
+	if updated.Bio != bio || updated.Version != auth.User.Version+1 {
+		t.Fatalf("PatchProfile returned bio %q version %d", updated.Bio, updated.Version)
+	}
+
+	bio = "stale"
+	_, err = s.PatchProfile(ctx, auth.User.ID, model.PatchUser{Bio: &bio}, auth.User.Version)
+	if !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("PatchProfile error = %v, want ErrPreconditionFailed", err)
+	}
+}
+
+func TestLogoutEndsSession(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	auth := signUp(t, s, "alice")
+
+	identity, err := s.Authenticate(ctx, auth.Session)
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+
+	err = s.Logout(ctx, identity)
+	if err != nil {
+		t.Fatalf("Logout: %v", err)
+	}
+
+	_, err = s.Authenticate(ctx, auth.Session)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Authenticate after Logout error = %v, want ErrUnauthorized", err)
+	}
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	cfg := testConfig()
+	cfg.Sessions = SessionConfig{Lifetime: time.Hour, IdleTimeout: 100 * time.Millisecond, TouchInterval: time.Millisecond}
+	s := newTestServiceConfig(t, Mongo_storage.NewMemory(), Redis_storage.NewMemory(), cfg)
+	ctx := context.Background()
+	auth := signUp(t, s, "alice")
+
+	// Every request pushes the idle timeout back.
+	for i := 0; i < 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		_, err := s.Authenticate(ctx, auth.Session)
+		if err != nil {
+			t.Fatalf("Authenticate of an active session: %v", err)
+		}
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	_, err := s.Authenticate(ctx, auth.Session)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Authenticate of an idle session error = %v, want ErrUnauthorized", err)
+	}
+}
+
+func TestSessionLifetime(t *testing.T) {
+	cfg := testConfig()
+	cfg.Sessions = SessionConfig{Lifetime: 150 * time.Millisecond, IdleTimeout: time.Hour, TouchInterval: time.Millisecond}
+	s := newTestServiceConfig(t, Mongo_storage.NewMemory(), Redis_storage.NewMemory(), cfg)
+	ctx := context.Background()
+	auth := signUp(t, s, "alice")
+
+	for i := 0; i < 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		_, err := s.Authenticate(ctx, auth.Session)
+		if i < 2 && err != nil {
+			t.Fatalf("Authenticate within the lifetime: %v", err)
+		}
+		if i == 3 && !errors.Is(err, ErrUnauthorized) {
+			t.Fatalf("Authenticate after the lifetime error = %v, want ErrUnauthorized", err)
+		}
+	}
+}
+
+func TestExpiredSessionNotRestoredFromMongo(t *testing.T) {
+	cfg := testConfig()
+	cfg.Sessions = SessionConfig{Lifetime: time.Hour, IdleTimeout: 100 * time.Millisecond, TouchInterval: time.Millisecond}
+	mo := Mongo_storage.NewMemory()
+	re := Redis_storage.NewMemory()
+	s := newTestServiceConfig(t, mo, re, cfg)
+	ctx := context.Background()
+	auth := signUp(t, s, "alice")
+	digest := token.Hash(auth.Session)
+
+	// A live session lost from Redis is restored from Mongo.
+	err := re.DeleteSession(ctx, auth.User.ID, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Authenticate(ctx, auth.Session)
+	if err != nil {
+		t.Fatalf("Authenticate of a session only in Mongo: %v", err)
+	}
+	_, err = re.GetSession(ctx, digest)
+	if err != nil {
+		t.Fatalf("session was not copied back to Redis: %v", err)
+	}
+
+	// Once idle for too long it is not, and it is removed from Mongo.
+	err = re.DeleteSession(ctx, auth.User.ID, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	_, err = s.Authenticate(ctx, auth.Session)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Authenticate of an expired session in Mongo error = %v, want ErrUnauthorized", err)
+	}
+	_, err = re.GetSession(ctx, digest)
+	if err == nil {
+		t.Fatal("expired session was copied back to Redis")
+	}
+	_, err = mo.GetBySession(ctx, digest)
+	if err == nil {
+		t.Fatal("expired session is still stored in Mongo")
+	}
+}
+
+func TestSignInRotatesSession(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	old := signUp(t, s, "alice")
+
+	client := testClient
+	client.Session = old.Session
+	auth, err := s.SignIn(ctx, model.Input{Username: "alice", Password: "correct horse battery staple"}, client)
+	if err != nil {
+		t.Fatalf("SignIn: %v", err)
+	}
+	if auth.Session == old.Session {
+		t.Fatal("SignIn kept the session the client came with")
+	}
+
+	_, err = s.Authenticate(ctx, old.Session)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Authenticate(old session) error = %v, want ErrUnauthorized", err)
+	}
+	_, err = s.Authenticate(ctx, auth.Session)
+	if err != nil {
+		t.Fatalf("Authenticate(new session): %v", err)
+	}
+}
+
+// failingSessions is a session storage whose UpsertSession always fails.
+type failingSessions struct {
+	Redis_storage.Storage
+}
+
+func (failingSessions) UpsertSession(ctx context.Context, session model.Session, ttl time.Duration) error {
+	return errors.New("redis is down")
+}
+
+func TestSaveSessionUndoesMongoWrite(t *testing.T) {
+	mo := Mongo_storage.NewMemory()
+	s := newTestServiceConfig(t, mo, failingSessions{Redis_storage.NewMemory()}, testConfig())
+	ctx := context.Background()
+
+	_, err := s.SignUp(ctx, model.Input{Username: "alice", Email: "alice@example.com", Password: "correct horse battery staple"}, testClient)
+	if err == nil {
+		t.Fatal("SignUp succeeded without a session store")
+	}
+
+	user, err := mo.GetByUsername(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(user.Sessions) != 0 {
+		t.Fatalf("Mongo kept %d sessions after Redis failed", len(user.Sessions))
+	}
+}
+
+func TestReconcileSessions(t *testing.T) {
+	mo := Mongo_storage.NewMemory()
+	re := Redis_storage.NewMemory()
+	s := newTestServiceConfig(t, mo, re, testConfig())
+	ctx := context.Background()
+	auth := signUp(t, s, "alice")
+	now := time.Now()
+
+	orphan := model.Session{ID: "orphan", Token: token.Hash("orphan"), UserID: auth.User.ID, CreatedAt: now, LastSeenAt: now}
+	err := re.UpsertSession(ctx, orphan, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone := model.Session{ID: "gone", Token: token.Hash("gone"), UserID: "deleted-user", CreatedAt: now, LastSeenAt: now}
+	err = re.UpsertSession(ctx, gone, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := model.Session{ID: "expired", Token: token.Hash("expired"), UserID: auth.User.ID,
+		CreatedAt: now.Add(-2 * time.Hour), LastSeenAt: now.Add(-time.Hour), ExpiresAt: now.Add(-time.Minute)}
+	err = mo.UpsertSession(ctx, auth.User.ID, expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := s.ReconcileSessions(ctx)
+	if err != nil {
+		t.Fatalf("ReconcileSessions: %v", err)
+	}
+	if result.Orphaned != 2 || result.Expired != 1 {
+		t.Fatalf("ReconcileSessions = %+v, want 2 orphaned and 1 expired", result)
+	}
+
+	for _, digest := range []string{orphan.Token, gone.Token} {
+		_, err = re.GetSession(ctx, digest)
+		if err == nil {
+			t.Fatalf("orphaned session %s is still in Redis", digest)
+		}
+	}
+	user, err := mo.GetByID(ctx, auth.User.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(user.Sessions) != 1 || user.Sessions[0].Token != token.Hash(auth.Session) {
+		t.Fatalf("Mongo sessions after reconcile = %+v, want only the live one", user.Sessions)
+	}
+	_, err = s.Authenticate(ctx, auth.Session)
+	if err != nil {
+		t.Fatalf("Authenticate of the live session: %v", err)
+	}
+}
+
+func TestRefreshRotates(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	auth := signUp(t, s, "alice")
+
+	tokens, err := s.Refresh(ctx, auth.Tokens.RefreshToken)
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if tokens.RefreshToken == auth.Tokens.RefreshToken {
+		t.Fatal("Refresh returned the same refresh token")
+	}
+	identity, err := s.Authenticate(ctx, tokens.AccessToken)
+	if err != nil {
+		t.Fatalf("Authenticate with the new access token: %v", err)
+	}
+	if identity.User.Username != "alice" {
+		t.Fatalf("Authenticate = %+v", identity.User)
+	}
+
+	tokens, err = s.Refresh(ctx, tokens.RefreshToken)
+	if err != nil {
+		t.Fatalf("second Refresh: %v", err)
+	}
+
+	_, err = s.Refresh(ctx, "not-a-refresh-token")
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Refresh of an unknown token error = %v, want ErrUnauthorized", err)
+	}
+}
+
+// TestRefreshReuseRevokesFamily replays a rotated refresh token, as a thief
+// holding a copy would, and expects every token of the sign-in to stop
+// working.
+func TestRefreshReuseRevokesFamily(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	auth := signUp(t, s, "alice")
+
+	rotated, err := s.Refresh(ctx, auth.Tokens.RefreshToken)
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+
+	_, err = s.Refresh(ctx, auth.Tokens.RefreshToken)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("replayed Refresh error = %v, want ErrUnauthorized", err)
+	}
+	_, err = s.Refresh(ctx, rotated.RefreshToken)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Refresh after reuse error = %v, want the family revoked", err)
+	}
+
+	// Another sign-in is a separate family and keeps working.
+	other, err := s.SignIn(ctx, model.Input{Username: "alice", Password: "correct horse battery staple"}, testClient)
+	if err != nil {
+		t.Fatalf("SignIn: %v", err)
+	}
+	_, err = s.Refresh(ctx, other.Tokens.RefreshToken)
+	if err != nil {
+		t.Fatalf("Refresh of another family: %v", err)
+	}
+}
+
+// TestRefreshFamilyIsSession checks the refresh tokens of a sign-in, rotated
+// or not, belong to the family named after the session it opened.
+func TestRefreshFamilyIsSession(t *testing.T) {
+	mo, re := Mongo_storage.NewMemory(), Redis_storage.NewMemory()
+	s := newTestServiceConfig(t, mo, re, testConfig())
+	ctx := context.Background()
+	auth := signUp(t, s, "alice")
+
+	user, err := mo.GetByID(ctx, auth.User.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(user.Sessions) != 1 {
+		t.Fatalf("user has %d sessions, want 1", len(user.Sessions))
+	}
+	session := user.Sessions[0].ID
+
+	rotated, err := s.Refresh(ctx, auth.Tokens.RefreshToken)
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	for _, refresh := range []string{auth.Tokens.RefreshToken, rotated.RefreshToken} {
+		stored, err := re.GetRefreshToken(ctx, token.Hash(refresh))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Family != session {
+			t.Fatalf("refresh token family = %q, want the session %q", stored.Family, session)
+		}
+	}
+}
+
+// TestRefreshConcurrent presents one refresh token many times at once. Only
+// one request may get new tokens, and the rest count as reuse.
+func TestRefreshConcurrent(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	auth := signUp(t, s, "alice")
+
+	const n = 10
+	results := make(chan model.Tokens, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tokens, err := s.Refresh(ctx, auth.Tokens.RefreshToken)
+			if err == nil {
+				results <- tokens
+			} else if !errors.Is(err, ErrUnauthorized) {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	var issued []model.Tokens
+	for tokens := range results {
+		issued = append(issued, tokens)
+	}
+	if len(issued) != 1 {
+		t.Fatalf("%d concurrent refreshes succeeded, want 1", len(issued))
+	}
+
+	_, err := s.Refresh(ctx, issued[0].RefreshToken)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Refresh after concurrent reuse error = %v, want the family revoked", err)
+	}
+}
+
+func TestRefreshExpired(t *testing.T) {
+	cfg := testConfig()
+	cfg.RefreshTTL = 20 * time.Millisecond
+	s := newTestServiceConfig(t, Mongo_storage.NewMemory(), Redis_storage.NewMemory(), cfg)
+	auth := signUp(t, s, "alice")
+
+	time.Sleep(2 * cfg.RefreshTTL)
+
+	_, err := s.Refresh(context.Background(), auth.Tokens.RefreshToken)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Refresh of an expired token error = %v, want ErrUnauthorized", err)
+	}
+}
+
+// signIn opens another session of a user made by signUp.
+func signIn(t *testing.T, s Service, username string) model.Auth {
+	t.Helper()
+
+	auth, err := s.SignIn(context.Background(), model.Input{Username: username, Password: "correct horse battery staple"}, testClient)
+	if err != nil {
+		t.Fatalf("SignIn(%q): %v", username, err)
+	}
+
+	return auth
+}
+
+// TestEndedSessionCannotRefresh ends sessions every way a client can and
+// expects the refresh tokens of that sign-in to stop working with them.
+func TestEndedSessionCannotRefresh(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	first := signUp(t, s, "alice")
+	second := signIn(t, s, "alice")
+	third := signIn(t, s, "alice")
+
+	identity, err := s.Authenticate(ctx, first.Session)
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	err = s.Logout(ctx, identity)
+	if err != nil {
+		t.Fatalf("Logout: %v", err)
+	}
+	_, err = s.Refresh(ctx, first.Tokens.RefreshToken)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Refresh after Logout error = %v, want ErrUnauthorized", err)
+	}
+
+	// A rotated token belongs to the session as much as the first one.
+	rotated, err := s.Refresh(ctx, second.Tokens.RefreshToken)
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	identity, err = s.Authenticate(ctx, third.Session)
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	sessions, err := s.ListSessions(ctx, identity)
+	if err != nil {
+		t.Fatalf("ListSessions: %v", err)
+	}
+	for _, session := range sessions {
+		if session.Current {
+			continue
+		}
+		err = s.RevokeSession(ctx, identity, session.ID)
+		if err != nil {
+			t.Fatalf("RevokeSession: %v", err)
+		}
+	}
+	_, err = s.Refresh(ctx, rotated.RefreshToken)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Refresh after RevokeSession error = %v, want ErrUnauthorized", err)
+	}
+
+	fourth := signIn(t, s, "alice")
+	err = s.RevokeOtherSessions(ctx, identity)
+	if err != nil {
+		t.Fatalf("RevokeOtherSessions: %v", err)
+	}
+	_, err = s.Refresh(ctx, fourth.Tokens.RefreshToken)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Refresh after RevokeOtherSessions error = %v, want ErrUnauthorized", err)
+	}
+	_, err = s.Refresh(ctx, third.Tokens.RefreshToken)
+	if err != nil {
+		t.Fatalf("Refresh of the session RevokeOtherSessions kept: %v", err)
+	}
+}
+
+func TestListSessionsMarksCurrent(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	signUp(t, s, "alice")
+	current := signIn(t, s, "alice")
+
+	identity, err := s.Authenticate(ctx, current.Session)
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	sessions, err := s.ListSessions(ctx, identity)
+	if err != nil {
+		t.Fatalf("ListSessions: %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("ListSessions returned %d sessions, want 2", len(sessions))
+	}
+
+	marked := 0
+	for _, session := range sessions {
+		if session.Token != "" {
+			t.Fatal("ListSessions returned a session token")
+		}
+		if session.Current {
+			marked++
+			if session.ID != identity.Session.ID {
+				t.Fatalf("ListSessions marked %q current, want %q", session.ID, identity.Session.ID)
+			}
+		}
+	}
+	if marked != 1 {
+		t.Fatalf("ListSessions marked %d sessions current, want 1", marked)
+	}
+}
+
+// TestRevokeSessionOfAnotherUser passes the session ID of someone else, which
+// must be refused and leave that session working.
+func TestRevokeSessionOfAnotherUser(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	alice := signUp(t, s, "alice")
+	bob := signUp(t, s, "bob")
+
+	bobIdentity, err := s.Authenticate(ctx, bob.Session)
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	identity, err := s.Authenticate(ctx, alice.Session)
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+
+	err = s.RevokeSession(ctx, identity, bobIdentity.Session.ID)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("RevokeSession of another user's session error = %v, want ErrNotFound", err)
+	}
+	_, err = s.Authenticate(ctx, bob.Session)
+	if err != nil {
+		t.Fatalf("Authenticate after another user revoked the session: %v", err)
+	}
+	_, err = s.Refresh(ctx, bob.Tokens.RefreshToken)
+	if err != nil {
+		t.Fatalf("Refresh after another user revoked the session: %v", err)
+	}
+}
+
+func TestRevokeOtherSessionsKeepsCurrent(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	other := signUp(t, s, "alice")
+	current := signIn(t, s, "alice")
+
+	identity, err := s.Authenticate(ctx, current.Session)
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	err = s.RevokeOtherSessions(ctx, identity)
+	if err != nil {
+		t.Fatalf("RevokeOtherSessions: %v", err)
+	}
+
+	_, err = s.Authenticate(ctx, other.Session)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Authenticate of a revoked session error = %v, want ErrUnauthorized", err)
+	}
+	identity, err = s.Authenticate(ctx, current.Session)
+	if err != nil {
+		t.Fatalf("Authenticate of the kept session: %v", err)
+	}
+	sessions, err := s.ListSessions(ctx, identity)
+	if err != nil {
+		t.Fatalf("ListSessions: %v", err)
+	}
+	if len(sessions) != 1 || !sessions[0].Current {
+		t.Fatalf("ListSessions after RevokeOtherSessions = %+v, want only the current session", sessions)
+	}
+}
+
+func TestForgotPasswordUnknownEmail(t *testing.T) {
+	s, ml := newTestServiceMail(t, Mongo_storage.NewMemory(), Redis_storage.NewMemory(), testConfig())
+
+	err := s.ForgotPassword(context.Background(), model.ForgotPassword{Email: "nobody@example.com"})
+	if err != nil {
+		t.Fatalf("ForgotPassword of an unknown email: %v", err)
+	}
+	if messages := ml.Messages(); len(messages) != 0 {
+		t.Fatalf("ForgotPassword of an unknown email sent %+v", messages)
+	}
+}
+
+func TestResetPasswordSingleUse(t *testing.T) {
+	s, ml := newTestServiceMail(t, Mongo_storage.NewMemory(), Redis_storage.NewMemory(), testConfig())
+	ctx := context.Background()
+	signUp(t, s, "alice")
+
+	err := s.ForgotPassword(ctx, model.ForgotPassword{Email: "alice@example.com"})
+	if err != nil {
+		t.Fatalf("ForgotPassword: %v", err)
+	}
+	reset := mailedToken(t, ml, "alice@example.com", "http://localhost/reset")
+
+	const password = "a brand new passphrase"
+	err = s.ResetPassword(ctx, model.ResetPassword{Token: reset, New: password, ConfirmNew: password})
+	if err != nil {
+		t.Fatalf("ResetPassword: %v", err)
+	}
+	_, err = s.SignIn(ctx, model.Input{Username: "alice", Password: password}, testClient)
+	if err != nil {
+		t.Fatalf("SignIn with the new password: %v", err)
+	}
+
+	const again = "yet another passphrase"
+	err = s.ResetPassword(ctx, model.ResetPassword{Token: reset, New: again, ConfirmNew: again})
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("ResetPassword with a used token error = %v, want ErrUnauthorized", err)
+	}
+}
+
+func TestResetPasswordExpires(t *testing.T) {
+	cfg := testConfig()
+	cfg.ResetTTL = 20 * time.Millisecond
+	s, ml := newTestServiceMail(t, Mongo_storage.NewMemory(), Redis_storage.NewMemory(), cfg)
+	ctx := context.Background()
+	signUp(t, s, "alice")
+
+	err := s.ForgotPassword(ctx, model.ForgotPassword{Email: "alice@example.com"})
+	if err != nil {
+		t.Fatalf("ForgotPassword: %v", err)
+	}
+	reset := mailedToken(t, ml, "alice@example.com", "http://localhost/reset")
+
+	time.Sleep(2 * cfg.ResetTTL)
+
+	const password = "a brand new passphrase"
+	err = s.ResetPassword(ctx, model.ResetPassword{Token: reset, New: password, ConfirmNew: password})
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("ResetPassword with an expired token error = %v, want ErrUnauthorized", err)
+	}
+}
+
+// TestResetPasswordRevokesSessions expects a reset to sign the user out of
+// every device, whether it holds a session or only a refresh token.
+func TestResetPasswordRevokesSessions(t *testing.T) {
+	s, ml := newTestServiceMail(t, Mongo_storage.NewMemory(), Redis_storage.NewMemory(), testConfig())
+	ctx := context.Background()
+	first := signUp(t, s, "alice")
+	second := signIn(t, s, "alice")
+	rotated, err := s.Refresh(ctx, second.Tokens.RefreshToken)
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+
+	err = s.ForgotPassword(ctx, model.ForgotPassword{Email: "alice@example.com"})
+	if err != nil {
+		t.Fatalf("ForgotPassword: %v", err)
+	}
+	const password = "a brand new passphrase"
+	err = s.ResetPassword(ctx, model.ResetPassword{
+		Token:      mailedToken(t, ml, "alice@example.com", "http://localhost/reset"),
+		New:        password,
+		ConfirmNew: password,
+	})
+	if err != nil {
+		t.Fatalf("ResetPassword: %v", err)
+	}
+
+	for _, auth := range []model.Auth{first, second} {
+		_, err = s.Authenticate(ctx, auth.Session)
+		if !errors.Is(err, ErrUnauthorized) {
+			t.Fatalf("Authenticate after ResetPassword error = %v, want ErrUnauthorized", err)
+		}
+	}
+	for _, refresh := range []string{first.Tokens.RefreshToken, rotated.RefreshToken} {
+		_, err = s.Refresh(ctx, refresh)
+		if !errors.Is(err, ErrUnauthorized) {
+			t.Fatalf("Refresh after ResetPassword error = %v, want ErrUnauthorized", err)
+		}
+	}
+}
+
+// TestResetPasswordPolicy expects a reset to hold the new password to the
+// rules of SignUp, and a refused password to leave the token usable.
+func TestResetPasswordPolicy(t *testing.T) {
+	s, ml := newTestServiceMail(t, Mongo_storage.NewMemory(), Redis_storage.NewMemory(), testConfig())
+	ctx := context.Background()
+	signUp(t, s, "alice")
+
+	err := s.ForgotPassword(ctx, model.ForgotPassword{Email: "alice@example.com"})
+	if err != nil {
+		t.Fatalf("ForgotPassword: %v", err)
+	}
+	reset := mailedToken(t, ml, "alice@example.com", "http://localhost/reset")
+
+	refused := map[string]string{
+		"short":          validation.CodeTooShort,
+		breachedPassword: validation.CodeBreached,
+	}
+	for password, code := range refused {
+		err = s.ResetPassword(ctx, model.ResetPassword{Token: reset, New: password, ConfirmNew: password})
+		var serviceErr *Error
+		if !errors.As(err, &serviceErr) || len(serviceErr.Fields) != 1 || serviceErr.Fields[0].Code != code {
+			t.Fatalf("ResetPassword to %q error = %v, want %s", password, err, code)
+		}
+		if serviceErr.Fields[0].Field != "new" {
+			t.Fatalf("ResetPassword to %q reported field %q, want new", password, serviceErr.Fields[0].Field)
+		}
+	}
+
+	const password = "a brand new passphrase"
+	err = s.ResetPassword(ctx, model.ResetPassword{Token: reset, New: password, ConfirmNew: password})
+	if err != nil {
+		t.Fatalf("ResetPassword after refused passwords: %v", err)
+	}
+}
+
+func TestVerifyEmailOnce(t *testing.T) {
+	s, ml := newTestServiceMail(t, Mongo_storage.NewMemory(), Redis_storage.NewMemory(), testConfig())
+	ctx := context.Background()
+	auth := signUp(t, s, "alice")
+	verify := mailedToken(t, ml, "alice@example.com", "http://localhost/verify")
+
+	err := s.VerifyEmail(ctx, verify)
+	if err != nil {
+		t.Fatalf("VerifyEmail: %v", err)
+	}
+	identity, err := s.Authenticate(ctx, auth.Session)
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if identity.User.EmailVerifiedAt == nil {
+		t.Fatal("email not verified after VerifyEmail")
+	}
+
+	err = s.VerifyEmail(ctx, verify)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("VerifyEmail with a used link error = %v, want ErrUnauthorized", err)
+	}
+	err = s.ResendVerification(ctx, identity)
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("ResendVerification of a verified email error = %v, want ErrConflict", err)
+	}
+}
+
+// TestVerifyEmailAfterChange follows a link sent for an address the user has
+// replaced since, which must not verify the new one.
+func TestVerifyEmailAfterChange(t *testing.T) {
+	s, ml := newTestServiceMail(t, Mongo_storage.NewMemory(), Redis_storage.NewMemory(), testConfig())
+	ctx := context.Background()
+	auth := signUp(t, s, "alice")
+	old := mailedToken(t, ml, "alice@example.com", "http://localhost/verify")
+
+	email := "alice@example.org"
+	_, err := s.PatchProfile(ctx, auth.User.ID, model.PatchUser{Email: &email}, model.AnyVersion)
+	if err != nil {
+		t.Fatalf("PatchProfile: %v", err)
+	}
+
+	err = s.VerifyEmail(ctx, old)
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("VerifyEmail of the old address error = %v, want ErrConflict", err)
+	}
+	identity, err := s.Authenticate(ctx, auth.Session)
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if identity.User.EmailVerifiedAt != nil {
+		t.Fatal("a link for the old address verified the new one")
+	}
+}
+
+func TestPatchEmailResetsVerification(t *testing.T) {
+	s, ml := newTestServiceMail(t, Mongo_storage.NewMemory(), Redis_storage.NewMemory(), testConfig())
+	ctx := context.Background()
+	auth := signUp(t, s, "alice")
+
+	err := s.VerifyEmail(ctx, mailedToken(t, ml, "alice@example.com", "http://localhost/verify"))
+	if err != nil {
+		t.Fatalf("VerifyEmail: %v", err)
+	}
+
+	email := "alice@example.org"
+	updated, err := s.PatchProfile(ctx, auth.User.ID, model.PatchUser{Email: &email}, model.AnyVersion)
+	if err != nil {
+		t.Fatalf("PatchProfile: %v", err)
+	}
+	if updated.EmailVerifiedAt != nil {
+		t.Fatal("the new email is verified before its link was followed")
+	}
+
+	err = s.VerifyEmail(ctx, mailedToken(t, ml, email, "http://localhost/verify"))
+	if err != nil {
+		t.Fatalf("VerifyEmail of the new address: %v", err)
+	}
+}
+
+// failingMailer fails every message.
+type failingMailer struct{}
+
+func (failingMailer) Send(ctx context.Context, msg mailer.Message) error {
+	return errors.New("mail server down")
+}
+
+// TestPatchEmailMailFails expects a changed email to be saved and returned
+// even when its verification link cannot be sent.
+func TestPatchEmailMailFails(t *testing.T) {
+	tokens, err := token.New(token.Config{Algorithm: token.HS256, Secret: "test-secret", Issuer: "test", AccessTTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(Redis_storage.NewMemory(), Mongo_storage.NewMemory(), tokens, failingMailer{}, testConfig())
+	ctx := context.Background()
+	auth := signUp(t, s, "alice")
+
+	email := "alice@example.org"
+	updated, err := s.PatchProfile(ctx, auth.User.ID, model.PatchUser{Email: &email}, model.AnyVersion)
+	if err != nil {
+		t.Fatalf("PatchProfile with a failing mailer: %v", err)
+	}
+	if updated.Email != email {
+		t.Fatalf("PatchProfile returned email %q, want %q", updated.Email, email)
+	}
+}
+
+func TestAuthenticateRejectsForeignAccessToken(t *testing.T) {
+	s := newTestService(t)
+	signUp(t, s, "alice")
+
+	other, err := token.New(token.Config{Algorithm: token.HS256, Secret: "other-secret", Issuer: "test", AccessTTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, _, err := other.Issue("1", "alice", []string{model.RoleAdmin})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.Authenticate(context.Background(), forged)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Authenticate of a foreign token error = %v, want ErrUnauthorized", err)
+	}
+}
@@ -0,0 +1,326 @@
+package service
+
+import (
+	"context"
+	"crypto/subtle"
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/sillamilla/user_microservice/internal/users/model"
+	"github.com/sillamilla/user_microservice/internal/users/token"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log"
+	"time"
+)
+
+// Sessions are kept in both stores. Mongo is the source of truth, a session
+// exists exactly when Mongo has it. Redis is a cache that answers every
+// request and carries the sliding expiry. Writes keep the Redis sessions a
+// subset of the Mongo ones: new sessions go to Mongo first and are removed
+// again when Redis fails, ended sessions leave Redis first. What is left
+// over when that undo fails too, or when a Mongo fallback races a revocation,
+// is repaired by ReconcileSessions.
+
+// SessionConfig controls how long sessions last. A session ends Lifetime after
+// it was opened or IdleTimeout after the last request made with it, whichever
+// comes first. Every request extends the session in Redis, the copy in the
+// user storage is brought up to date at most once per TouchInterval, so a
+// session restored from there may end up to TouchInterval early.
+type SessionConfig struct {
+	Lifetime      time.Duration
+	IdleTimeout   time.Duration
+	TouchInterval time.Duration
+}
+
+const (
+	defaultSessionLifetime      = 30 * 24 * time.Hour
+	defaultSessionIdleTimeout   = 5 * time.Hour
+	defaultSessionTouchInterval = time.Minute
+)
+
+// sessionExpiresAt is when session ends unless it is used again before.
+func (s *service) sessionExpiresAt(session model.Session) time.Time {
+	expiresAt := session.ExpiresAt
+	if expiresAt.IsZero() {
+		// Sessions opened before the lifetime was recorded.
+		expiresAt = session.CreatedAt.Add(s.cfg.Sessions.Lifetime)
+	}
+
+	idle := session.LastSeenAt.Add(s.cfg.Sessions.IdleTimeout)
+	if idle.Before(expiresAt) {
+		return idle
+	}
+
+	return expiresAt
+}
+
+func (s *service) sessionExpired(session model.Session, now time.Time) bool {
+	return !now.Before(s.sessionExpiresAt(session))
+}
+
+// touchSession records a request made with session at now and extends it in
+// Redis. The user storage is only written when now falls into another
+// TouchInterval than the previous request.
+func (s *service) touchSession(ctx context.Context, session model.Session, now time.Time) (model.Session, error) {
+	previous := session.LastSeenAt
+	session.LastSeenAt = now
+
+	err := s.re.UpsertSession(ctx, session, s.sessionExpiresAt(session).Sub(now))
+	if err != nil {
+		return model.Session{}, err
+	}
+
+	interval := s.cfg.Sessions.TouchInterval
+	if previous.Truncate(interval).Equal(now.Truncate(interval)) {
+		return session, nil
+	}
+
+	err = s.mo.UpsertSession(ctx, session.UserID, session)
+	if err != nil {
+		return model.Session{}, err
+	}
+
+	return session, nil
+}
+
+// saveSession stores a new session in Mongo, then in Redis. When Redis fails
+// the Mongo copy is removed again, so the caller can report the failure
+// without leaving a session behind.
+func (s *service) saveSession(ctx context.Context, session model.Session, now time.Time) error {
+	err := s.mo.UpsertSession(ctx, session.UserID, session)
+	if err != nil {
+		return err
+	}
+
+	err = s.re.UpsertSession(ctx, session, s.sessionExpiresAt(session).Sub(now))
+	if err != nil {
+		undoErr := s.mo.DeleteSession(ctx, session.UserID, session.Token)
+		if undoErr != nil {
+			log.Printf("service.saveSession: session %s of user %s left in Mongo: %v", session.ID, session.UserID, undoErr)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// deleteSession ends a session in Redis, then in Mongo. If Mongo fails the
+// session still exists and is restored from there on its next use. The
+// refresh tokens issued with the session, whose family is the session ID, are
+// revoked first, so a session that is gone can never be refreshed.
+func (s *service) deleteSession(ctx context.Context, session model.Session) error {
+	err := s.re.RevokeRefreshFamily(ctx, session.ID)
+	if err != nil {
+		return err
+	}
+
+	err = s.re.DeleteSession(ctx, session.UserID, session.Token)
+	if err != nil {
+		return err
+	}
+
+	err = s.mo.DeleteSession(ctx, session.UserID, session.Token)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// deleteUserSessions ends every session of userID except keepToken, which
+// may be empty, in the same order as deleteSession and revoking the refresh
+// tokens of each.
+func (s *service) deleteUserSessions(ctx context.Context, userID string, keepToken string) error {
+	cached, err := s.re.ListSessions(ctx, userID)
+	if err != nil {
+		return err
+	}
+	user, err := s.mo.GetByID(ctx, userID)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+
+	for _, stored := range append(cached, user.Sessions...) {
+		if stored.Token == keepToken {
+			continue
+		}
+
+		err = s.re.RevokeRefreshFamily(ctx, stored.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, stored := range cached {
+		if stored.Token == keepToken {
+			continue
+		}
+
+		err = s.re.DeleteSession(ctx, userID, stored.Token)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.mo.DeleteOtherSessions(ctx, userID, keepToken)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// findSession looks a session up by its token digest, in Redis first and
+// then in Mongo. It does not check expiry.
+func (s *service) findSession(ctx context.Context, digest string) (model.Session, error) {
+	current, err := s.re.GetSession(ctx, digest)
+	if err == nil {
+		return current, nil
+	} else if !errors.Is(err, redis.Nil) {
+		return model.Session{}, errors.Wrap(err, "GetSession")
+	}
+
+	user, err := s.mo.GetBySession(ctx, digest)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return model.Session{}, newError(ErrUnauthorized, "Session not found")
+	} else if err != nil {
+		return model.Session{}, errors.Wrap(err, "GetBySession")
+	}
+
+	for _, stored := range user.Sessions {
+		if subtle.ConstantTimeCompare([]byte(stored.Token), []byte(digest)) == 1 {
+			return stored, nil
+		}
+	}
+
+	return model.Session{}, newError(ErrUnauthorized, "Session not found")
+}
+
+// endPresentedSession ends the session a client signed in with, if any. A
+// sign-in always opens a new session, so a token planted on the device
+// before is never carried over, and the old one is not left behind.
+func (s *service) endPresentedSession(ctx context.Context, presented string) error {
+	if !token.IsSession(presented) {
+		return nil
+	}
+
+	current, err := s.findSession(ctx, token.Hash(presented))
+	if errors.Is(err, ErrUnauthorized) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return s.deleteSession(ctx, current)
+}
+
+// ReconcileResult counts what ReconcileSessions repaired.
+type ReconcileResult struct {
+	// Orphaned sessions were in Redis but not in Mongo.
+	Orphaned int
+	// Expired sessions were still stored in Mongo.
+	Expired int
+}
+
+// ReconcileSessions brings both stores back in line: sessions only Redis has
+// are removed from it and expired sessions are removed from Mongo. Redis is
+// read before Mongo for every user, a session created in between is already
+// in Mongo by the time it reaches Redis and is never taken for an orphan.
+func (s *service) ReconcileSessions(ctx context.Context) (ReconcileResult, error) {
+	var result ReconcileResult
+
+	cachedIDs, err := s.re.SessionUserIDs(ctx)
+	if err != nil {
+		return result, errors.Wrap(err, "service.ReconcileSessions.SessionUserIDs")
+	}
+	storedIDs, err := s.mo.SessionUserIDs(ctx)
+	if err != nil {
+		return result, errors.Wrap(err, "service.ReconcileSessions.SessionUserIDs")
+	}
+
+	seen := make(map[string]bool)
+	now := time.Now()
+	for _, id := range append(cachedIDs, storedIDs...) {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		err = s.reconcileUser(ctx, id, now, &result)
+		if err != nil {
+			return result, errors.Wrap(err, "service.ReconcileSessions")
+		}
+	}
+
+	return result, nil
+}
+
+func (s *service) reconcileUser(ctx context.Context, userID string, now time.Time, result *ReconcileResult) error {
+	cached, err := s.re.ListSessions(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	user, err := s.mo.GetByID(ctx, userID)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		user = model.User{ID: userID}
+	} else if err != nil {
+		return err
+	}
+
+	stored := make(map[string]bool, len(user.Sessions))
+	for _, session := range user.Sessions {
+		stored[session.Token] = true
+	}
+
+	lastSeen := make(map[string]time.Time, len(cached))
+	for _, session := range cached {
+		if !stored[session.Token] {
+			err = s.re.DeleteSession(ctx, userID, session.Token)
+			if err != nil {
+				return err
+			}
+			result.Orphaned++
+			continue
+		}
+		lastSeen[session.Token] = session.LastSeenAt
+	}
+
+	for _, session := range user.Sessions {
+		// Redis has the latest activity, Mongo may lag behind.
+		if seenAt, ok := lastSeen[session.Token]; ok && seenAt.After(session.LastSeenAt) {
+			session.LastSeenAt = seenAt
+		}
+		if !s.sessionExpired(session, now) {
+			continue
+		}
+
+		err = s.deleteSession(ctx, session)
+		if err != nil {
+			return err
+		}
+		result.Expired++
+	}
+
+	return nil
+}
+
+// RunReconciler calls ReconcileSessions every interval until ctx is done.
+func RunReconciler(ctx context.Context, srv Service, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			result, err := srv.ReconcileSessions(ctx)
+			if err != nil {
+				log.Printf("service.RunReconciler: %v", err)
+			} else if result.Orphaned > 0 || result.Expired > 0 {
+				log.Printf("service.RunReconciler: removed %d orphaned and %d expired sessions", result.Orphaned, result.Expired)
+			}
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package service
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/sillamilla/user_microservice/internal/users/model"
+	"github.com/sillamilla/user_microservice/internal/users/service/helper"
+	"github.com/sillamilla/user_microservice/internal/users/token"
+	"strings"
+	"time"
+)
+
+const (
+	totpIssuer         = "MusicHub"
+	totpEnrollmentTTL  = 10 * time.Minute
+	signInChallengeTTL = 5 * time.Minute
+	recoveryCodeCount  = 10
+)
+
+// EnrollTOTP starts two-factor enrolment. The secret only becomes active
+// once ConfirmTOTP receives a valid code for it.
+func (s *service) EnrollTOTP(ctx context.Context, identity model.Identity) (model.TOTPEnrollment, error) {
+	if identity.User.TOTPEnabled {
+		return model.TOTPEnrollment{}, newError(ErrConflict, "Two-factor authentication is already enabled")
+	}
+
+	secret, err := helper.GenerateTOTPSecret()
+	if err != nil {
+		return model.TOTPEnrollment{}, errors.Wrap(err, "service.EnrollTOTP.GenerateTOTPSecret")
+	}
+
+	err = s.re.SaveTOTPEnrollment(ctx, identity.User.ID, secret, totpEnrollmentTTL)
+	if err != nil {
+		return model.TOTPEnrollment{}, errors.Wrap(err, "service.EnrollTOTP.SaveTOTPEnrollment")
+	}
+
+	return model.TOTPEnrollment{
+		Secret: secret,
+		URI:    helper.TOTPURI(totpIssuer, identity.User.Username, secret),
+	}, nil
+}
+
+// ConfirmTOTP enables two-factor authentication and returns the recovery
+// codes. They are shown once, only their digests are stored.
+func (s *service) ConfirmTOTP(ctx context.Context, identity model.Identity, input model.TOTPCode) ([]string, error) {
+	secret, err := s.re.GetTOTPEnrollment(ctx, identity.User.ID)
+	if errors.Is(err, redis.Nil) {
+		return nil, newError(ErrValidation, "No pending two-factor enrolment")
+	} else if err != nil {
+		return nil, errors.Wrap(err, "service.ConfirmTOTP.GetTOTPEnrollment")
+	}
+
+	_, ok := helper.ValidateTOTP(secret, input.Code, time.Now())
+	if !ok {
+		return nil, newError(ErrUnauthorized, "Invalid code")
+	}
+
+	codes, err := helper.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, errors.Wrap(err, "service.ConfirmTOTP.GenerateRecoveryCodes")
+	}
+
+	hashed := make([]string, 0, len(codes))
+	for _, code := range codes {
+		hashed = append(hashed, token.Hash(code))
+	}
+
+	err = s.mo.EnableTOTP(ctx, identity.User.ID, secret, hashed)
+	if err != nil {
+		return nil, errors.Wrap(err, "service.ConfirmTOTP.EnableTOTP")
+	}
+
+	err = s.re.DeleteTOTPEnrollment(ctx, identity.User.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "service.ConfirmTOTP.DeleteTOTPEnrollment")
+	}
+
+	return codes, nil
+}
+
+func (s *service) DisableTOTP(ctx context.Context, identity model.Identity, input model.DisableTOTP) error {
+	user := identity.User
+	if !user.TOTPEnabled {
+		return newError(ErrConflict, "Two-factor authentication is not enabled")
+	}
+
+	ok, err := s.cfg.Hasher.Verify(user.Password, input.Password)
+	if err != nil {
+		return errors.Wrap(err, "service.DisableTOTP.Verify")
+	}
+	if !ok {
+		return newError(ErrUnauthorized, "Invalid password")
+	}
+
+	err = s.checkTOTP(ctx, user, input.Code)
+	if err != nil {
+		return errors.Wrap(err, "service.DisableTOTP.checkTOTP")
+	}
+
+	err = s.mo.DisableTOTP(ctx, user.ID)
+	if err != nil {
+		return errors.Wrap(err, "service.DisableTOTP")
+	}
+
+	return nil
+}
+
+// SignInSecondFactor completes a sign-in that SignIn answered with a
+// challenge. Either a TOTP code or an unused recovery code is accepted.
+func (s *service) SignInSecondFactor(ctx context.Context, input model.SecondFactor, client model.Client) (model.Auth, error) {
+	hash := token.Hash(input.Challenge)
+	userID, err := s.re.GetSignInChallenge(ctx, hash)
+	if errors.Is(err, redis.Nil) {
+		return model.Auth{}, newError(ErrUnauthorized, "Invalid or expired challenge")
+	} else if err != nil {
+		return model.Auth{}, errors.Wrap(err, "service.SignInSecondFactor.GetSignInChallenge")
+	}
+
+	user, err := s.getUser(ctx, userID)
+	if err != nil {
+		return model.Auth{}, errors.Wrap(err, "service.SignInSecondFactor.getUser")
+	}
+
+	err = s.checkLoginLock(ctx, user.Username, client.IP)
+	if err != nil {
+		return model.Auth{}, errors.Wrap(err, "service.SignInSecondFactor.checkLoginLock")
+	}
+
+	if strings.Contains(input.Code, "-") {
+		var used bool
+		used, err = s.mo.UseRecoveryCode(ctx, user.ID, token.Hash(strings.ToLower(strings.TrimSpace(input.Code))))
+		if err != nil {
+			return model.Auth{}, errors.Wrap(err, "service.SignInSecondFactor.UseRecoveryCode")
+		}
+		if !used {
+			err = newError(ErrUnauthorized, "Invalid code")
+		}
+	} else {
+		err = s.checkTOTP(ctx, user, input.Code)
+	}
+	if errors.Is(err, ErrUnauthorized) {
+		lockErr := s.registerLoginFailure(ctx, user, user.Username, client.IP)
+		if lockErr != nil {
+			return model.Auth{}, errors.Wrap(lockErr, "service.SignInSecondFactor.registerLoginFailure")
+		}
+
+		return model.Auth{}, err
+	} else if err != nil {
+		return model.Auth{}, errors.Wrap(err, "service.SignInSecondFactor.checkCode")
+	}
+
+	err = s.re.DeleteSignInChallenge(ctx, hash)
+	if err != nil {
+		return model.Auth{}, errors.Wrap(err, "service.SignInSecondFactor.DeleteSignInChallenge")
+	}
+
+	auth, err := s.completeSignIn(ctx, user, client)
+	if err != nil {
+		return model.Auth{}, errors.Wrap(err, "service.SignInSecondFactor.completeSignIn")
+	}
+
+	return auth, nil
+}
+
+func (s *service) newSignInChallenge(ctx context.Context, userID string) (string, error) {
+	challenge, hash, err := token.NewOpaque()
+	if err != nil {
+		return "", err
+	}
+
+	err = s.re.SaveSignInChallenge(ctx, hash, userID, signInChallengeTTL)
+	if err != nil {
+		return "", err
+	}
+
+	return challenge, nil
+}
+
+// checkTOTP validates a code against the user's secret and rejects codes that
+// were already used within their validity window.
+func (s *service) checkTOTP(ctx context.Context, user model.User, code string) error {
+	step, ok := helper.ValidateTOTP(user.TOTPSecret, strings.TrimSpace(code), time.Now())
+	if !ok {
+		return newError(ErrUnauthorized, "Invalid code")
+	}
+
+	first, err := s.re.UseTOTPStep(ctx, user.ID, step)
+	if err != nil {
+		return err
+	}
+	if !first {
+		return newError(ErrUnauthorized, "Code already used")
+	}
+
+	return nil
+}
@@ -0,0 +1,191 @@
+package service
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/sillamilla/user_microservice/internal/users/Mongo_storage"
+	"github.com/sillamilla/user_microservice/internal/users/model"
+	"github.com/sillamilla/user_microservice/internal/users/service/helper"
+	"strings"
+	"testing"
+	"time"
+)
+
+// enableTOTP signs up username with two-factor authentication enabled and
+// returns the secret and recovery codes.
+func enableTOTP(t *testing.T, s Service, username string) (string, []string) {
+	t.Helper()
+	ctx := context.Background()
+
+	auth := signUp(t, s, username)
+	identity, err := s.Authenticate(ctx, auth.Session)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enrollment, err := s.EnrollTOTP(ctx, identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := s.ConfirmTOTP(ctx, identity, model.TOTPCode{Code: totpCode(t, enrollment.Secret, time.Now())})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return enrollment.Secret, codes
+}
+
+func totpCode(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+
+	code, err := helper.TOTPCode(secret, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return code
+}
+
+// challenge signs in with the password and returns the second factor
+// challenge.
+func challenge(t *testing.T, s Service, username string) string {
+	t.Helper()
+
+	auth, err := s.SignIn(context.Background(), model.Input{Username: username, Password: "correct horse battery staple"}, testClient)
+	if err != nil {
+		t.Fatalf("SignIn: %v", err)
+	}
+	if auth.Challenge == "" || auth.Session != "" {
+		t.Fatalf("SignIn with two-factor enabled = %+v, want only a challenge", auth)
+	}
+
+	return auth.Challenge
+}
+
+// waitForDelay outlasts the sign-in delay a failure triggers with the test
+// lockout config.
+func waitForDelay() {
+	time.Sleep(5 * time.Millisecond)
+}
+
+func TestSignInSecondFactorTOTP(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	secret, _ := enableTOTP(t, s, "alice")
+
+	// The code from the enrolment was for the current step, take the previous
+	// one so it is not rejected as a replay.
+	code := totpCode(t, secret, time.Now().Add(-30*time.Second))
+	auth, err := s.SignInSecondFactor(ctx, model.SecondFactor{Challenge: challenge(t, s, "alice"), Code: code}, testClient)
+	if err != nil {
+		t.Fatalf("SignInSecondFactor: %v", err)
+	}
+	if auth.Session == "" || auth.Tokens.AccessToken == "" {
+		t.Fatalf("SignInSecondFactor = %+v, want a session and tokens", auth)
+	}
+}
+
+func TestSignInSecondFactorRejectsReplayedCode(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	secret, _ := enableTOTP(t, s, "alice")
+
+	code := totpCode(t, secret, time.Now().Add(30*time.Second))
+	_, err := s.SignInSecondFactor(ctx, model.SecondFactor{Challenge: challenge(t, s, "alice"), Code: code}, testClient)
+	if err != nil {
+		t.Fatalf("SignInSecondFactor: %v", err)
+	}
+
+	_, err = s.SignInSecondFactor(ctx, model.SecondFactor{Challenge: challenge(t, s, "alice"), Code: code}, testClient)
+	if !errors.Is(err, ErrUnauthorized) || !strings.Contains(err.Error(), "already used") {
+		t.Fatalf("replayed code error = %v, want ErrUnauthorized", err)
+	}
+}
+
+func TestSignInSecondFactorRejectsStaleCode(t *testing.T) {
+	s := newTestService(t)
+	secret, _ := enableTOTP(t, s, "alice")
+
+	code := totpCode(t, secret, time.Now().Add(-2*time.Minute))
+	_, err := s.SignInSecondFactor(context.Background(), model.SecondFactor{Challenge: challenge(t, s, "alice"), Code: code}, testClient)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("stale code error = %v, want ErrUnauthorized", err)
+	}
+}
+
+func TestSignInSecondFactorRecoveryCode(t *testing.T) {
+	mo := Mongo_storage.NewMemory()
+	s := newTestServiceWith(t, mo)
+	ctx := context.Background()
+	_, codes := enableTOTP(t, s, "alice")
+
+	// Recovery codes are matched regardless of case and surrounding space.
+	_, err := s.SignInSecondFactor(ctx, model.SecondFactor{Challenge: challenge(t, s, "alice"), Code: " " + strings.ToUpper(codes[0]) + " "}, testClient)
+	if err != nil {
+		t.Fatalf("SignInSecondFactor with a recovery code: %v", err)
+	}
+
+	user, err := mo.GetByUsername(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(user.RecoveryCodes) != len(codes)-1 {
+		t.Fatalf("%d recovery codes left, want %d", len(user.RecoveryCodes), len(codes)-1)
+	}
+
+	_, err = s.SignInSecondFactor(ctx, model.SecondFactor{Challenge: challenge(t, s, "alice"), Code: codes[0]}, testClient)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("reused recovery code error = %v, want ErrUnauthorized", err)
+	}
+	waitForDelay()
+
+	_, err = s.SignInSecondFactor(ctx, model.SecondFactor{Challenge: challenge(t, s, "alice"), Code: codes[1]}, testClient)
+	if err != nil {
+		t.Fatalf("SignInSecondFactor with another recovery code: %v", err)
+	}
+}
+
+// TestSignInSecondFactorRoutesByDash checks only input with a dash is tried
+// as a recovery code, a recovery code without it is checked as a TOTP code.
+func TestSignInSecondFactorRoutesByDash(t *testing.T) {
+	mo := Mongo_storage.NewMemory()
+	s := newTestServiceWith(t, mo)
+	ctx := context.Background()
+	_, codes := enableTOTP(t, s, "alice")
+
+	_, err := s.SignInSecondFactor(ctx, model.SecondFactor{Challenge: challenge(t, s, "alice"), Code: strings.Replace(codes[0], "-", "", 1)}, testClient)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("recovery code without its dash error = %v, want ErrUnauthorized", err)
+	}
+
+	user, err := mo.GetByUsername(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(user.RecoveryCodes) != len(codes) {
+		t.Fatalf("a recovery code was used up by input without a dash")
+	}
+	waitForDelay()
+
+	_, err = s.SignInSecondFactor(ctx, model.SecondFactor{Challenge: challenge(t, s, "alice"), Code: "aaaaa-bbbbb"}, testClient)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("made up recovery code error = %v, want ErrUnauthorized", err)
+	}
+}
+
+func TestSignInSecondFactorChallengeIsSingleUse(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+	_, codes := enableTOTP(t, s, "alice")
+
+	c := challenge(t, s, "alice")
+	_, err := s.SignInSecondFactor(ctx, model.SecondFactor{Challenge: c, Code: codes[0]}, testClient)
+	if err != nil {
+		t.Fatalf("SignInSecondFactor: %v", err)
+	}
+
+	_, err = s.SignInSecondFactor(ctx, model.SecondFactor{Challenge: c, Code: codes[1]}, testClient)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("reused challenge error = %v, want ErrUnauthorized", err)
+	}
+}
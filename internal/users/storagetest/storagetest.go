@@ -0,0 +1,796 @@
+// Package storagetest holds the conformance suites every storage backend has
+// to pass. A backend's tests call RunUserStorage or RunSessionStorage with a
+// factory that returns an empty storage for every subtest.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/sillamilla/user_microservice/internal/users/Mongo_storage"
+	"github.com/sillamilla/user_microservice/internal/users/Redis_storage"
+	"github.com/sillamilla/user_microservice/internal/users/model"
+	"go.mongodb.org/mongo-driver/mongo"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// UserStorageFactory returns an empty user storage. It is called once per
+// subtest and may register cleanup with t.Cleanup.
+type UserStorageFactory func(t *testing.T) Mongo_storage.Storage
+
+// SessionStorageFactory returns an empty session storage.
+type SessionStorageFactory func(t *testing.T) Redis_storage.Storage
+
+// RunUserStorage checks that a user storage behaves like Mongo_storage.
+func RunUserStorage(t *testing.T, newStorage UserStorageFactory) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, db Mongo_storage.Storage)
+	}{
+		{"SignUpAndLookup", testSignUpAndLookup},
+		{"NotFound", testUserNotFound},
+		{"UniqueUsername", testUniqueUsername},
+		{"ConcurrentSignUp", testConcurrentSignUp},
+		{"UniqueEmail", testUniqueEmail},
+		{"EditProfile", testEditProfile},
+		{"EditPassword", testEditPassword},
+		{"Sessions", testUserSessions},
+		{"EmailVerified", testEmailVerified},
+		{"TOTP", testTOTP},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.run(t, newStorage(t))
+		})
+	}
+}
+
+// RunSessionStorage checks that a session storage behaves like Redis_storage.
+func RunSessionStorage(t *testing.T, newStorage SessionStorageFactory) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, db Redis_storage.Storage)
+	}{
+		{"Sessions", testSessions},
+		{"RefreshTokens", testRefreshTokens},
+		{"OneTimeTokens", testOneTimeTokens},
+		{"TOTP", testTOTPState},
+		{"LoginFailures", testLoginFailures},
+		{"Expiry", testExpiry},
+		{"SessionExpiry", testSessionExpiry},
+		{"UserCache", testUserCache},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.run(t, newStorage(t))
+		})
+	}
+}
+
+func newUser(id string, username string, email string) model.User {
+	user := model.UserFromInput(id, model.Input{Username: username, Email: email, Password: "hash-" + id}, time.Now())
+	return user
+}
+
+func signUp(t *testing.T, db Mongo_storage.Storage, user model.User) {
+	t.Helper()
+
+	err := db.SignUp(context.Background(), user)
+	if err != nil {
+		t.Fatalf("SignUp(%q): %v", user.Username, err)
+	}
+}
+
+// sameTime compares at millisecond precision, which is what Mongo keeps.
+func sameTime(a time.Time, b time.Time) bool {
+	return a.Truncate(time.Millisecond).Equal(b.Truncate(time.Millisecond))
+}
+
+func checkUser(t *testing.T, got model.User, want model.User) {
+	t.Helper()
+
+	if got.ID != want.ID || got.Username != want.Username || got.Email != want.Email || got.Password != want.Password {
+		t.Fatalf("got user %q/%q/%q, want %q/%q/%q", got.ID, got.Username, got.Email, want.ID, want.Username, want.Email)
+	}
+	if got.Version != want.Version {
+		t.Fatalf("got version %d, want %d", got.Version, want.Version)
+	}
+	if len(got.Roles) != len(want.Roles) {
+		t.Fatalf("got roles %v, want %v", got.Roles, want.Roles)
+	}
+	if !sameTime(got.CreatedAt, want.CreatedAt) {
+		t.Fatalf("got created at %v, want %v", got.CreatedAt, want.CreatedAt)
+	}
+}
+
+func expectNoDocuments(t *testing.T, op string, err error) {
+	t.Helper()
+
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		t.Fatalf("%s error = %v, want mongo.ErrNoDocuments", op, err)
+	}
+}
+
+func expectDuplicate(t *testing.T, op string, err error) {
+	t.Helper()
+
+	if !mongo.IsDuplicateKeyError(err) {
+		t.Fatalf("%s error = %v, want a duplicate key error", op, err)
+	}
+}
+
+func expectDuplicateUsername(t *testing.T, op string, err error) {
+	t.Helper()
+
+	if !Mongo_storage.IsDuplicateIndex(err, Mongo_storage.UsernameIndex) {
+		t.Fatalf("%s error = %v, want a duplicate username error", op, err)
+	}
+}
+
+func expectNil(t *testing.T, op string, err error) {
+	t.Helper()
+
+	if !errors.Is(err, redis.Nil) {
+		t.Fatalf("%s error = %v, want redis.Nil", op, err)
+	}
+}
+
+func must(t *testing.T, op string, err error) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatalf("%s: %v", op, err)
+	}
+}
+
+func testSignUpAndLookup(t *testing.T, db Mongo_storage.Storage) {
+	ctx := context.Background()
+	user := newUser("1", "alice", "Alice@Example.com")
+	signUp(t, db, user)
+
+	got, err := db.GetByID(ctx, "1")
+	must(t, "GetByID", err)
+	checkUser(t, got, user)
+
+	got, err = db.GetByUsername(ctx, "alice")
+	must(t, "GetByUsername", err)
+	checkUser(t, got, user)
+
+	got, err = db.GetByEmail(ctx, "alice@example.COM")
+	must(t, "GetByEmail", err)
+	checkUser(t, got, user)
+
+	got, err = db.SignIn(ctx, model.Input{Username: "alice", Password: user.Password})
+	must(t, "SignIn", err)
+	checkUser(t, got, user)
+
+	want := model.UserInfo{ID: "1", Username: "alice", Bio: user.Bio, Icon: user.Icon}
+	info, err := db.SearchByUsername(ctx, "ALICE")
+	must(t, "SearchByUsername", err)
+	if info != want {
+		t.Fatalf("SearchByUsername = %+v, want %+v", info, want)
+	}
+
+	info, err = db.GetPublicByID(ctx, "1")
+	must(t, "GetPublicByID", err)
+	if info != want {
+		t.Fatalf("GetPublicByID = %+v, want %+v", info, want)
+	}
+}
+
+func testUserNotFound(t *testing.T, db Mongo_storage.Storage) {
+	ctx := context.Background()
+	signUp(t, db, newUser("1", "alice", "alice@example.com"))
+
+	_, err := db.GetByID(ctx, "2")
+	expectNoDocuments(t, "GetByID", err)
+
+	_, err = db.GetByUsername(ctx, "bob")
+	expectNoDocuments(t, "GetByUsername", err)
+
+	_, err = db.GetByEmail(ctx, "bob@example.com")
+	expectNoDocuments(t, "GetByEmail", err)
+
+	_, err = db.GetBySession(ctx, "missing")
+	expectNoDocuments(t, "GetBySession", err)
+
+	_, err = db.SearchByUsername(ctx, "bob")
+	expectNoDocuments(t, "SearchByUsername", err)
+
+	_, err = db.GetPublicByID(ctx, "2")
+	expectNoDocuments(t, "GetPublicByID", err)
+
+	_, err = db.SignIn(ctx, model.Input{Username: "alice", Password: "wrong"})
+	expectNoDocuments(t, "SignIn with a wrong password", err)
+
+	err = db.EditPassword(ctx, "2", "hash", model.AnyVersion)
+	expectNoDocuments(t, "EditPassword", err)
+
+	bio := "bio"
+	err = db.EditProfile(ctx, "2", model.PatchUser{Bio: &bio}, model.AnyVersion)
+	expectNoDocuments(t, "EditProfile", err)
+
+	err = db.UpsertSession(ctx, "2", model.Session{ID: "s", Token: "t", UserID: "2"})
+	expectNoDocuments(t, "UpsertSession", err)
+}
+
+func testUniqueUsername(t *testing.T, db Mongo_storage.Storage) {
+	ctx := context.Background()
+	signUp(t, db, newUser("1", "alice", "alice@example.com"))
+	signUp(t, db, newUser("2", "bob", "bob@example.com"))
+
+	// Usernames are compared after NFKC normalization and case folding, the
+	// last one is written in fullwidth letters.
+	for _, username := range []string{"alice", "Alice", "ALICE", "\uff41\uff4c\uff49\uff43\uff45"} {
+		err := db.SignUp(ctx, newUser("3", username, "other@example.com"))
+		expectDuplicateUsername(t, "SignUp as "+username, err)
+
+		err = db.EditProfile(ctx, "2", model.PatchUser{Username: &username}, model.AnyVersion)
+		expectDuplicateUsername(t, "EditProfile to "+username, err)
+	}
+
+	got, err := db.GetByID(ctx, "2")
+	must(t, "GetByID", err)
+	if got.Username != "bob" || got.Version != 1 {
+		t.Fatalf("failed EditProfile changed the user: %q version %d", got.Username, got.Version)
+	}
+
+	got, err = db.GetByUsername(ctx, "ALICE")
+	must(t, "GetByUsername", err)
+	if got.ID != "1" || got.Username != "alice" {
+		t.Fatalf("GetByUsername(ALICE) = %q %q, want 1 alice", got.ID, got.Username)
+	}
+
+	// Changing the case of the own username is not a conflict.
+	username := "Alice"
+	err = db.EditProfile(ctx, "1", model.PatchUser{Username: &username}, model.AnyVersion)
+	must(t, "EditProfile to own username in another case", err)
+
+	got, err = db.GetByUsername(ctx, "alice")
+	must(t, "GetByUsername", err)
+	if got.Username != "Alice" {
+		t.Fatalf("Username = %q, want Alice", got.Username)
+	}
+}
+
+func testConcurrentSignUp(t *testing.T, db Mongo_storage.Storage) {
+	usernames := []string{"artist", "Artist", "ARTIST", "aRtIsT", "artisT", "ARTist", "\uff21rtist", "artiST"}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(usernames))
+	for i, username := range usernames {
+		wg.Add(1)
+		go func(i int, username string) {
+			defer wg.Done()
+			errs[i] = db.SignUp(context.Background(), newUser(strconv.Itoa(i), username, ""))
+		}(i, username)
+	}
+	wg.Wait()
+
+	created := 0
+	for i, err := range errs {
+		if err == nil {
+			created++
+			continue
+		}
+		expectDuplicateUsername(t, "SignUp as "+usernames[i], err)
+	}
+	if created != 1 {
+		t.Fatalf("%d of %d concurrent sign-ups succeeded, want 1", created, len(usernames))
+	}
+}
+
+func testUniqueEmail(t *testing.T, db Mongo_storage.Storage) {
+	ctx := context.Background()
+	signUp(t, db, newUser("1", "alice", "alice@example.com"))
+	signUp(t, db, newUser("2", "bob", ""))
+	signUp(t, db, newUser("3", "carol", ""))
+
+	err := db.SignUp(ctx, newUser("4", "dave", "ALICE@example.com"))
+	expectDuplicate(t, "SignUp with a taken email", err)
+
+	email := "Alice@Example.com"
+	err = db.EditProfile(ctx, "2", model.PatchUser{Email: &email}, model.AnyVersion)
+	expectDuplicate(t, "EditProfile to a taken email", err)
+}
+
+func testEditProfile(t *testing.T, db Mongo_storage.Storage) {
+	ctx := context.Background()
+	user := newUser("1", "alice", "alice@example.com")
+	signUp(t, db, user)
+
+	bio, icon := "hello", "https://example.com/a.png"
+	err := db.EditProfile(ctx, "1", model.PatchUser{Bio: &bio, Icon: &icon}, 1)
+	must(t, "EditProfile", err)
+
+	got, err := db.GetByID(ctx, "1")
+	must(t, "GetByID", err)
+	if got.Bio != bio || got.Icon != icon || got.Username != "alice" || got.Email != user.Email {
+		t.Fatalf("EditProfile stored %+v", got)
+	}
+	if got.Version != 2 {
+		t.Fatalf("version after EditProfile = %d, want 2", got.Version)
+	}
+
+	stale := "stale"
+	err = db.EditProfile(ctx, "1", model.PatchUser{Bio: &stale}, 1)
+	if !errors.Is(err, Mongo_storage.ErrVersionConflict) {
+		t.Fatalf("stale EditProfile error = %v, want ErrVersionConflict", err)
+	}
+
+	username := "alicia"
+	err = db.EditProfile(ctx, "1", model.PatchUser{Username: &username}, model.AnyVersion)
+	must(t, "EditProfile with AnyVersion", err)
+
+	got, err = db.GetByUsername(ctx, "alicia")
+	must(t, "GetByUsername", err)
+	if got.Bio != bio || got.Version != 3 {
+		t.Fatalf("after rename got bio %q version %d", got.Bio, got.Version)
+	}
+
+	_, err = db.GetByUsername(ctx, "alice")
+	expectNoDocuments(t, "GetByUsername of the old name", err)
+}
+
+func testEditPassword(t *testing.T, db Mongo_storage.Storage) {
+	ctx := context.Background()
+	user := newUser("1", "alice", "alice@example.com")
+	signUp(t, db, user)
+
+	err := db.EditPassword(ctx, "1", "new-hash", 1)
+	must(t, "EditPassword", err)
+
+	_, err = db.SignIn(ctx, model.Input{Username: "alice", Password: user.Password})
+	expectNoDocuments(t, "SignIn with the old password", err)
+
+	got, err := db.SignIn(ctx, model.Input{Username: "alice", Password: "new-hash"})
+	must(t, "SignIn with the new password", err)
+	if got.Version != 2 {
+		t.Fatalf("version after EditPassword = %d, want 2", got.Version)
+	}
+
+	err = db.EditPassword(ctx, "1", "other-hash", 1)
+	if !errors.Is(err, Mongo_storage.ErrVersionConflict) {
+		t.Fatalf("stale EditPassword error = %v, want ErrVersionConflict", err)
+	}
+}
+
+func testUserSessions(t *testing.T, db Mongo_storage.Storage) {
+	ctx := context.Background()
+	signUp(t, db, newUser("1", "alice", "alice@example.com"))
+
+	now := time.Now()
+	first := model.Session{ID: "s1", Token: "t1", UserID: "1", UserAgent: "a", IP: "127.0.0.1", CreatedAt: now, LastSeenAt: now, ExpiresAt: now.Add(time.Hour)}
+	second := model.Session{ID: "s2", Token: "t2", UserID: "1", UserAgent: "b", IP: "127.0.0.2", CreatedAt: now, LastSeenAt: now}
+	must(t, "UpsertSession", db.UpsertSession(ctx, "1", first))
+	must(t, "UpsertSession", db.UpsertSession(ctx, "1", second))
+
+	first.LastSeenAt = now.Add(time.Minute)
+	must(t, "UpsertSession of an existing token", db.UpsertSession(ctx, "1", first))
+
+	signUp(t, db, newUser("2", "bob", "bob@example.com"))
+	ids, err := db.SessionUserIDs(ctx)
+	must(t, "SessionUserIDs", err)
+	if len(ids) != 1 || ids[0] != "1" {
+		t.Fatalf("SessionUserIDs = %v, want [1]", ids)
+	}
+
+	got, err := db.GetBySession(ctx, "t1")
+	must(t, "GetBySession", err)
+	if got.ID != "1" {
+		t.Fatalf("GetBySession returned user %q", got.ID)
+	}
+	if len(got.Sessions) != 2 {
+		t.Fatalf("user has %d sessions, want 2", len(got.Sessions))
+	}
+	for _, session := range got.Sessions {
+		if session.Token == "t1" && !sameTime(session.LastSeenAt, first.LastSeenAt) {
+			t.Fatalf("upsert did not update last seen: %v", session.LastSeenAt)
+		}
+		if session.Token == "t1" && !sameTime(session.ExpiresAt, first.ExpiresAt) {
+			t.Fatalf("session expires at %v, want %v", session.ExpiresAt, first.ExpiresAt)
+		}
+		if session.Token == "t2" && !session.ExpiresAt.IsZero() {
+			t.Fatalf("session without expiry expires at %v", session.ExpiresAt)
+		}
+	}
+
+	must(t, "DeleteSession", db.DeleteSession(ctx, "1", "t1"))
+	_, err = db.GetBySession(ctx, "t1")
+	expectNoDocuments(t, "GetBySession of a deleted session", err)
+
+	third := model.Session{ID: "s3", Token: "t3", UserID: "1", CreatedAt: now, LastSeenAt: now}
+	must(t, "UpsertSession", db.UpsertSession(ctx, "1", third))
+	must(t, "DeleteOtherSessions", db.DeleteOtherSessions(ctx, "1", "t3"))
+
+	got, err = db.GetBySession(ctx, "t3")
+	must(t, "GetBySession of the kept session", err)
+	if len(got.Sessions) != 1 {
+		t.Fatalf("user has %d sessions after DeleteOtherSessions, want 1", len(got.Sessions))
+	}
+}
+
+func testEmailVerified(t *testing.T, db Mongo_storage.Storage) {
+	ctx := context.Background()
+	signUp(t, db, newUser("1", "alice", "alice@example.com"))
+
+	now := time.Now()
+	err := db.SetEmailVerified(ctx, "1", "other@example.com", &now)
+	expectNoDocuments(t, "SetEmailVerified for an outdated email", err)
+
+	version := versionOf(t, db, "1")
+	must(t, "SetEmailVerified", db.SetEmailVerified(ctx, "1", "alice@example.com", &now))
+	got, err := db.GetByID(ctx, "1")
+	must(t, "GetByID", err)
+	if got.EmailVerifiedAt == nil || !sameTime(*got.EmailVerifiedAt, now) {
+		t.Fatalf("email verified at = %v, want %v", got.EmailVerifiedAt, now)
+	}
+	expectNewVersion(t, "SetEmailVerified", got, version)
+
+	must(t, "SetEmailVerified(nil)", db.SetEmailVerified(ctx, "1", "alice@example.com", nil))
+	got, err = db.GetByID(ctx, "1")
+	must(t, "GetByID", err)
+	if got.EmailVerifiedAt != nil {
+		t.Fatalf("email still verified at %v", got.EmailVerifiedAt)
+	}
+}
+
+func testTOTP(t *testing.T, db Mongo_storage.Storage) {
+	ctx := context.Background()
+	signUp(t, db, newUser("1", "alice", "alice@example.com"))
+
+	version := versionOf(t, db, "1")
+	must(t, "EnableTOTP", db.EnableTOTP(ctx, "1", "secret", []string{"code-a", "code-b"}))
+	got, err := db.GetByID(ctx, "1")
+	must(t, "GetByID", err)
+	if !got.TOTPEnabled || got.TOTPSecret != "secret" || len(got.RecoveryCodes) != 2 {
+		t.Fatalf("EnableTOTP stored enabled=%v secret=%q codes=%v", got.TOTPEnabled, got.TOTPSecret, got.RecoveryCodes)
+	}
+	expectNewVersion(t, "EnableTOTP", got, version)
+
+	version = got.Version
+	used, err := db.UseRecoveryCode(ctx, "1", "code-a")
+	must(t, "UseRecoveryCode", err)
+	if !used {
+		t.Fatal("UseRecoveryCode did not accept a stored code")
+	}
+	got, err = db.GetByID(ctx, "1")
+	must(t, "GetByID", err)
+	expectNewVersion(t, "UseRecoveryCode", got, version)
+
+	version = got.Version
+	used, err = db.UseRecoveryCode(ctx, "1", "code-a")
+	must(t, "UseRecoveryCode", err)
+	if used {
+		t.Fatal("UseRecoveryCode accepted a code twice")
+	}
+	if got := versionOf(t, db, "1"); got != version {
+		t.Fatalf("UseRecoveryCode of a used code changed the version from %d to %d", version, got)
+	}
+
+	must(t, "DisableTOTP", db.DisableTOTP(ctx, "1"))
+	got, err = db.GetByID(ctx, "1")
+	must(t, "GetByID", err)
+	if got.TOTPEnabled || got.TOTPSecret != "" || len(got.RecoveryCodes) != 0 {
+		t.Fatalf("DisableTOTP left enabled=%v secret=%q codes=%v", got.TOTPEnabled, got.TOTPSecret, got.RecoveryCodes)
+	}
+	expectNewVersion(t, "DisableTOTP", got, version)
+}
+
+func versionOf(t *testing.T, db Mongo_storage.Storage, id string) int64 {
+	t.Helper()
+	user, err := db.GetByID(context.Background(), id)
+	must(t, "GetByID", err)
+	return user.Version
+}
+
+func expectNewVersion(t *testing.T, op string, user model.User, before int64) {
+	t.Helper()
+	if user.Version <= before {
+		t.Fatalf("%s left the version at %d, want it bumped from %d", op, user.Version, before)
+	}
+}
+
+func testSessions(t *testing.T, db Redis_storage.Storage) {
+	ctx := context.Background()
+	now := time.Now()
+
+	_, err := db.GetSession(ctx, "missing")
+	expectNil(t, "GetSession", err)
+
+	first := model.Session{ID: "s1", Token: "t1", UserID: "1", UserAgent: "a", IP: "127.0.0.1", CreatedAt: now, LastSeenAt: now}
+	second := model.Session{ID: "s2", Token: "t2", UserID: "1", CreatedAt: now, LastSeenAt: now}
+	other := model.Session{ID: "s3", Token: "t3", UserID: "2", CreatedAt: now, LastSeenAt: now}
+	for _, session := range []model.Session{first, second, other} {
+		must(t, "UpsertSession", db.UpsertSession(ctx, session, time.Hour))
+	}
+
+	got, err := db.GetSession(ctx, "t1")
+	must(t, "GetSession", err)
+	if got.ID != "s1" || got.UserID != "1" || got.UserAgent != "a" || !sameTime(got.CreatedAt, now) {
+		t.Fatalf("GetSession = %+v", got)
+	}
+
+	sessions, err := db.ListSessions(ctx, "1")
+	must(t, "ListSessions", err)
+	if len(sessions) != 2 {
+		t.Fatalf("ListSessions returned %d sessions, want 2", len(sessions))
+	}
+
+	ids, err := db.SessionUserIDs(ctx)
+	must(t, "SessionUserIDs", err)
+	sort.Strings(ids)
+	if len(ids) != 2 || ids[0] != "1" || ids[1] != "2" {
+		t.Fatalf("SessionUserIDs = %v, want [1 2]", ids)
+	}
+
+	must(t, "DeleteSession", db.DeleteSession(ctx, "1", "t1"))
+	_, err = db.GetSession(ctx, "t1")
+	expectNil(t, "GetSession of a deleted session", err)
+
+	sessions, err = db.ListSessions(ctx, "1")
+	must(t, "ListSessions", err)
+	if len(sessions) != 1 || sessions[0].Token != "t2" {
+		t.Fatalf("ListSessions after delete = %+v", sessions)
+	}
+
+	sessions, err = db.ListSessions(ctx, "unknown")
+	must(t, "ListSessions of an unknown user", err)
+	if len(sessions) != 0 {
+		t.Fatalf("ListSessions of an unknown user returned %d sessions", len(sessions))
+	}
+}
+
+func testRefreshTokens(t *testing.T, db Redis_storage.Storage) {
+	ctx := context.Background()
+	expiresAt := time.Now().Add(time.Hour)
+
+	_, err := db.GetRefreshToken(ctx, "missing")
+	expectNil(t, "GetRefreshToken", err)
+
+	first := model.RefreshToken{Hash: "h1", UserID: "1", Family: "f1", ExpiresAt: expiresAt}
+	second := model.RefreshToken{Hash: "h2", UserID: "1", Family: "f2", ExpiresAt: expiresAt}
+	must(t, "SaveRefreshToken", db.SaveRefreshToken(ctx, first))
+	must(t, "SaveRefreshToken", db.SaveRefreshToken(ctx, second))
+
+	got, err := db.GetRefreshToken(ctx, "h1")
+	must(t, "GetRefreshToken", err)
+	if got.UserID != "1" || got.Family != "f1" {
+		t.Fatalf("GetRefreshToken = %+v", got)
+	}
+
+	used, err := db.UseRefreshToken(ctx, first)
+	must(t, "UseRefreshToken", err)
+	if !used {
+		t.Fatal("first UseRefreshToken reported a replay")
+	}
+	used, err = db.UseRefreshToken(ctx, first)
+	must(t, "UseRefreshToken", err)
+	if used {
+		t.Fatal("second UseRefreshToken was accepted")
+	}
+
+	must(t, "RevokeRefreshFamily", db.RevokeRefreshFamily(ctx, "f1"))
+	checkFamily(t, db, "f1", false)
+	checkFamily(t, db, "f2", true)
+
+	must(t, "RevokeUserRefreshFamilies", db.RevokeUserRefreshFamilies(ctx, "1"))
+	checkFamily(t, db, "f2", false)
+}
+
+func checkFamily(t *testing.T, db Redis_storage.Storage, family string, want bool) {
+	t.Helper()
+
+	active, err := db.RefreshFamilyActive(context.Background(), family)
+	must(t, "RefreshFamilyActive", err)
+	if active != want {
+		t.Fatalf("family %s active = %v, want %v", family, active, want)
+	}
+}
+
+func testOneTimeTokens(t *testing.T, db Redis_storage.Storage) {
+	ctx := context.Background()
+
+	must(t, "SavePasswordReset", db.SavePasswordReset(ctx, "reset", "1", time.Hour))
+	userID, err := db.ConsumePasswordReset(ctx, "reset")
+	must(t, "ConsumePasswordReset", err)
+	if userID != "1" {
+		t.Fatalf("ConsumePasswordReset = %q", userID)
+	}
+	_, err = db.ConsumePasswordReset(ctx, "reset")
+	expectNil(t, "second ConsumePasswordReset", err)
+
+	verification := model.EmailVerification{UserID: "1", Email: "alice@example.com"}
+	must(t, "SaveEmailVerification", db.SaveEmailVerification(ctx, "verify", verification, time.Hour))
+	got, err := db.ConsumeEmailVerification(ctx, "verify")
+	must(t, "ConsumeEmailVerification", err)
+	if got != verification {
+		t.Fatalf("ConsumeEmailVerification = %+v", got)
+	}
+	_, err = db.ConsumeEmailVerification(ctx, "verify")
+	expectNil(t, "second ConsumeEmailVerification", err)
+
+	must(t, "SaveUnlockToken", db.SaveUnlockToken(ctx, "unlock", "alice", time.Hour))
+	username, err := db.ConsumeUnlockToken(ctx, "unlock")
+	must(t, "ConsumeUnlockToken", err)
+	if username != "alice" {
+		t.Fatalf("ConsumeUnlockToken = %q", username)
+	}
+	_, err = db.ConsumeUnlockToken(ctx, "unlock")
+	expectNil(t, "second ConsumeUnlockToken", err)
+
+	must(t, "SaveSignInChallenge", db.SaveSignInChallenge(ctx, "challenge", "1", time.Hour))
+	userID, err = db.GetSignInChallenge(ctx, "challenge")
+	must(t, "GetSignInChallenge", err)
+	if userID != "1" {
+		t.Fatalf("GetSignInChallenge = %q", userID)
+	}
+	must(t, "DeleteSignInChallenge", db.DeleteSignInChallenge(ctx, "challenge"))
+	_, err = db.GetSignInChallenge(ctx, "challenge")
+	expectNil(t, "GetSignInChallenge after delete", err)
+}
+
+func testTOTPState(t *testing.T, db Redis_storage.Storage) {
+	ctx := context.Background()
+
+	_, err := db.GetTOTPEnrollment(ctx, "1")
+	expectNil(t, "GetTOTPEnrollment", err)
+
+	must(t, "SaveTOTPEnrollment", db.SaveTOTPEnrollment(ctx, "1", "secret", time.Hour))
+	secret, err := db.GetTOTPEnrollment(ctx, "1")
+	must(t, "GetTOTPEnrollment", err)
+	if secret != "secret" {
+		t.Fatalf("GetTOTPEnrollment = %q", secret)
+	}
+	must(t, "DeleteTOTPEnrollment", db.DeleteTOTPEnrollment(ctx, "1"))
+	_, err = db.GetTOTPEnrollment(ctx, "1")
+	expectNil(t, "GetTOTPEnrollment after delete", err)
+
+	first, err := db.UseTOTPStep(ctx, "1", 42)
+	must(t, "UseTOTPStep", err)
+	again, err := db.UseTOTPStep(ctx, "1", 42)
+	must(t, "UseTOTPStep", err)
+	other, err := db.UseTOTPStep(ctx, "2", 42)
+	must(t, "UseTOTPStep", err)
+	if !first || again || !other {
+		t.Fatalf("UseTOTPStep = %v, %v, %v; want true, false, true", first, again, other)
+	}
+}
+
+func testLoginFailures(t *testing.T, db Redis_storage.Storage) {
+	ctx := context.Background()
+
+	ttl, err := db.LoginLockTTL(ctx, "user:alice")
+	must(t, "LoginLockTTL", err)
+	if ttl != 0 {
+		t.Fatalf("LoginLockTTL of an unlocked key = %v", ttl)
+	}
+
+	for want := int64(1); want <= 3; want++ {
+		failures, err := db.RegisterLoginFailure(ctx, "user:alice", time.Hour)
+		must(t, "RegisterLoginFailure", err)
+		if failures != want {
+			t.Fatalf("RegisterLoginFailure = %d, want %d", failures, want)
+		}
+	}
+
+	must(t, "LockLogin", db.LockLogin(ctx, "user:alice", time.Minute))
+	ttl, err = db.LoginLockTTL(ctx, "user:alice")
+	must(t, "LoginLockTTL", err)
+	if ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("LoginLockTTL = %v, want within (0, 1m]", ttl)
+	}
+
+	must(t, "ResetLoginFailures", db.ResetLoginFailures(ctx, "user:alice"))
+	ttl, err = db.LoginLockTTL(ctx, "user:alice")
+	must(t, "LoginLockTTL", err)
+	if ttl != 0 {
+		t.Fatalf("LoginLockTTL after reset = %v", ttl)
+	}
+	failures, err := db.RegisterLoginFailure(ctx, "user:alice", time.Hour)
+	must(t, "RegisterLoginFailure", err)
+	if failures != 1 {
+		t.Fatalf("RegisterLoginFailure after reset = %d, want 1", failures)
+	}
+}
+
+func testExpiry(t *testing.T, db Redis_storage.Storage) {
+	ctx := context.Background()
+	ttl := 50 * time.Millisecond
+
+	must(t, "SavePasswordReset", db.SavePasswordReset(ctx, "reset", "1", ttl))
+	must(t, "LockLogin", db.LockLogin(ctx, "user:alice", ttl))
+	must(t, "SaveRefreshToken", db.SaveRefreshToken(ctx, model.RefreshToken{Hash: "h", UserID: "1", Family: "f", ExpiresAt: time.Now().Add(ttl)}))
+
+	time.Sleep(2 * ttl)
+
+	_, err := db.ConsumePasswordReset(ctx, "reset")
+	expectNil(t, "ConsumePasswordReset after expiry", err)
+
+	lock, err := db.LoginLockTTL(ctx, "user:alice")
+	must(t, "LoginLockTTL", err)
+	if lock != 0 {
+		t.Fatalf("LoginLockTTL after expiry = %v", lock)
+	}
+
+	_, err = db.GetRefreshToken(ctx, "h")
+	expectNil(t, "GetRefreshToken after expiry", err)
+	checkFamily(t, db, "f", false)
+}
+
+func testSessionExpiry(t *testing.T, db Redis_storage.Storage) {
+	ctx := context.Background()
+	ttl := 50 * time.Millisecond
+	now := time.Now()
+
+	long := model.Session{ID: "s1", Token: "t1", UserID: "1", CreatedAt: now, LastSeenAt: now}
+	short := model.Session{ID: "s2", Token: "t2", UserID: "1", CreatedAt: now, LastSeenAt: now}
+	must(t, "UpsertSession", db.UpsertSession(ctx, long, 4*ttl))
+	must(t, "UpsertSession", db.UpsertSession(ctx, short, ttl))
+
+	time.Sleep(2 * ttl)
+
+	_, err := db.GetSession(ctx, "t2")
+	expectNil(t, "GetSession after expiry", err)
+
+	// The shorter session must not have cut the user's index short.
+	sessions, err := db.ListSessions(ctx, "1")
+	must(t, "ListSessions", err)
+	if len(sessions) != 1 || sessions[0].Token != "t1" {
+		t.Fatalf("ListSessions after one session expired = %+v", sessions)
+	}
+
+	// Upserting again extends the session.
+	must(t, "UpsertSession", db.UpsertSession(ctx, long, 4*ttl))
+	time.Sleep(3 * ttl)
+	_, err = db.GetSession(ctx, "t1")
+	must(t, "GetSession of an extended session", err)
+}
+
+func testUserCache(t *testing.T, db Redis_storage.Storage) {
+	ctx := context.Background()
+	ttl := 50 * time.Millisecond
+
+	_, err := db.GetCachedUser(ctx, "1")
+	expectNil(t, "GetCachedUser of an uncached user", err)
+
+	user := Redis_storage.UserStorage{ID: "1", Username: "alice", Bio: "bio", Icon: "icon"}
+	must(t, "CacheUser", db.CacheUser(ctx, user, time.Minute))
+	cached, err := db.GetCachedUser(ctx, "1")
+	must(t, "GetCachedUser", err)
+	if cached != user {
+		t.Fatalf("GetCachedUser = %+v, want %+v", cached, user)
+	}
+
+	// Invalidating drops the user and keeps it out for the hold.
+	must(t, "InvalidateCachedUser", db.InvalidateCachedUser(ctx, "1", ttl))
+	_, err = db.GetCachedUser(ctx, "1")
+	expectNil(t, "GetCachedUser after invalidation", err)
+	must(t, "CacheUser", db.CacheUser(ctx, user, time.Minute))
+	_, err = db.GetCachedUser(ctx, "1")
+	expectNil(t, "GetCachedUser cached during the hold", err)
+
+	time.Sleep(2 * ttl)
+	must(t, "CacheUser", db.CacheUser(ctx, user, ttl))
+	_, err = db.GetCachedUser(ctx, "1")
+	must(t, "GetCachedUser cached after the hold", err)
+
+	must(t, "CacheUserID", db.CacheUserID(ctx, "username:alice", "1", ttl))
+	id, err := db.GetCachedUserID(ctx, "username:alice")
+	must(t, "GetCachedUserID", err)
+	if id != "1" {
+		t.Fatalf("GetCachedUserID = %q, want 1", id)
+	}
+
+	time.Sleep(2 * ttl)
+	_, err = db.GetCachedUser(ctx, "1")
+	expectNil(t, "GetCachedUser after expiry", err)
+	_, err = db.GetCachedUserID(ctx, "username:alice")
+	expectNil(t, "GetCachedUserID after expiry", err)
+}
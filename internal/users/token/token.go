@@ -0,0 +1,199 @@
+package token
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"strings"
+	"time"
+)
+
+const (
+	HS256 = "HS256"
+	EdDSA = "EdDSA"
+	RS256 = "RS256"
+)
+
+var ErrInvalidToken = errors.New("invalid token")
+
+type Claims struct {
+	Username string   `json:"username"`
+	Roles    []string `json:"roles"`
+	jwt.RegisteredClaims
+}
+
+type Config struct {
+	// Algorithm is one of HS256, EdDSA (Ed25519) or RS256.
+	Algorithm string
+	// Secret is the shared key used by HS256.
+	Secret string
+	// PrivateKey is a PEM encoded PKCS#8 (Ed25519, RSA) or PKCS#1 (RSA) key.
+	PrivateKey string
+	Issuer     string
+	AccessTTL  time.Duration
+}
+
+type Manager struct {
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+	issuer    string
+	accessTTL time.Duration
+}
+
+func New(cfg Config) (*Manager, error) {
+	m := &Manager{
+		issuer:    cfg.Issuer,
+		accessTTL: cfg.AccessTTL,
+	}
+
+	switch cfg.Algorithm {
+	case HS256:
+		if cfg.Secret == "" {
+			return nil, errors.New("token.New: HS256 requires a secret")
+		}
+		m.method = jwt.SigningMethodHS256
+		m.signKey = []byte(cfg.Secret)
+		m.verifyKey = []byte(cfg.Secret)
+	case EdDSA:
+		key, err := parsePrivateKey(cfg.PrivateKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "token.New")
+		}
+		edKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("token.New: EdDSA requires an Ed25519 private key")
+		}
+		m.method = jwt.SigningMethodEdDSA
+		m.signKey = edKey
+		m.verifyKey = edKey.Public()
+	case RS256:
+		key, err := parsePrivateKey(cfg.PrivateKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "token.New")
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("token.New: RS256 requires an RSA private key")
+		}
+		m.method = jwt.SigningMethodRS256
+		m.signKey = rsaKey
+		m.verifyKey = &rsaKey.PublicKey
+	default:
+		return nil, errors.Errorf("token.New: unsupported algorithm %q", cfg.Algorithm)
+	}
+
+	return m, nil
+}
+
+// PublicKey returns the key other services need to verify access tokens. For
+// HS256 this is the shared secret.
+func (m *Manager) PublicKey() interface{} {
+	return m.verifyKey
+}
+
+func (m *Manager) Issue(userID string, username string, roles []string) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(m.accessTTL)
+
+	claims := Claims{
+		Username: username,
+		Roles:    roles,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Issuer:    m.issuer,
+			Subject:   userID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+
+	signed, err := jwt.NewWithClaims(m.method, claims).SignedString(m.signKey)
+	if err != nil {
+		return "", time.Time{}, errors.Wrap(err, "token.Issue")
+	}
+
+	return signed, expiresAt, nil
+}
+
+func (m *Manager) Verify(tokenString string) (Claims, error) {
+	var claims Claims
+
+	_, err := jwt.ParseWithClaims(tokenString, &claims, func(t *jwt.Token) (interface{}, error) {
+		return m.verifyKey, nil
+	}, jwt.WithValidMethods([]string{m.method.Alg()}), jwt.WithIssuer(m.issuer), jwt.WithExpirationRequired())
+	if err != nil {
+		return Claims{}, errors.Wrap(ErrInvalidToken, err.Error())
+	}
+
+	return claims, nil
+}
+
+// NewOpaque returns a random opaque token, used for refresh and password
+// reset tokens, and the digest that is persisted instead of the token itself.
+func NewOpaque() (string, string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", "", errors.Wrap(err, "token.NewOpaque")
+	}
+
+	plain := base64.RawURLEncoding.EncodeToString(b)
+	return plain, Hash(plain), nil
+}
+
+// SessionPrefix starts every session token, so they can be told apart from
+// access tokens and recognized when they leak, e.g. by secret scanners.
+const SessionPrefix = "mhs_"
+
+// NewSession returns a session token with 256 random bits and its digest.
+// Only the digest is persisted, the token is handed to the client once.
+func NewSession() (string, string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", "", errors.Wrap(err, "token.NewSession")
+	}
+
+	plain := SessionPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return plain, Hash(plain), nil
+}
+
+// IsSession reports whether credential looks like a token from NewSession.
+// Sessions issued before tokens were prefixed fail this check.
+func IsSession(credential string) bool {
+	return strings.HasPrefix(credential, SessionPrefix)
+}
+
+// Hash returns the hex SHA-256 digest under which opaque tokens are stored.
+func Hash(plain string) string {
+	sum := sha256.Sum256([]byte(plain))
+	return hex.EncodeToString(sum[:])
+}
+
+func parsePrivateKey(data string) (interface{}, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("private key is not PEM encoded")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err == nil {
+		return key, nil
+	}
+
+	rsaKey, rsaErr := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if rsaErr == nil {
+		return rsaKey, nil
+	}
+
+	return nil, errors.Wrap(err, "parse private key")
+}
@@ -0,0 +1,162 @@
+package token
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pkg/errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newManager(t *testing.T, cfg Config) *Manager {
+	t.Helper()
+
+	if cfg.Issuer == "" {
+		cfg.Issuer = "test"
+	}
+	if cfg.AccessTTL == 0 {
+		cfg.AccessTTL = time.Minute
+	}
+	m, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func pemKey(t *testing.T, key interface{}) string {
+	t.Helper()
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+func TestIssueAndVerify(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configs := []Config{
+		{Algorithm: HS256, Secret: "secret"},
+		{Algorithm: EdDSA, PrivateKey: pemKey(t, edKey)},
+		{Algorithm: RS256, PrivateKey: pemKey(t, rsaKey)},
+	}
+	for _, cfg := range configs {
+		t.Run(cfg.Algorithm, func(t *testing.T) {
+			m := newManager(t, cfg)
+
+			signed, expiresAt, err := m.Issue("1", "alice", []string{"user"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims, err := m.Verify(signed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.Subject != "1" || claims.Username != "alice" || !claims.ExpiresAt.Time.Equal(expiresAt.Truncate(time.Second)) {
+				t.Fatalf("Verify = %+v", claims)
+			}
+		})
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaManager := newManager(t, Config{Algorithm: RS256, PrivateKey: pemKey(t, rsaKey)})
+	hsManager := newManager(t, Config{Algorithm: HS256, Secret: "secret"})
+
+	publicDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}))
+
+	sign := func(method jwt.SigningMethod, key interface{}, claims jwt.Claims) string {
+		signed, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	valid := jwt.RegisteredClaims{
+		Subject:   "1",
+		Issuer:    "test",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}
+	issue := func(m *Manager) string {
+		signed, _, err := m.Issue("1", "alice", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	expired := newManager(t, Config{Algorithm: HS256, Secret: "secret", AccessTTL: -time.Minute})
+	otherKey := newManager(t, Config{Algorithm: HS256, Secret: "other"})
+	otherIssuer := newManager(t, Config{Algorithm: HS256, Secret: "secret", Issuer: "other"})
+	noExpiry := valid
+	noExpiry.ExpiresAt = nil
+
+	tests := []struct {
+		name   string
+		m      *Manager
+		signed string
+	}{
+		{"expired", hsManager, issue(expired)},
+		{"wrong key", hsManager, issue(otherKey)},
+		{"wrong issuer", hsManager, issue(otherIssuer)},
+		{"no expiry", hsManager, sign(jwt.SigningMethodHS256, []byte("secret"), noExpiry)},
+		{"other algorithm", hsManager, issue(rsaManager)},
+		// HS256 signed with the RSA public key, the classic algorithm
+		// confusion against RS256 verifiers.
+		{"public key as HMAC secret", rsaManager, sign(jwt.SigningMethodHS256, []byte(publicPEM), valid)},
+		{"none", hsManager, sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, valid)},
+		{"tampered", hsManager, strings.Replace(issue(hsManager), ".", ".x", 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.m.Verify(tt.signed)
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("Verify error = %v, want ErrInvalidToken", err)
+			}
+		})
+	}
+}
+
+func TestNewRejectsMismatchedKey(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = New(Config{Algorithm: RS256, PrivateKey: pemKey(t, edKey)})
+	if err == nil {
+		t.Fatal("New accepted an Ed25519 key for RS256")
+	}
+	_, err = New(Config{Algorithm: HS256})
+	if err == nil {
+		t.Fatal("New accepted HS256 without a secret")
+	}
+	_, err = New(Config{Algorithm: "none", Secret: "secret"})
+	if err == nil {
+		t.Fatal("New accepted the none algorithm")
+	}
+}
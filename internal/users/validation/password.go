@@ -0,0 +1,115 @@
+package validation
+
+import (
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// commonPasswords are rejected outright and count as a single character when
+// they appear inside a longer password.
+var commonPasswords = []string{
+	"password", "passw0rd", "p@ssw0rd", "123456", "1234567890", "000000",
+	"111111", "qwerty", "qwertyuiop", "asdfgh", "zxcvbn", "abc123",
+	"letmein", "welcome", "iloveyou", "admin", "master", "shadow", "dragon",
+	"monkey", "football", "baseball", "sunshine", "princess", "superman",
+	"trustno1", "music", "musichub",
+}
+
+// PasswordScore estimates how hard password is to guess, from 0 (trivial) to
+// 4 (strong). It works out the entropy from the character classes used and
+// the length, where repeated and sequential characters, common passwords and
+// any of userInputs count as a single character.
+func PasswordScore(password string, userInputs ...string) int {
+	lower := strings.ToLower(password)
+	for _, common := range commonPasswords {
+		if lower == common {
+			return 0
+		}
+	}
+
+	length := utf8.RuneCountInString(password)
+	guessable := append(commonPasswords[:len(commonPasswords):len(commonPasswords)], userInputs...)
+	for _, input := range userInputs {
+		local, _, ok := strings.Cut(input, "@")
+		if ok {
+			guessable = append(guessable, local)
+		}
+	}
+	for _, word := range guessable {
+		word = strings.ToLower(word)
+		if utf8.RuneCountInString(word) < 3 {
+			continue
+		}
+		length -= strings.Count(lower, word) * (utf8.RuneCountInString(word) - 1)
+	}
+
+	// Runs like "aaaa", "abcd" or "4321" add nothing after their first rune.
+	var previous rune
+	for i, r := range []rune(lower) {
+		if i > 0 && (r == previous || r == previous+1 || r == previous-1) {
+			length--
+		}
+		previous = r
+	}
+	if length < 1 {
+		return 0
+	}
+
+	bits := float64(length) * math.Log2(float64(poolSize(password)))
+	switch {
+	case bits < 25:
+		return 0
+	case bits < 40:
+		return 1
+	case bits < 60:
+		return 2
+	case bits < 80:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// poolSize is the number of characters an attacker has to try per position
+// given the classes password draws from.
+func poolSize(password string) int {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range password {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < utf8.RuneSelf && unicode.IsPrint(r):
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	size := 0
+	if lower {
+		size += 26
+	}
+	if upper {
+		size += 26
+	}
+	if digit {
+		size += 10
+	}
+	if symbol {
+		size += 33
+	}
+	if other {
+		size += 100
+	}
+	if size < 2 {
+		return 2
+	}
+
+	return size
+}
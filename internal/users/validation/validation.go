@@ -0,0 +1,206 @@
+// Package validation checks usernames and passwords against a configurable
+// policy. Problems are reported per field so clients can show them next to
+// the right input.
+package validation
+
+import (
+	"github.com/sillamilla/user_microservice/internal/users/model"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Field error codes, stable for clients to match on.
+const (
+	CodeRequired          = "required"
+	CodeTooShort          = "too_short"
+	CodeTooLong           = "too_long"
+	CodeInvalid           = "invalid"
+	CodeInvalidCharacters = "invalid_characters"
+	CodeReserved          = "reserved"
+	CodeBlocked           = "blocked"
+	CodeTooWeak           = "too_weak"
+	CodeBreached          = "breached"
+	CodeMismatch          = "mismatch"
+)
+
+// FieldError is one problem with one input field. Field is the JSON name of
+// the field and Message is safe to show to users.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// Config is the policy. Zero values are replaced by the defaults below.
+type Config struct {
+	UsernameMinLength int
+	UsernameMaxLength int
+	// UsernameSymbols are allowed besides letters and digits, but not as the
+	// first or last character.
+	UsernameSymbols string
+	// UsernameASCIIOnly rejects letters and digits outside of ASCII.
+	UsernameASCIIOnly bool
+	// Reserved usernames can not be taken by anyone. They are added to
+	// DefaultReserved.
+	Reserved []string
+	// Blocklist words must not appear anywhere in a username.
+	Blocklist []string
+
+	PasswordMinLength int
+	// PasswordMinScore is the lowest PasswordScore accepted, from 0 to 4.
+	PasswordMinScore int
+}
+
+const (
+	defaultUsernameMinLength = 3
+	defaultUsernameMaxLength = 32
+	defaultUsernameSymbols   = "._-"
+	defaultPasswordMinLength = 10
+	defaultPasswordMinScore  = 2
+
+	// maxPasswordBytes keeps the cost of hashing bounded.
+	maxPasswordBytes = 1024
+)
+
+// DefaultReserved are names that could be mistaken for the service or its
+// staff, or that collide with routes.
+var DefaultReserved = []string{
+	"admin", "administrator", "root", "system", "support", "help", "api",
+	"www", "mail", "musichub", "moderator", "staff", "security", "official",
+	"null", "undefined", "settings", "login", "logout", "signin", "signup",
+}
+
+type Validator struct {
+	cfg       Config
+	reserved  map[string]bool
+	blocklist []string
+}
+
+func New(cfg Config) *Validator {
+	if cfg.UsernameMinLength == 0 {
+		cfg.UsernameMinLength = defaultUsernameMinLength
+	}
+	if cfg.UsernameMaxLength == 0 {
+		cfg.UsernameMaxLength = defaultUsernameMaxLength
+	}
+	if cfg.UsernameSymbols == "" {
+		cfg.UsernameSymbols = defaultUsernameSymbols
+	}
+	if cfg.PasswordMinLength == 0 {
+		cfg.PasswordMinLength = defaultPasswordMinLength
+	}
+	if cfg.PasswordMinScore == 0 {
+		cfg.PasswordMinScore = defaultPasswordMinScore
+	}
+
+	v := &Validator{
+		cfg:      cfg,
+		reserved: make(map[string]bool),
+	}
+	for _, name := range append(DefaultReserved, cfg.Reserved...) {
+		v.reserved[v.compact(name)] = true
+	}
+	for _, word := range cfg.Blocklist {
+		word = v.compact(word)
+		if word != "" {
+			v.blocklist = append(v.blocklist, word)
+		}
+	}
+
+	return v
+}
+
+// Username checks a new username. Reserved names and blocklisted words are
+// matched after normalization with the symbols removed, so "Ad.min" is
+// reserved too.
+func (v *Validator) Username(username string) *FieldError {
+	length := utf8.RuneCountInString(username)
+	switch {
+	case length == 0:
+		return fieldError("username", CodeRequired, "Username is required")
+	case length < v.cfg.UsernameMinLength:
+		return fieldError("username", CodeTooShort, "Username must be at least "+strconv.Itoa(v.cfg.UsernameMinLength)+" characters")
+	case length > v.cfg.UsernameMaxLength:
+		return fieldError("username", CodeTooLong, "Username must be at most "+strconv.Itoa(v.cfg.UsernameMaxLength)+" characters")
+	}
+
+	runes := []rune(username)
+	for i, r := range runes {
+		if v.isSymbol(r) && i != 0 && i != len(runes)-1 {
+			continue
+		}
+		if (unicode.IsLetter(r) || unicode.IsDigit(r)) && (!v.cfg.UsernameASCIIOnly || r < utf8.RuneSelf) {
+			continue
+		}
+
+		return fieldError("username", CodeInvalidCharacters, v.charactersMessage())
+	}
+
+	compact := v.compact(username)
+	if v.reserved[compact] {
+		return fieldError("username", CodeReserved, "Username is reserved")
+	}
+	for _, word := range v.blocklist {
+		if strings.Contains(compact, word) {
+			return fieldError("username", CodeBlocked, "Username contains a word that is not allowed")
+		}
+	}
+
+	return nil
+}
+
+// Password checks a new password. userInputs are the username, email and
+// similar values that make a password easy to guess when it contains them.
+func (v *Validator) Password(password string, userInputs ...string) *FieldError {
+	switch {
+	case password == "":
+		return fieldError("password", CodeRequired, "Password is required")
+	case utf8.RuneCountInString(password) < v.cfg.PasswordMinLength:
+		return fieldError("password", CodeTooShort, "Password must be at least "+strconv.Itoa(v.cfg.PasswordMinLength)+" characters")
+	case len(password) > maxPasswordBytes:
+		return fieldError("password", CodeTooLong, "Password must be at most "+strconv.Itoa(maxPasswordBytes)+" bytes")
+	case PasswordScore(password, userInputs...) < v.cfg.PasswordMinScore:
+		return fieldError("password", CodeTooWeak, "Password is too easy to guess, use a longer password or a few unrelated words")
+	}
+
+	return nil
+}
+
+func (v *Validator) charactersMessage() string {
+	letters := "letters"
+	if v.cfg.UsernameASCIIOnly {
+		letters = "latin letters"
+	}
+
+	return "Username may only contain " + letters + ", digits and " + strings.Join(strings.Split(v.cfg.UsernameSymbols, ""), " ") +
+		", and must start and end with a letter or digit"
+}
+
+func (v *Validator) isSymbol(r rune) bool {
+	return strings.ContainsRune(v.cfg.UsernameSymbols, r)
+}
+
+// compact normalizes s like a username key and drops everything that is not
+// a letter or digit.
+func (v *Validator) compact(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, model.NormalizeUsername(s))
+}
+
+func fieldError(field string, code string, message string) *FieldError {
+	return &FieldError{
+		Field:   field,
+		Code:    code,
+		Message: message,
+	}
+}
@@ -0,0 +1,79 @@
+package validation
+
+import "testing"
+
+func TestUsername(t *testing.T) {
+	v := New(Config{Blocklist: []string{"badword"}})
+
+	tests := []struct {
+		username string
+		code     string
+	}{
+		{"alice", ""},
+		{"dj.shadow_99", ""},
+		{"Ÿoko", ""},
+		{"", CodeRequired},
+		{"al", CodeTooShort},
+		{"a123456789012345678901234567890123", CodeTooLong},
+		{"alice!", CodeInvalidCharacters},
+		{".alice", CodeInvalidCharacters},
+		{"alice-", CodeInvalidCharacters},
+		{"al ice", CodeInvalidCharacters},
+		{"Admin", CodeReserved},
+		{"ad.min", CodeReserved},
+		{"ＭｕｓｉｃＨｕｂ", CodeReserved},
+		{"the_BadWord_fan", CodeBlocked},
+	}
+
+	for _, tt := range tests {
+		err := v.Username(tt.username)
+		code := ""
+		if err != nil {
+			code = err.Code
+		}
+		if code != tt.code {
+			t.Errorf("Username(%q) = %q, want %q", tt.username, code, tt.code)
+		}
+	}
+}
+
+func TestUsernameASCIIOnly(t *testing.T) {
+	v := New(Config{UsernameASCIIOnly: true})
+
+	err := v.Username("Ÿoko")
+	if err == nil || err.Code != CodeInvalidCharacters {
+		t.Fatalf("Username = %v, want %s", err, CodeInvalidCharacters)
+	}
+}
+
+func TestPassword(t *testing.T) {
+	v := New(Config{})
+
+	tests := []struct {
+		password   string
+		userInputs []string
+		code       string
+	}{
+		{"correct horse battery staple", nil, ""},
+		{"Tr0ub4dor&3x", nil, ""},
+		{"", nil, CodeRequired},
+		{"short", nil, CodeTooShort},
+		{"1234567890", nil, CodeTooWeak},
+		{"aaaaaaaaaaaa", nil, CodeTooWeak},
+		{"password12345", nil, CodeTooWeak},
+		{"alice2024!!", []string{"alice", "alice@example.com"}, CodeTooWeak},
+		{"alicesmith99", []string{"bob", "alicesmith@example.com"}, CodeTooWeak},
+		{string(make([]byte, 1025)), nil, CodeTooLong},
+	}
+
+	for _, tt := range tests {
+		err := v.Password(tt.password, tt.userInputs...)
+		code := ""
+		if err != nil {
+			code = err.Code
+		}
+		if code != tt.code {
+			t.Errorf("Password(%q) = %q (score %d), want %q", tt.password, code, PasswordScore(tt.password, tt.userInputs...), tt.code)
+		}
+	}
+}